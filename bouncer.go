@@ -10,7 +10,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
@@ -18,11 +21,20 @@ import (
 	"text/template"
 	"time"
 
+	bypass "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/bypass"
 	cache "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/cache"
 	captcha "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/captcha"
 	configuration "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/configuration"
+	geo "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/geo"
+	goodbot "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/goodbot"
 	ip "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/ip"
 	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+	policy "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/policy"
+	redirect "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/redirect"
+	response "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/response"
+	rules "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/rules"
+	scope "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/scope"
+	throttle "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/throttle"
 )
 
 const (
@@ -36,11 +48,38 @@ const (
 	crowdsecLapiRoute        = "v1/decisions"
 	crowdsecLapiStreamRoute  = "v1/decisions/stream"
 	crowdsecLapiMetricsRoute = "v1/usage-metrics"
+	crowdsecAllowlistsRoute  = "v1/allowlists"
+	crowdsecAllowCheckRoute  = "v1/allowlists/check/"
 	crowdsecCapiHost         = "api.crowdsec.net"
 	crowdsecCapiHeader       = "Authorization"
 	crowdsecCapiLoginRoute   = "v2/watchers/login"
 	crowdsecCapiStreamRoute  = "v2/decisions/stream"
 	cacheTimeoutKey          = "updated"
+	allowlistKeyPrefix       = "allowlist:"
+	simulatedPrefix          = "s"
+	decisionInfoPrefix       = "decision:"
+	prefixMembersPrefix      = "prefix:"
+	dryRunKeyPrefix          = "dryrun:"
+	// dryRunLogSeconds the dry run of a remediation is logged at INFO level once per IP in this duration.
+	dryRunLogSeconds = 60
+)
+
+// Protocols of the requests blocked with a specific response, see requestProtocol.
+const (
+	protocolGRPC      = "grpc"
+	protocolWebSocket = "websocket"
+	protocolSSE       = "sse"
+	grpcBlockMessage  = "request blocked by CrowdSec"
+	// RESOURCE_EXHAUSTED, the gRPC status of the throttled requests.
+	grpcThrottleStatusCode = 8
+	grpcThrottleMessage    = "request throttled by CrowdSec"
+)
+
+// Headers forwarded to the service in annotate mode, copies sent by the client are removed.
+const (
+	annotateRemediationHeader   = "X-Crowdsec-Remediation"
+	annotateScenarioHeader      = "X-Crowdsec-Scenario"
+	annotateCaptchaPassedHeader = "X-Crowdsec-Captcha-Passed"
 )
 
 // ##############################################################
@@ -66,9 +105,15 @@ var (
 	isCrowdsecStreamHealthy = true
 	updateFailure           int64
 	streamTicker            chan bool
+	allowlistsTicker        chan bool
 	metricsTicker           chan bool
 	lastMetricsPush         time.Time
 	blockedRequests         int64
+	bypassedRequests        int64
+	dryRunRequests          int64
+	tarpittedConnections    int64
+	// allowlistChecker holds the content of the CrowdSec allowlists pulled in stream mode.
+	allowlistChecker = &ip.Checker{}
 )
 
 // CreateConfig creates the default plugin configuration.
@@ -102,11 +147,41 @@ type Bouncer struct {
 	defaultDecisionTimeout  int64
 	remediationStatusCode   int
 	remediationCustomHeader string
-	forwardedCustomHeader   string
+	forwardedHeaders        []string
+	deepChain               bool
+	deepChainMaxHops        int
+	ipv6PrefixLength        int
+	geoCountry              *geo.Reader
+	geoASN                  *geo.Reader
+	countryAllowList        []string
+	countryDenyList         []string
+	customScopes            []*scope.Extractor
+	goodBots                *goodbot.Verifier
+	bypassRules             *bypass.Rules
+	requestRules            []*rules.Rule
+	allowlistsEnabled       bool
+	remediationPolicies     []*policy.Policy
+	dryRun                  bool
+	dryRunRemediations      []string
+	dryRunHeader            string
+	annotate                bool
+	redirect                *redirect.Redirect
+	tarpitDelay             time.Duration
+	tarpitInterval          time.Duration
+	tarpitMaxConnections    int64
+	throttle                *throttle.Limiter
+	grpcStatusCode          int
+	webSocketStatusCode     int
+	sseStatusCode           int
 	crowdsecStreamRoute     string
 	crowdsecHeader          string
 	redisUnreachableBlock   bool
-	banTemplateString       string
+	banPages                *response.Pages
+	defaultLanguage         string
+	hostBans                []*hostBan
+	banSecurityPolicy       string
+	responses               *response.Renderer
+	apiPathPrefixes         []string
 	clientPoolStrategy      *ip.PoolStrategy
 	serverPoolStrategy      *ip.PoolStrategy
 	httpClient              *http.Client
@@ -118,7 +193,7 @@ type Bouncer struct {
 // New creates the crowdsec bouncer plugin.
 //
 //nolint:gocyclo
-func New(_ context.Context, next http.Handler, config *configuration.Config, name string) (http.Handler, error) {
+func New(ctx context.Context, next http.Handler, config *configuration.Config, name string) (http.Handler, error) {
 	config.LogLevel = strings.ToUpper(config.LogLevel)
 	log := logger.New(config.LogLevel, config.LogFilePath)
 	err := configuration.ValidateParams(config)
@@ -128,6 +203,13 @@ func New(_ context.Context, next http.Handler, config *configuration.Config, nam
 	}
 
 	serverChecker, _ := ip.NewChecker(log, config.ForwardedHeadersTrustedIPs)
+	if config.ForwardedHeadersTrustedIPsFile != "" {
+		err = serverChecker.WithFile(ctx, log, config.ForwardedHeadersTrustedIPsFile, config.TrustedIPsFileRefreshSeconds)
+		if err != nil {
+			log.Error("New:forwardedHeadersTrustedIPsFile " + err.Error())
+			return nil, err
+		}
+	}
 	clientChecker, _ := ip.NewChecker(log, config.ClientTrustedIPs)
 
 	var tlsConfig *tls.Config
@@ -159,16 +241,94 @@ func New(_ context.Context, next http.Handler, config *configuration.Config, nam
 		config.CrowdsecLapiKey = apiKey
 	}
 
-	var banTemplateString string
+	var banPages *response.Pages
 	if config.BanHTMLFilePath != "" {
-		var buf bytes.Buffer
-		banTemplate, _ := configuration.GetHTMLTemplate(config.BanHTMLFilePath)
-		err = banTemplate.Execute(&buf, nil)
+		banPages, err = getBanPages(config.BanHTMLFilePath)
 		if err != nil {
 			log.Error("New:banTemplate is bad formatted " + err.Error())
 			return nil, err
 		}
-		banTemplateString = buf.String()
+		warnMissingNonce(log, config.BanContentSecurityPolicy, config.BanHTMLFilePath, banPages)
+	}
+	hostOverrides, _ := configuration.GetHostOverrides(config)
+	hostBans := make([]*hostBan, 0, len(hostOverrides))
+	for _, hostOverride := range hostOverrides {
+		pages := banPages
+		if hostOverride.BanHTMLFilePath != "" {
+			pages, err = getBanPages(hostOverride.BanHTMLFilePath)
+			if err != nil {
+				log.Error("New:hostOverrides banTemplate is bad formatted " + err.Error())
+				return nil, err
+			}
+			warnMissingNonce(log, config.BanContentSecurityPolicy, hostOverride.BanHTMLFilePath, pages)
+		}
+		hostBans = append(hostBans, &hostBan{host: hostOverride.Host, pages: pages})
+	}
+	responses, err := response.New(config.BanJSONFilePath, config.BanTextFilePath)
+	if err != nil {
+		log.Error("New:banJsonFilePath or banTextFilePath " + err.Error())
+		return nil, err
+	}
+
+	var geoCountry, geoASN *geo.Reader
+	if config.GeoCountryDatabaseFilePath != "" {
+		geoCountry, err = geo.Open(config.GeoCountryDatabaseFilePath)
+		if err != nil {
+			log.Error("New:geoCountryDatabaseFilePath " + err.Error())
+			return nil, err
+		}
+	}
+	if config.GeoASNDatabaseFilePath != "" {
+		geoASN, err = geo.Open(config.GeoASNDatabaseFilePath)
+		if err != nil {
+			log.Error("New:geoAsnDatabaseFilePath " + err.Error())
+			return nil, err
+		}
+	}
+
+	config.CustomScopesJwtSecret, _ = configuration.GetVariable(config, "CustomScopesJwtSecret")
+	customScopes := make([]*scope.Extractor, 0, len(config.CustomScopes))
+	for _, definition := range config.CustomScopes {
+		extractor, errScope := scope.Parse(definition, config.CustomScopesJwtSecret)
+		if errScope != nil {
+			log.Error("New:customScopes " + errScope.Error())
+			return nil, errScope
+		}
+		customScopes = append(customScopes, extractor)
+	}
+
+	requestRules, err := configuration.GetRequestRules(config)
+	if err != nil {
+		log.Error("New:requestRules " + err.Error())
+		return nil, err
+	}
+
+	remediationPolicies, err := configuration.GetRemediationPolicies(config)
+	if err != nil {
+		log.Error("New:remediationPolicies " + err.Error())
+		return nil, err
+	}
+
+	var redirectPortal *redirect.Redirect
+	if config.RedirectURL != "" {
+		config.RedirectSecret, _ = configuration.GetVariable(config, "RedirectSecret")
+		redirectPortal, err = redirect.New(config.RedirectURL, config.RedirectSecret, config.RedirectStatusCode)
+		if err != nil {
+			log.Error("New:redirect " + err.Error())
+			return nil, err
+		}
+	}
+
+	var bypassRules *bypass.Rules
+	config.BypassTokenSecret, _ = configuration.GetVariable(config, "BypassTokenSecret")
+	if len(config.BypassCertificateSubjects)+len(config.BypassCertificateSANs)+len(config.BypassCertificateIssuers) > 0 || config.BypassTokenSecret != "" {
+		bypassRules = bypass.New(
+			config.BypassCertificateSubjects,
+			config.BypassCertificateSANs,
+			config.BypassCertificateIssuers,
+			config.BypassTokenHeader,
+			config.BypassTokenSecret,
+		)
 	}
 
 	bouncer := &Bouncer{
@@ -194,16 +354,45 @@ func New(_ context.Context, next http.Handler, config *configuration.Config, nam
 		updateInterval:          config.UpdateIntervalSeconds,
 		updateMaxFailure:        config.UpdateMaxFailure,
 		remediationCustomHeader: config.RemediationHeadersCustomName,
-		forwardedCustomHeader:   config.ForwardedHeadersCustomName,
+		forwardedHeaders:        configuration.GetForwardedHeaders(config),
+		deepChain:               config.ForwardedHeadersDeepChain,
+		deepChainMaxHops:        config.ForwardedHeadersMaxHops,
+		ipv6PrefixLength:        config.IPv6DecisionPrefixLength,
+		geoCountry:              geoCountry,
+		geoASN:                  geoASN,
+		countryAllowList:        upperList(config.GeoCountryAllowList),
+		countryDenyList:         upperList(config.GeoCountryDenyList),
+		customScopes:            customScopes,
+		bypassRules:             bypassRules,
+		requestRules:            requestRules,
+		allowlistsEnabled:       config.CrowdsecAllowlistsEnabled,
+		remediationPolicies:     remediationPolicies,
+		dryRun:                  config.DryRunEnabled,
+		dryRunRemediations:      lowerList(config.DryRunRemediations),
+		dryRunHeader:            config.DryRunHeaderName,
+		annotate:                config.AnnotateEnabled,
+		redirect:                redirectPortal,
+		tarpitDelay:             time.Duration(config.TarpitDelaySeconds) * time.Second,
+		tarpitInterval:          time.Second,
+		tarpitMaxConnections:    config.TarpitMaxConnections,
+		grpcStatusCode:          config.RemediationGRPCStatusCode,
+		webSocketStatusCode:     config.RemediationWebSocketStatusCode,
+		sseStatusCode:           config.RemediationSSEStatusCode,
 		defaultDecisionTimeout:  config.DefaultDecisionSeconds,
 		remediationStatusCode:   config.RemediationStatusCode,
 		redisUnreachableBlock:   config.RedisCacheUnreachableBlock,
-		banTemplateString:       banTemplateString,
+		banPages:                banPages,
+		defaultLanguage:         config.DefaultLanguage,
+		hostBans:                hostBans,
+		banSecurityPolicy:       config.BanContentSecurityPolicy,
+		responses:               responses,
+		apiPathPrefixes:         config.APIPathPrefixes,
 		crowdsecStreamRoute:     crowdsecStreamRoute,
 		crowdsecHeader:          crowdsecHeader,
 		log:                     log,
 		serverPoolStrategy: &ip.PoolStrategy{
 			Checker: serverChecker,
+			Depth:   config.ForwardedHeadersDepth,
 		},
 		clientPoolStrategy: &ip.PoolStrategy{
 			Checker: clientChecker,
@@ -226,10 +415,23 @@ func New(_ context.Context, next http.Handler, config *configuration.Config, nam
 	bouncer.cacheClient.New(
 		log,
 		config.RedisCacheEnabled,
+		config.FileCacheEnabled,
 		config.RedisCacheHost,
 		config.RedisCachePassword,
 		config.RedisCacheDatabase,
+		config.FileCachePath,
 	)
+	// Without a Limiter, the throttle decisions are bans.
+	if config.ThrottleRequests > 0 && config.ThrottlePeriodSeconds > 0 && config.ThrottleBurst > 0 {
+		bouncer.throttle = throttle.New(bouncer.cacheClient, config.ThrottleRequests, config.ThrottlePeriodSeconds, config.ThrottleBurst)
+	}
+	if config.GoodBotsEnabled {
+		bouncer.goodBots, err = goodbot.New(log, bouncer.cacheClient, net.DefaultResolver, config.GoodBots, config.GoodBotsCacheSeconds)
+		if err != nil {
+			log.Error("New:goodBots " + err.Error())
+			return nil, err
+		}
+	}
 	config.CaptchaSiteKey, _ = configuration.GetVariable(config, "CaptchaSiteKey")
 	config.CaptchaSecretKey, _ = configuration.GetVariable(config, "CaptchaSecretKey")
 	err = bouncer.captchaClient.New(
@@ -248,12 +450,24 @@ func New(_ context.Context, next http.Handler, config *configuration.Config, nam
 		config.CaptchaSecretKey,
 		config.RemediationHeadersCustomName,
 		config.CaptchaHTMLFilePath,
+		config.DefaultLanguage,
+		config.CaptchaContentSecurityPolicy,
+		config.CaptchaPowDifficulty,
 		config.CaptchaGracePeriodSeconds,
 	)
 	if err != nil {
 		log.Error("CaptchaClient not valid " + err.Error())
 		return nil, err
 	}
+	if bouncer.captchaClient.Valid {
+		for _, hostOverride := range hostOverrides {
+			err = bouncer.captchaClient.AddHost(hostOverride.Host, hostOverride.CaptchaSiteKey, hostOverride.CaptchaSecretKey, hostOverride.CaptchaHTMLFilePath)
+			if err != nil {
+				log.Error("CaptchaClient hostOverrides not valid " + err.Error())
+				return nil, err
+			}
+		}
+	}
 
 	if (config.CrowdsecMode == configuration.StreamMode || config.CrowdsecMode == configuration.AloneMode) && streamTicker == nil {
 		if config.CrowdsecMode == configuration.AloneMode {
@@ -269,6 +483,14 @@ func New(_ context.Context, next http.Handler, config *configuration.Config, nam
 		})
 	}
 
+	// The allowlists are pulled by the first middleware enabling them, not by the one pulling the stream.
+	if config.CrowdsecMode == configuration.StreamMode && config.CrowdsecAllowlistsEnabled && allowlistsTicker == nil {
+		handleAllowlistsTicker(bouncer)
+		allowlistsTicker = startTicker("allowlists", config.UpdateIntervalSeconds, log, func() {
+			handleAllowlistsTicker(bouncer)
+		})
+	}
+
 	// Start metrics ticker if not already running
 	if metricsTicker == nil && config.MetricsUpdateIntervalSeconds > 0 {
 		lastMetricsPush = time.Now() // Initialize lastMetricsPush when starting the metrics ticker
@@ -291,76 +513,456 @@ func (bouncer *Bouncer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		bouncer.next.ServeHTTP(rw, req)
 		return
 	}
+	// The script of the pow captcha is served before any check, it is neither a remediation nor an API response.
+	if bouncer.captchaClient.ServeScript(rw, req) {
+		return
+	}
+
+	if bouncer.dryRunHeader != "" {
+		// Only the bouncer sets the dry run header.
+		req.Header.Del(bouncer.dryRunHeader)
+	}
+	if bouncer.annotate {
+		req.Header.Del(annotateRemediationHeader)
+		req.Header.Del(annotateScenarioHeader)
+		req.Header.Del(annotateCaptchaPassedHeader)
+	}
+
+	var bypassToken string
+	if bouncer.bypassRules != nil {
+		bypassToken = bouncer.bypassRules.TakeToken(req)
+	}
 
-	// Here we check for the trusted IPs in the forwardedCustomHeader
-	remoteIP, err := ip.GetRemoteIP(req, bouncer.serverPoolStrategy, bouncer.forwardedCustomHeader)
+	// Request rules are evaluated before anything else, they can skip the bouncer entirely.
+	var rule *rules.Rule
+	var action string
+	if len(bouncer.requestRules) > 0 {
+		rule = rules.Evaluate(bouncer.requestRules, req)
+		if rule != nil {
+			action = rule.Action
+		}
+		if action == rules.ActionBypass {
+			bouncer.next.ServeHTTP(rw, req)
+			return
+		}
+	}
+
+	// Here we check for the trusted IPs in the forwardedHeaders
+	remoteIP, err := ip.GetRemoteIP(req, bouncer.serverPoolStrategy, bouncer.forwardedHeaders)
 	if err != nil {
 		bouncer.log.Error(fmt.Sprintf("ServeHTTP:getRemoteIp ip:%s %s", remoteIP, err.Error()))
-		handleBanServeHTTP(bouncer, rw)
+		handleForcedBanServeHTTP(bouncer, remoteIP, rw, req)
 		return
 	}
-	isTrusted, err := bouncer.clientPoolStrategy.Checker.Contains(remoteIP)
+	remoteAddr, err := netip.ParseAddr(remoteIP)
 	if err != nil {
-		bouncer.log.Error(fmt.Sprintf("ServeHTTP:checkerContains ip:%s %s", remoteIP, err.Error()))
-		handleBanServeHTTP(bouncer, rw)
+		bouncer.log.Error(fmt.Sprintf("ServeHTTP:parseRemoteIp ip:%s %s", remoteIP, err.Error()))
+		handleForcedBanServeHTTP(bouncer, remoteIP, rw, req)
 		return
 	}
+	// Decisions and captcha grace are stored under this key, the IPv6 prefix when enforced.
+	remoteKey := ip.Key(remoteAddr, remoteIP, bouncer.ipv6PrefixLength)
+	isTrusted := bouncer.clientPoolStrategy.Checker.ContainsAddr(remoteAddr)
 	// if our IP is in the trusted list we bypass the next checks
-	bouncer.log.Debug(fmt.Sprintf("ServeHTTP ip:%s isTrusted:%v", remoteIP, isTrusted))
+	if bouncer.log.DebugEnabled() {
+		bouncer.log.Debug(fmt.Sprintf("ServeHTTP ip:%s isTrusted:%v", remoteIP, isTrusted))
+	}
 	if isTrusted {
 		bouncer.next.ServeHTTP(rw, req)
 		return
 	}
+	if bouncer.allowlistsEnabled && bouncer.crowdsecMode != configuration.AppsecMode && isAllowlisted(bouncer, remoteAddr, remoteIP) {
+		bouncer.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if action == rules.ActionBan {
+		if bouncer.log.DebugEnabled() {
+			bouncer.log.Debug(fmt.Sprintf("ServeHTTP:requestRules ip:%s action:%s", remoteIP, action))
+		}
+		handleForcedBanServeHTTP(bouncer, remoteIP, rw, req)
+		return
+	}
 
 	if bouncer.crowdsecMode == configuration.AppsecMode {
 		handleNextServeHTTP(bouncer, remoteIP, rw, req)
 		return
 	}
 
-	// TODO This should be simplified
+	value := getRemediation(bouncer, remoteIP, remoteKey)
+	if bouncer.geoCountry != nil || bouncer.geoASN != nil {
+		value = getGeoRemediation(bouncer, remoteAddr, remoteIP, value)
+	}
+	// The ID and the scenario of the decision are stored under its key, the one of a custom scope when it wins.
+	decisionKey := remoteKey
+	if len(bouncer.customScopes) > 0 {
+		decisionKey, value = getCustomScopeRemediation(bouncer, req, remoteIP, remoteKey, value)
+	}
+	if bouncer.deepChain {
+		// A banned IP further left in the chain is more severe than the remediation of the client IP.
+		if hopIP, hopKey, hopValue := getDeepChainRemediation(bouncer, req, remoteIP, remoteKey, value); hopKey != remoteKey {
+			remoteIP, remoteKey, decisionKey, value = hopIP, hopKey, hopKey, hopValue
+		}
+	}
+	if value != cache.NoBannedValue && len(bouncer.requestRules) > 0 && rules.Restricts(bouncer.requestRules, remediationName(value)) &&
+		(rule == nil || !rule.Enforces(remediationName(value))) {
+		// The remediation is enforced only on the requests matching an enforce rule listing it.
+		if bouncer.log.DebugEnabled() {
+			bouncer.log.Debug(fmt.Sprintf("ServeHTTP:requestRules ip:%s remediation:%s not enforced on this request", remoteIP, value))
+		}
+		value = cache.NoBannedValue
+	}
+	if action == rules.ActionCaptcha && remediationSeverity(value) < remediationSeverity(cache.CaptchaValue) {
+		// The captcha is forced, but a banned IP stays banned.
+		value = cache.CaptchaValue
+	}
+	if value != cache.NoBannedValue && bouncer.bypassRules != nil {
+		if authenticated, ok := bouncer.bypassRules.Match(req, bypassToken); ok {
+			bypassed := atomic.AddInt64(&bypassedRequests, 1)
+			if bouncer.log.DebugEnabled() {
+				bouncer.log.Debug(fmt.Sprintf("ServeHTTP:bypass ip:%s remediation:%s bypassed for %s bypassedRequests:%d", remoteIP, value, authenticated, bypassed))
+			}
+			value = cache.NoBannedValue
+		}
+	}
+	if value != cache.NoBannedValue && bouncer.goodBots != nil && bouncer.goodBots.Verify(remoteIP, req.UserAgent()) {
+		bypassed := atomic.AddInt64(&bypassedRequests, 1)
+		if bouncer.log.DebugEnabled() {
+			bouncer.log.Debug(fmt.Sprintf("ServeHTTP:goodBot ip:%s remediation:%s bypassed for a verified crawler bypassedRequests:%d", remoteIP, value, bypassed))
+		}
+		value = cache.NoBannedValue
+	}
+	if value == cache.NoBannedValue {
+		handleNextServeHTTP(bouncer, remoteIP, rw, req)
+	} else {
+		handleRemediationServeHTTP(bouncer, remoteIP, remoteKey, decisionKey, value, rw, req)
+	}
+}
+
+// isAllowlisted checks the CrowdSec allowlists: in stream mode against their pulled content,
+// otherwise with the LAPI check endpoint, the answer being cached for the default decision duration
+// in live and none modes, so LAPI is not queried twice per request.
+func isAllowlisted(bouncer *Bouncer, remoteAddr netip.Addr, remoteIP string) bool {
+	if bouncer.crowdsecMode == configuration.StreamMode {
+		return allowlistChecker.ContainsAddr(remoteAddr)
+	}
+	key := allowlistKeyPrefix + remoteIP
+	if value, err := bouncer.cacheClient.Get(key); err == nil {
+		return value == strconv.FormatBool(true)
+	}
+	routeURL := url.URL{
+		Scheme: bouncer.crowdsecScheme,
+		Host:   bouncer.crowdsecHost,
+		Path:   bouncer.crowdsecPath + crowdsecAllowCheckRoute + remoteIP,
+	}
+	body, err := crowdsecQuery(bouncer, routeURL.String(), nil)
+	if err != nil {
+		bouncer.log.Error(fmt.Sprintf("isAllowlisted:crowdsecQuery ip:%s %s", remoteIP, err.Error()))
+		return false
+	}
+	var check AllowlistCheck
+	if err = json.Unmarshal(body, &check); err != nil {
+		bouncer.log.Error(fmt.Sprintf("isAllowlisted:parsingBody ip:%s %s", remoteIP, err.Error()))
+		return false
+	}
+	bouncer.cacheClient.Set(key, strconv.FormatBool(check.Allowlisted), bouncer.defaultDecisionTimeout)
+	if check.Allowlisted && bouncer.log.DebugEnabled() {
+		bouncer.log.Debug(fmt.Sprintf("isAllowlisted ip:%s reason:%s", remoteIP, check.Reason))
+	}
+	return check.Allowlisted
+}
+
+// getRemediation returns the remediation of an IP from the cache, the stream state or LAPI:
+// cache.NoBannedValue, cache.CaptchaValue, a ban value (see banValue), or the empty string for an unknown decision type.
+func getRemediation(bouncer *Bouncer, remoteIP, remoteKey string) string {
 	if bouncer.crowdsecMode != configuration.NoneMode {
-		value, cacheErr := bouncer.cacheClient.Get(remoteIP)
+		value, cacheErr := bouncer.cacheClient.Get(remoteKey)
 		if cacheErr != nil {
 			cacheErrString := cacheErr.Error()
-			bouncer.log.Debug(fmt.Sprintf("ServeHTTP:Get ip:%s isBanned:false %s", remoteIP, cacheErrString))
+			if bouncer.log.DebugEnabled() {
+				bouncer.log.Debug(fmt.Sprintf("ServeHTTP:Get ip:%s isBanned:false %s", remoteIP, cacheErrString))
+			}
 			if !bouncer.redisUnreachableBlock && cacheErrString == cache.CacheUnreachable {
 				bouncer.log.Error(fmt.Sprintf("ServeHTTP:Get ip:%s redisUnreachable=true", remoteIP))
-				handleNextServeHTTP(bouncer, remoteIP, rw, req)
-				return
+				return cache.NoBannedValue
 			}
 			if cacheErrString != cache.CacheMiss {
 				bouncer.log.Error(fmt.Sprintf("ServeHTTP:Get ip:%s %s", remoteIP, cacheErrString))
-				handleBanServeHTTP(bouncer, rw)
-				return
+				return cache.BannedValue
 			}
 		} else {
-			bouncer.log.Debug(fmt.Sprintf("ServeHTTP ip:%s cache:hit isBanned:%v", remoteIP, value))
-			if value == cache.NoBannedValue {
-				handleNextServeHTTP(bouncer, remoteIP, rw, req)
-			} else {
-				handleRemediationServeHTTP(bouncer, remoteIP, value, rw, req)
+			if bouncer.log.DebugEnabled() {
+				bouncer.log.Debug(fmt.Sprintf("ServeHTTP ip:%s cache:hit isBanned:%v", remoteIP, value))
 			}
-			return
+			return value
 		}
 	}
 
 	// Right here if we cannot join the stream we forbid the request to go on.
 	if bouncer.crowdsecMode == configuration.StreamMode || bouncer.crowdsecMode == configuration.AloneMode {
 		if isCrowdsecStreamHealthy {
-			handleNextServeHTTP(bouncer, remoteIP, rw, req)
-		} else {
+			return cache.NoBannedValue
+		}
+		if bouncer.log.DebugEnabled() {
 			bouncer.log.Debug(fmt.Sprintf("ServeHTTP isCrowdsecStreamHealthy:false ip:%s updateFailure:%d", remoteIP, updateFailure))
-			handleBanServeHTTP(bouncer, rw)
 		}
-	} else {
-		value, err := handleNoStreamCache(bouncer, remoteIP)
-		if value == cache.NoBannedValue {
-			handleNextServeHTTP(bouncer, remoteIP, rw, req)
-		} else {
+		return cache.BannedValue
+	}
+	value, err := handleNoStreamCache(bouncer, remoteKey)
+	if value != cache.NoBannedValue {
+		if bouncer.log.DebugEnabled() {
 			bouncer.log.Debug(fmt.Sprintf("ServeHTTP:handleNoStreamCache ip:%s isBanned:%v %s", remoteIP, value, err.Error()))
-			handleRemediationServeHTTP(bouncer, remoteIP, value, rw, req)
 		}
 	}
+	return value
+}
+
+// getDeepChainRemediation looks up the untrusted IPs of the forwarded chain other than the client IP,
+// and returns the IP, key and remediation of the most severe one.
+func getDeepChainRemediation(bouncer *Bouncer, req *http.Request, remoteIP, remoteKey, value string) (string, string, string) {
+	if remediationSeverity(value) == remediationSeverity(cache.BannedValue) {
+		return remoteIP, remoteKey, value
+	}
+	hops := ip.GetRemoteIPs(req, bouncer.serverPoolStrategy, bouncer.forwardedHeaders, bouncer.deepChainMaxHops)
+	for _, hop := range hops {
+		if hop == remoteIP {
+			continue
+		}
+		hopAddr, err := netip.ParseAddr(hop)
+		if err != nil || bouncer.clientPoolStrategy.Checker.ContainsAddr(hopAddr) {
+			continue
+		}
+		hopKey := ip.Key(hopAddr, hop, bouncer.ipv6PrefixLength)
+		hopValue := getRemediation(bouncer, hop, hopKey)
+		if bouncer.log.DebugEnabled() {
+			bouncer.log.Debug(fmt.Sprintf("ServeHTTP:deepChain ip:%s hop:%s remediation:%s", remoteIP, hop, hopValue))
+		}
+		if remediationSeverity(hopValue) > remediationSeverity(value) {
+			remoteIP, remoteKey, value = hop, hopKey, hopValue
+		}
+		if remediationSeverity(value) == remediationSeverity(cache.BannedValue) {
+			break
+		}
+	}
+	return remoteIP, remoteKey, value
+}
+
+// getGeoRemediation returns the most severe of the remediation of an IP and the ones of its country and AS:
+// the static country lists first, then the Country and AS scope decisions of the stream.
+func getGeoRemediation(bouncer *Bouncer, remoteAddr netip.Addr, remoteIP, value string) string {
+	if remediationSeverity(value) == remediationSeverity(cache.BannedValue) {
+		return value
+	}
+	if bouncer.geoCountry != nil {
+		country, err := bouncer.geoCountry.Country(remoteAddr)
+		if err != nil {
+			bouncer.log.Error(fmt.Sprintf("ServeHTTP:geoCountry ip:%s %s", remoteIP, err.Error()))
+		}
+		if country != "" {
+			// IPs without a known country (private networks, missing from the database) are never blocked by the lists.
+			if contains(bouncer.countryDenyList, country) || (len(bouncer.countryAllowList) > 0 && !contains(bouncer.countryAllowList, country)) {
+				if bouncer.log.DebugEnabled() {
+					bouncer.log.Debug(fmt.Sprintf("ServeHTTP:geoCountry ip:%s country:%s isBanned:true", remoteIP, country))
+				}
+				return cache.BannedValue
+			}
+			value = getScopeRemediation(bouncer, geo.CountryKey(country), value)
+		}
+	}
+	if bouncer.geoASN != nil {
+		asn, err := bouncer.geoASN.ASN(remoteAddr)
+		if err != nil {
+			bouncer.log.Error(fmt.Sprintf("ServeHTTP:geoAsn ip:%s %s", remoteIP, err.Error()))
+		}
+		if asn != 0 {
+			value = getScopeRemediation(bouncer, geo.ASKey(strconv.FormatUint(uint64(asn), 10)), value)
+		}
+	}
+	return value
+}
+
+// getScopeRemediation returns the most severe of value and the remediation cached under a scope key.
+// Only the stream holds decisions on scopes other than IP and Range.
+func getScopeRemediation(bouncer *Bouncer, key, value string) string {
+	if bouncer.crowdsecMode != configuration.StreamMode && bouncer.crowdsecMode != configuration.AloneMode {
+		return value
+	}
+	scopeValue, err := bouncer.cacheClient.Get(key)
+	if err != nil {
+		return value
+	}
+	if bouncer.log.DebugEnabled() {
+		bouncer.log.Debug(fmt.Sprintf("ServeHTTP:getScopeRemediation key:%s remediation:%s", key, scopeValue))
+	}
+	if remediationSeverity(scopeValue) > remediationSeverity(value) {
+		return scopeValue
+	}
+	return value
+}
+
+// getCustomScopeRemediation returns the most severe of the remediation of an IP and the ones of the
+// custom scopes found in the request, with the key of its decision: remoteKey or the key of the custom scope.
+// Values that cannot be read (ex: invalid JWT) are ignored.
+func getCustomScopeRemediation(bouncer *Bouncer, req *http.Request, remoteIP, remoteKey, value string) (string, string) {
+	decisionKey := remoteKey
+	for _, extractor := range bouncer.customScopes {
+		if remediationSeverity(value) == remediationSeverity(cache.BannedValue) {
+			break
+		}
+		scopeValue, err := extractor.Value(req)
+		if err != nil {
+			if bouncer.log.DebugEnabled() {
+				bouncer.log.Debug(fmt.Sprintf("ServeHTTP:customScope ip:%s scope:%s %s", remoteIP, extractor.Scope, err.Error()))
+			}
+			continue
+		}
+		if scopeValue == "" {
+			continue
+		}
+		key := scope.Key(extractor.Scope, scopeValue)
+		if bouncer.crowdsecMode == configuration.StreamMode || bouncer.crowdsecMode == configuration.AloneMode {
+			if scopeRemediation := getScopeRemediation(bouncer, key, value); scopeRemediation != value {
+				decisionKey, value = key, scopeRemediation
+			}
+			continue
+		}
+		var scopeRemediation string
+		isCached := false
+		if bouncer.crowdsecMode == configuration.LiveMode {
+			scopeRemediation, err = bouncer.cacheClient.Get(key)
+			isCached = err == nil
+		}
+		if !isCached {
+			query := url.Values{}
+			query.Set("scope", extractor.Scope)
+			query.Set("value", scopeValue)
+			scopeRemediation, err = handleNoStreamQuery(bouncer, key, query)
+			if err != nil {
+				if bouncer.log.DebugEnabled() {
+					bouncer.log.Debug(fmt.Sprintf("ServeHTTP:customScope ip:%s scope:%s remediation:%s %s", remoteIP, extractor.Scope, scopeRemediation, err.Error()))
+				}
+			}
+		}
+		if remediationSeverity(scopeRemediation) > remediationSeverity(value) {
+			decisionKey, value = key, scopeRemediation
+		}
+	}
+	return decisionKey, value
+}
+
+func contains(source []string, target string) bool {
+	for _, item := range source {
+		if item == target {
+			return true
+		}
+	}
+	return false
+}
+
+func upperList(list []string) []string {
+	upper := make([]string, 0, len(list))
+	for _, item := range list {
+		upper = append(upper, strings.ToUpper(strings.TrimSpace(item)))
+	}
+	return upper
+}
+
+func lowerList(list []string) []string {
+	lower := make([]string, 0, len(list))
+	for _, item := range list {
+		lower = append(lower, strings.ToLower(strings.TrimSpace(item)))
+	}
+	return lower
+}
+
+// remediationSeverity orders remediations, unknown values are handled as a ban.
+// Simulated remediations are less severe than the enforced ones.
+func remediationSeverity(value string) int {
+	if strings.HasPrefix(value, simulatedPrefix) {
+		return remediationSeverity(value[len(simulatedPrefix):]) - 3
+	}
+	switch value {
+	case cache.NoBannedValue:
+		return 0
+	case cache.ThrottleValue:
+		return 4
+	case cache.CaptchaValue:
+		return 5
+	default:
+		return 6
+	}
+}
+
+// remediationName returns the remediation type of a value: ban, captcha or throttle.
+func remediationName(value string) string {
+	switch strings.TrimPrefix(value, simulatedPrefix) {
+	case cache.CaptchaValue:
+		return "captcha"
+	case cache.ThrottleValue:
+		return "throttle"
+	default:
+		return "ban"
+	}
+}
+
+// decisionValue returns the cache value of a decision: the first matching remediation policy applies,
+// otherwise ban, captcha and throttle decisions map to their remediation and decisions of other types are bans,
+// in every mode. It returns false when the decision is bypassed.
+// The value of a simulated decision is prefixed, it is only logged as in dry run.
+func decisionValue(bouncer *Bouncer, decision Decision) (string, bool) {
+	var value string
+	if remediationPolicy := policy.Evaluate(bouncer.remediationPolicies, decision.Type, decision.Scenario, decision.Origin, decision.Scope); remediationPolicy != nil {
+		switch remediationPolicy.Action {
+		case policy.ActionBypass:
+			return "", false
+		case policy.ActionCaptcha:
+			value = cache.CaptchaValue
+		case policy.ActionRedirect:
+			value = cache.RedirectValue
+		case policy.ActionTarpit:
+			value = cache.TarpitValue
+		case policy.ActionThrottle:
+			value = cache.ThrottleValue
+		default:
+			value = banValue(remediationPolicy.StatusCode)
+		}
+	} else {
+		switch decision.Type {
+		case "ban":
+			value = cache.BannedValue
+		case "captcha":
+			value = cache.CaptchaValue
+		case "throttle":
+			value = cache.ThrottleValue
+		default:
+			if bouncer.log.DebugEnabled() {
+				bouncer.log.Debug("decisionValue:unknownType " + decision.Type)
+			}
+			value = cache.BannedValue
+		}
+	}
+	if decision.Simulated {
+		value = simulatedPrefix + value
+	}
+	return value, true
+}
+
+// banValue returns the cache value of a ban, the status code is appended when it is not the default one (ex: t429).
+func banValue(statusCode int) string {
+	if statusCode == 0 {
+		return cache.BannedValue
+	}
+	return cache.BannedValue + strconv.Itoa(statusCode)
+}
+
+// banStatusCode returns the status code of a ban value, see banValue.
+func banStatusCode(bouncer *Bouncer, value string) int {
+	if len(value) > len(cache.BannedValue) && strings.HasPrefix(value, cache.BannedValue) {
+		if statusCode, err := strconv.Atoi(value[len(cache.BannedValue):]); err == nil {
+			return statusCode
+		}
+	}
+	return bouncer.remediationStatusCode
 }
 
 // CUSTOM CODE.
@@ -384,6 +986,24 @@ type Stream struct {
 	New     []Decision `json:"new"`
 }
 
+// Allowlist Body returned from Crowdsec LAPI allowlists.
+type Allowlist struct {
+	Name  string          `json:"name"`
+	Items []AllowlistItem `json:"items"`
+}
+
+// AllowlistItem IP or range of an Allowlist, the expiration is empty or zero when it never expires.
+type AllowlistItem struct {
+	Value      string `json:"value"`
+	Expiration string `json:"expiration"`
+}
+
+// AllowlistCheck Body returned from Crowdsec LAPI allowlist check.
+type AllowlistCheck struct {
+	Allowlisted bool   `json:"allowlisted"`
+	Reason      string `json:"reason"`
+}
+
 // Login Body returned from Crowdsec Login CAPI.
 type Login struct {
 	Code   int    `json:"code"`
@@ -392,44 +1012,377 @@ type Login struct {
 }
 
 // To append Headers we need to call rw.WriteHeader after set any header.
-func handleBanServeHTTP(bouncer *Bouncer, rw http.ResponseWriter) {
+func handleBanServeHTTP(bouncer *Bouncer, rw http.ResponseWriter, req *http.Request) {
+	handleBanStatusServeHTTP(bouncer, rw, req, bouncer.remediationStatusCode)
+}
+
+// handleBanStatusServeHTTP bans with the status code of a remediation policy,
+// gRPC, WebSocket and event stream requests get the response expected by their clients.
+func handleBanStatusServeHTTP(bouncer *Bouncer, rw http.ResponseWriter, req *http.Request, statusCode int) {
 	atomic.AddInt64(&blockedRequests, 1)
 
 	if bouncer.remediationCustomHeader != "" {
 		rw.Header().Set(bouncer.remediationCustomHeader, "ban")
 	}
-	if bouncer.banTemplateString == "" {
-		rw.WriteHeader(bouncer.remediationStatusCode)
+	switch protocol := requestProtocol(req); protocol {
+	case protocolGRPC:
+		writeProtocolStatus(rw, req, protocol, http.StatusOK, bouncer.grpcStatusCode, grpcBlockMessage)
+		return
+	case protocolWebSocket:
+		writeProtocolStatus(rw, req, protocol, bouncer.webSocketStatusCode, bouncer.grpcStatusCode, grpcBlockMessage)
+		return
+	case protocolSSE:
+		writeProtocolStatus(rw, req, protocol, bouncer.sseStatusCode, bouncer.grpcStatusCode, grpcBlockMessage)
 		return
 	}
-	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
-	rw.WriteHeader(bouncer.remediationStatusCode)
-	_, err := fmt.Fprint(rw, bouncer.banTemplateString)
+	contentType, body := banBody(bouncer, rw, req, statusCode, "ban")
+	writeBody(bouncer, rw, statusCode, contentType, body)
+}
+
+// writeProtocolStatus answers a request detected by requestProtocol without body:
+// gRPC with its status code, WebSocket and event stream with the HTTP status code.
+func writeProtocolStatus(rw http.ResponseWriter, req *http.Request, protocol string, statusCode, grpcStatusCode int, grpcMessage string) {
+	switch protocol {
+	case protocolGRPC:
+		// A trailers-only response carries the gRPC status in its headers, so that gRPC-Web clients,
+		// which cannot read HTTP trailers, get it too. The content type of the request tells its wire format.
+		rw.Header().Set("Content-Type", req.Header.Get("Content-Type"))
+		rw.Header().Set("Grpc-Status", strconv.Itoa(grpcStatusCode))
+		rw.Header().Set("Grpc-Message", grpcMessage)
+		rw.WriteHeader(http.StatusOK)
+	case protocolWebSocket:
+		// Rejected before the upgrade, the connection is not reused.
+		rw.Header().Set("Connection", "close")
+		rw.WriteHeader(statusCode)
+	default:
+		rw.WriteHeader(statusCode)
+	}
+}
+
+// banBody negotiates the content type and the body of a remediation with the client:
+// the ban template for browsers, problem details for APIs or plain text, and sets the security headers.
+// The content type is empty for browsers when there is no ban template.
+func banBody(bouncer *Bouncer, rw http.ResponseWriter, req *http.Request, statusCode int, remediation string) (string, string) {
+	format := response.Format(req, bouncer.apiPathPrefixes)
+	if format == response.FormatHTML {
+		pages := hostBanPages(bouncer, req)
+		if pages == nil {
+			response.SetSecurityHeaders(rw.Header(), "", "")
+			return "", ""
+		}
+		// The nonce allows the inline scripts and styles of this response only.
+		nonce := response.Nonce()
+		response.SetSecurityHeaders(rw.Header(), response.PagesContentSecurityPolicy(bouncer.banSecurityPolicy, response.BanContentSecurityPolicy, pages), nonce)
+		var buf bytes.Buffer
+		if err := pages.Template(req, bouncer.defaultLanguage).Execute(&buf, map[string]string{"Nonce": nonce}); err != nil {
+			bouncer.log.Error("banBody " + err.Error())
+		}
+		return response.ContentTypeHTML, buf.String()
+	}
+	response.SetSecurityHeaders(rw.Header(), "", "")
+	contentType, body, err := bouncer.responses.Body(format, response.NewData(statusCode, remediation))
+	if err != nil {
+		bouncer.log.Error("banBody " + err.Error())
+	}
+	return contentType, body
+}
+
+// hostBanPages returns the ban template of the host, or nil when there is none.
+func hostBanPages(bouncer *Bouncer, req *http.Request) *response.Pages {
+	for _, host := range bouncer.hostBans {
+		if rules.MatchHost(host.host, req.Host) {
+			return host.pages
+		}
+	}
+	return bouncer.banPages
+}
+
+// hostBan holds the ban template and its translations, for the requests to the hosts matching a glob.
+type hostBan struct {
+	host  string
+	pages *response.Pages
+}
+
+// getBanPages compiles the ban template and its translations, they are checked with an empty nonce.
+func getBanPages(banTemplatePath string) (*response.Pages, error) {
+	banTemplates, err := configuration.GetHTMLTemplates(banTemplatePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, banTemplate := range banTemplates {
+		var buf bytes.Buffer
+		if err = banTemplate.Execute(&buf, map[string]string{"Nonce": ""}); err != nil {
+			return nil, err
+		}
+	}
+	return response.NewPages(banTemplates), nil
+}
+
+// warnMissingNonce logs the ban template sent without the default Content-Security-Policy, see response.PagesContentSecurityPolicy.
+func warnMissingNonce(log *logger.Log, configured, path string, pages *response.Pages) {
+	if strings.TrimSpace(configured) == "" && !pages.UsesNonce() {
+		log.Info("New:banTemplate without nonce, sent without Content-Security-Policy path:" + path)
+	}
+}
+
+func writeBody(bouncer *Bouncer, rw http.ResponseWriter, statusCode int, contentType, body string) {
+	if contentType == "" {
+		rw.WriteHeader(statusCode)
+		return
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.WriteHeader(statusCode)
+	_, err := fmt.Fprint(rw, body)
 	if err != nil {
 		bouncer.log.Error("handleBanServeHTTP could not write template to ResponseWriter")
 	}
 }
 
-func handleRemediationServeHTTP(bouncer *Bouncer, remoteIP, remediation string, rw http.ResponseWriter, req *http.Request) {
-	bouncer.log.Debug(fmt.Sprintf("handleRemediationServeHTTP ip:%s remediation:%s", remoteIP, remediation))
+// handleRemediationServeHTTP applies the remediation of the decision stored under decisionKey,
+// the captcha and the throttle of the client are tracked under remoteKey.
+func handleRemediationServeHTTP(bouncer *Bouncer, remoteIP, remoteKey, decisionKey, remediation string, rw http.ResponseWriter, req *http.Request) {
+	if bouncer.log.DebugEnabled() {
+		bouncer.log.Debug(fmt.Sprintf("handleRemediationServeHTTP ip:%s key:%s decisionKey:%s remediation:%s", remoteIP, remoteKey, decisionKey, remediation))
+	}
+	if isDryRun(bouncer, remediation) {
+		handleDryRunServeHTTP(bouncer, remoteIP, remediation, rw, req)
+		return
+	}
+	if remediation == cache.ThrottleValue && bouncer.throttle != nil {
+		handleThrottleServeHTTP(bouncer, remoteIP, remoteKey, rw, req)
+		return
+	}
+	protocol := requestProtocol(req)
+	format := response.Format(req, bouncer.apiPathPrefixes)
 	if bouncer.captchaClient.Valid && remediation == cache.CaptchaValue {
-		if bouncer.captchaClient.Check(remoteIP) {
+		if bouncer.captchaClient.Check(remoteKey) {
+			if bouncer.annotate {
+				annotateRequest(bouncer, req, decisionKey, remediation, true)
+			}
 			handleNextServeHTTP(bouncer, remoteIP, rw, req)
 			return
 		}
-		atomic.AddInt64(&blockedRequests, 1) //  If we serve a captcha that should count as a dropped request.
-		bouncer.captchaClient.ServeHTTP(rw, req, remoteIP)
+		// gRPC, WebSocket and event stream clients cannot solve a captcha, they are banned.
+		if protocol == "" {
+			atomic.AddInt64(&blockedRequests, 1) //  If we serve a captcha that should count as a dropped request.
+			if bouncer.remediationCustomHeader != "" {
+				rw.Header().Set(bouncer.remediationCustomHeader, "captcha")
+			}
+			if format != response.FormatHTML {
+				// API clients are told to solve the captcha in a browser.
+				contentType, body := banBody(bouncer, rw, req, bouncer.remediationStatusCode, "captcha")
+				writeBody(bouncer, rw, bouncer.remediationStatusCode, contentType, body)
+				return
+			}
+			bouncer.captchaClient.ServeHTTP(rw, req, remoteKey)
+			return
+		}
+	}
+	if bouncer.annotate {
+		// The service decides how to degrade instead of the ban.
+		if bouncer.log.DebugEnabled() {
+			bouncer.log.Debug(fmt.Sprintf("handleRemediationServeHTTP:annotate ip:%s remediation:%s", remoteIP, remediation))
+		}
+		annotateRequest(bouncer, req, decisionKey, remediation, false)
+		handleNextServeHTTP(bouncer, remoteIP, rw, req)
+		return
+	}
+	if remediation == cache.TarpitValue {
+		handleTarpitServeHTTP(bouncer, remoteIP, rw, req)
+		return
+	}
+	if protocol == "" && format == response.FormatHTML && bouncer.redirect != nil && (remediation == cache.RedirectValue || hostBanPages(bouncer, req) == nil) {
+		handleRedirectServeHTTP(bouncer, remoteIP, decisionKey, rw, req)
+		return
+	}
+	handleBanStatusServeHTTP(bouncer, rw, req, banStatusCode(bouncer, remediation))
+}
+
+// requestProtocol detects the requests whose clients do not handle an HTTP error page:
+// gRPC, WebSocket upgrades and event streams, or returns the empty string.
+func requestProtocol(req *http.Request) string {
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		return protocolGRPC
+	}
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return protocolWebSocket
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		return protocolSSE
+	}
+	return ""
+}
+
+// handleThrottleServeHTTP lets the request through while the token bucket of the IP is not empty,
+// otherwise it answers 429 with the seconds to wait for the next token.
+func handleThrottleServeHTTP(bouncer *Bouncer, remoteIP, remoteKey string, rw http.ResponseWriter, req *http.Request) {
+	allowed, retryAfter := bouncer.throttle.Allow(remoteKey, time.Now())
+	if allowed {
+		handleNextServeHTTP(bouncer, remoteIP, rw, req)
+		return
+	}
+	atomic.AddInt64(&blockedRequests, 1)
+	if bouncer.log.DebugEnabled() {
+		bouncer.log.Debug(fmt.Sprintf("handleThrottleServeHTTP ip:%s retryAfter:%v", remoteIP, retryAfter))
+	}
+	if bouncer.remediationCustomHeader != "" {
+		rw.Header().Set(bouncer.remediationCustomHeader, "throttle")
+	}
+	rw.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+	if protocol := requestProtocol(req); protocol != "" {
+		writeProtocolStatus(rw, req, protocol, http.StatusTooManyRequests, grpcThrottleStatusCode, grpcThrottleMessage)
 		return
 	}
-	handleBanServeHTTP(bouncer, rw)
+	rw.WriteHeader(http.StatusTooManyRequests)
+}
+
+// handleTarpitServeHTTP holds the connection for the tarpit delay, trickling the response one byte at a time.
+// It bans immediately when too many connections are already tarpitted, to protect Traefik,
+// and the gRPC, WebSocket and event stream requests whose clients would not read the trickled page.
+func handleTarpitServeHTTP(bouncer *Bouncer, remoteIP string, rw http.ResponseWriter, req *http.Request) {
+	if requestProtocol(req) != "" {
+		handleBanServeHTTP(bouncer, rw, req)
+		return
+	}
+	if atomic.AddInt64(&tarpittedConnections, 1) > bouncer.tarpitMaxConnections {
+		atomic.AddInt64(&tarpittedConnections, -1)
+		if bouncer.log.DebugEnabled() {
+			bouncer.log.Debug("handleTarpitServeHTTP:full ip:" + remoteIP)
+		}
+		handleBanServeHTTP(bouncer, rw, req)
+		return
+	}
+	defer atomic.AddInt64(&tarpittedConnections, -1)
+	atomic.AddInt64(&blockedRequests, 1)
+
+	if bouncer.remediationCustomHeader != "" {
+		rw.Header().Set(bouncer.remediationCustomHeader, "tarpit")
+	}
+	contentType, body := banBody(bouncer, rw, req, bouncer.remediationStatusCode, "ban")
+	if contentType != "" {
+		rw.Header().Set("Content-Type", contentType)
+	}
+	rw.WriteHeader(bouncer.remediationStatusCode)
+	flusher, _ := rw.(http.Flusher)
+	ticker := time.NewTicker(bouncer.tarpitInterval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(bouncer.tarpitDelay)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-deadline.C:
+			if _, err := fmt.Fprint(rw, body); err != nil {
+				bouncer.log.Debug("handleTarpitServeHTTP could not write template to ResponseWriter")
+			}
+			return
+		case <-ticker.C:
+			// Whitespace keeps the client waiting without altering the HTML or JSON body.
+			if _, err := rw.Write([]byte(" ")); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// handleRedirectServeHTTP redirects to the portal with the original URL, the IP and the decision ID.
+func handleRedirectServeHTTP(bouncer *Bouncer, remoteIP, decisionKey string, rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&blockedRequests, 1)
+	decisionID, _ := getDecisionInfo(bouncer, decisionKey)
+	if bouncer.remediationCustomHeader != "" {
+		rw.Header().Set(bouncer.remediationCustomHeader, "redirect")
+	}
+	originalURL := redirect.OriginalURL(req, isFromTrustedProxy(bouncer, req))
+	http.Redirect(rw, req, bouncer.redirect.Location(originalURL, remoteIP, decisionID, time.Now()), bouncer.redirect.StatusCode)
+}
+
+// isFromTrustedProxy tells whether the request comes from one of the ForwardedHeadersTrustedIPs.
+func isFromTrustedProxy(bouncer *Bouncer, req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	trusted, _ := bouncer.serverPoolStrategy.Checker.Contains(host)
+	return trusted
+}
+
+// annotateRequest adds the remediation, the scenario of the decision when it is known,
+// and for captchas whether the captcha was passed, to the headers of the request forwarded to the service.
+func annotateRequest(bouncer *Bouncer, req *http.Request, decisionKey, remediation string, captchaPassed bool) {
+	name := remediationName(remediation)
+	req.Header.Set(annotateRemediationHeader, name)
+	if _, scenario := getDecisionInfo(bouncer, decisionKey); scenario != "" {
+		req.Header.Set(annotateScenarioHeader, scenario)
+	}
+	if name == "captcha" {
+		req.Header.Set(annotateCaptchaPassedHeader, strconv.FormatBool(captchaPassed))
+	}
+}
+
+// isDryRun checks if a remediation is only logged: it comes from a simulated decision,
+// or dry run is enabled for all remediations or for its type.
+func isDryRun(bouncer *Bouncer, remediation string) bool {
+	if strings.HasPrefix(remediation, simulatedPrefix) {
+		return true
+	}
+	return bouncer.dryRun && (len(bouncer.dryRunRemediations) == 0 || contains(bouncer.dryRunRemediations, remediationName(remediation)))
+}
+
+// handleDryRunServeHTTP logs and counts the remediation that would have been applied and lets the request through.
+func handleDryRunServeHTTP(bouncer *Bouncer, remoteIP, remediation string, rw http.ResponseWriter, req *http.Request) {
+	markDryRun(bouncer, remoteIP, remediation, req)
+	handleNextServeHTTP(bouncer, remoteIP, rw, req)
+}
+
+// markDryRun logs and counts the remediation that would have been applied, and tells it to the service.
+// The first dry run of a remediation for an IP is logged at INFO level, the next ones within dryRunLogSeconds at DEBUG level.
+func markDryRun(bouncer *Bouncer, remoteIP, remediation string, req *http.Request) {
+	name := remediationName(remediation)
+	count := atomic.AddInt64(&dryRunRequests, 1)
+	key := dryRunKeyPrefix + remoteIP + "_" + name
+	_, err := bouncer.cacheClient.Get(key)
+	isFirst := err != nil
+	if isFirst {
+		bouncer.cacheClient.Set(key, cache.NoBannedValue, dryRunLogSeconds)
+	}
+	if isFirst || bouncer.log.DebugEnabled() {
+		message := fmt.Sprintf("handleRemediationServeHTTP:dryRun ip:%s remediation:%s simulated:%t dryRunRequests:%d", remoteIP, name, strings.HasPrefix(remediation, simulatedPrefix), count)
+		if isFirst {
+			bouncer.log.Info(message)
+		} else {
+			bouncer.log.Debug(message)
+		}
+	}
+	if bouncer.dryRunHeader != "" {
+		req.Header.Set(bouncer.dryRunHeader, name)
+	}
+}
+
+// handleForcedBanServeHTTP bans a request without decision, banned by a request rule or without a valid client IP,
+// the ban is in dry run like the ban of a decision.
+func handleForcedBanServeHTTP(bouncer *Bouncer, remoteIP string, rw http.ResponseWriter, req *http.Request) {
+	if isDryRun(bouncer, cache.BannedValue) {
+		handleDryRunServeHTTP(bouncer, remoteIP, cache.BannedValue, rw, req)
+		return
+	}
+	handleBanServeHTTP(bouncer, rw, req)
 }
 
 func handleNextServeHTTP(bouncer *Bouncer, remoteIP string, rw http.ResponseWriter, req *http.Request) {
 	if bouncer.appsecEnabled {
 		if err := appsecQuery(bouncer, remoteIP, req); err != nil {
-			bouncer.log.Debug(fmt.Sprintf("handleNextServeHTTP ip:%s isWaf:true %s", remoteIP, err.Error()))
-			handleBanServeHTTP(bouncer, rw)
-			return
+			if bouncer.log.DebugEnabled() {
+				bouncer.log.Debug(fmt.Sprintf("handleNextServeHTTP ip:%s isWaf:true %s", remoteIP, err.Error()))
+			}
+			if !isDryRun(bouncer, cache.BannedValue) {
+				handleBanServeHTTP(bouncer, rw, req)
+				return
+			}
+			markDryRun(bouncer, remoteIP, cache.BannedValue, req)
 		}
 	}
 	bouncer.next.ServeHTTP(rw, req)
@@ -449,6 +1402,12 @@ func handleStreamTicker(bouncer *Bouncer) {
 	}
 }
 
+func handleAllowlistsTicker(bouncer *Bouncer) {
+	if err := handleAllowlists(bouncer); err != nil {
+		bouncer.log.Error("handleAllowlistsTicker:handleAllowlists " + err.Error())
+	}
+}
+
 func handleMetricsTicker(bouncer *Bouncer) {
 	if err := reportMetrics(bouncer); err != nil {
 		bouncer.log.Error("handleMetricsTicker:reportMetrics " + err.Error())
@@ -473,67 +1432,95 @@ func startTicker(name string, updateInterval int64, log *logger.Log, work func()
 }
 
 // We are now in none or live mode.
-func handleNoStreamCache(bouncer *Bouncer, remoteIP string) (string, error) {
-	isLiveMode := bouncer.crowdsecMode == configuration.LiveMode
-	routeURL := url.URL{
-		Scheme:   bouncer.crowdsecScheme,
-		Host:     bouncer.crowdsecHost,
-		Path:     bouncer.crowdsecPath + crowdsecLapiRoute,
-		RawQuery: fmt.Sprintf("ip=%v", remoteIP),
-	}
-	body, err := crowdsecQuery(bouncer, routeURL.String(), nil)
-	if err != nil {
-		return cache.BannedValue, err
-	}
-
-	if bytes.Equal(body, []byte("null")) {
-		if isLiveMode {
-			bouncer.cacheClient.Set(remoteIP, cache.NoBannedValue, bouncer.defaultDecisionTimeout)
-		}
-		return cache.NoBannedValue, nil
+// remoteKey is either an IP or, when IPv6 prefix enforcement is on, an IPv6 prefix.
+func handleNoStreamCache(bouncer *Bouncer, remoteKey string) (string, error) {
+	if !strings.Contains(remoteKey, "/") {
+		query := url.Values{}
+		query.Set("ip", remoteKey)
+		return handleNoStreamQuery(bouncer, remoteKey, query)
 	}
+	// The decisions on an address or a range inside the prefix apply to the whole prefix,
+	// and the ranges covering the prefix still apply to it.
+	inside := url.Values{}
+	inside.Set("range", remoteKey)
+	inside.Set("contains", "false")
+	covering := url.Values{}
+	covering.Set("range", remoteKey)
+	covering.Set("contains", "true")
+	return handleNoStreamQuery(bouncer, remoteKey, inside, covering)
+}
 
+// handleNoStreamQuery asks LAPI for the decisions matching the queries, the most severe remediation applies.
+// In live mode the remediation is cached under key.
+func handleNoStreamQuery(bouncer *Bouncer, key string, queries ...url.Values) (string, error) {
+	isLiveMode := bouncer.crowdsecMode == configuration.LiveMode
 	var decisions []Decision
-	err = json.Unmarshal(body, &decisions)
-	if err != nil {
-		return cache.BannedValue, fmt.Errorf("handleNoStreamCache:parseBody %w", err)
+	for _, query := range queries {
+		matches, err := queryDecisions(bouncer, query)
+		if err != nil {
+			return cache.BannedValue, err
+		}
+		decisions = append(decisions, matches...)
 	}
 	if len(decisions) == 0 {
 		if isLiveMode {
-			bouncer.cacheClient.Set(remoteIP, cache.NoBannedValue, bouncer.defaultDecisionTimeout)
+			bouncer.cacheClient.Set(key, cache.NoBannedValue, bouncer.defaultDecisionTimeout)
 		}
 		return cache.NoBannedValue, nil
 	}
+	// The most severe remediation of the decisions applies.
 	var decision Decision
+	var value string
+	found := false
 	for _, d := range decisions {
-		decision = d
-		if decision.Type == "ban" {
-			break
+		v, ok := decisionValue(bouncer, d)
+		if ok && (!found || remediationSeverity(v) > remediationSeverity(value)) {
+			decision, value, found = d, v, true
 		}
 	}
+	if !found {
+		if isLiveMode {
+			bouncer.cacheClient.Set(key, cache.NoBannedValue, bouncer.defaultDecisionTimeout)
+		}
+		return cache.NoBannedValue, nil
+	}
 	duration, err := time.ParseDuration(decision.Duration)
 	if err != nil {
 		return cache.BannedValue, fmt.Errorf("handleNoStreamCache:parseDuration %w", err)
 	}
-	var value string
-	switch decision.Type {
-	case "ban":
-		value = cache.BannedValue
-	case "captcha":
-		value = cache.CaptchaValue
-	default:
-		bouncer.log.Debug("handleStreamCache:unknownType " + decision.Type)
-	}
 	if isLiveMode {
 		durationSecond := int64(duration.Seconds())
 		if bouncer.defaultDecisionTimeout < durationSecond {
 			durationSecond = bouncer.defaultDecisionTimeout
 		}
-		bouncer.cacheClient.Set(remoteIP, value, durationSecond)
+		bouncer.cacheClient.Set(key, value, durationSecond)
+		setDecisionInfo(bouncer, key, decision, durationSecond)
 	}
 	return value, errors.New("handleNoStreamCache:banned")
 }
 
+// queryDecisions returns the decisions of LAPI matching the query.
+func queryDecisions(bouncer *Bouncer, query url.Values) ([]Decision, error) {
+	routeURL := url.URL{
+		Scheme:   bouncer.crowdsecScheme,
+		Host:     bouncer.crowdsecHost,
+		Path:     bouncer.crowdsecPath + crowdsecLapiRoute,
+		RawQuery: query.Encode(),
+	}
+	body, err := crowdsecQuery(bouncer, routeURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(body, []byte("null")) {
+		return nil, nil
+	}
+	var decisions []Decision
+	if err = json.Unmarshal(body, &decisions); err != nil {
+		return nil, fmt.Errorf("handleNoStreamCache:parseBody %w", err)
+	}
+	return decisions, nil
+}
+
 func getToken(bouncer *Bouncer) error {
 	loginURL := url.URL{
 		Scheme: bouncer.crowdsecScheme,
@@ -580,11 +1567,17 @@ func handleStreamCache(bouncer *Bouncer) error {
 		return err
 	}
 	bouncer.cacheClient.Set(cacheTimeoutKey, cache.NoBannedValue, bouncer.updateInterval-1)
+	query := url.Values{}
+	query.Set("startup", strconv.FormatBool(!isCrowdsecStreamHealthy || isStartup))
+	if bouncer.crowdsecMode == configuration.StreamMode {
+		// LAPI only sends decisions of the ip and range scopes unless asked otherwise.
+		query.Set("scopes", strings.Join(streamScopes(bouncer), ","))
+	}
 	streamRouteURL := url.URL{
 		Scheme:   bouncer.crowdsecScheme,
 		Host:     bouncer.crowdsecHost,
 		Path:     bouncer.crowdsecPath + bouncer.crowdsecStreamRoute,
-		RawQuery: fmt.Sprintf("startup=%t", !isCrowdsecStreamHealthy || isStartup),
+		RawQuery: query.Encode(),
 	}
 	body, err := crowdsecQuery(bouncer, streamRouteURL.String(), nil)
 	if err != nil {
@@ -598,25 +1591,193 @@ func handleStreamCache(bouncer *Bouncer) error {
 	for _, decision := range stream.New {
 		duration, err := time.ParseDuration(decision.Duration)
 		if err == nil {
-			var value string
-			switch decision.Type {
-			case "ban":
-				value = cache.BannedValue
-			case "captcha":
-				value = cache.CaptchaValue
-			default:
-				bouncer.log.Debug("handleStreamCache:unknownType " + decision.Type)
+			value, ok := decisionValue(bouncer, decision)
+			if !ok {
+				continue
+			}
+			key := decisionKey(bouncer, decision)
+			if isPrefixKey(bouncer, key) {
+				updatePrefixDecisions(bouncer, key, decision, value, int64(duration.Seconds()))
+				continue
 			}
-			bouncer.cacheClient.Set(decision.Value, value, int64(duration.Seconds()))
+			bouncer.cacheClient.Set(key, value, int64(duration.Seconds()))
+			setDecisionInfo(bouncer, key, decision, int64(duration.Seconds()))
 		}
 	}
 	for _, decision := range stream.Deleted {
-		bouncer.cacheClient.Delete(decision.Value)
+		key := decisionKey(bouncer, decision)
+		if isPrefixKey(bouncer, key) {
+			updatePrefixDecisions(bouncer, key, decision, "", 0)
+			continue
+		}
+		bouncer.cacheClient.Delete(key)
+		if bouncer.annotate || bouncer.redirect != nil {
+			bouncer.cacheClient.Delete(decisionInfoPrefix + key)
+		}
 	}
 	bouncer.log.Debug("handleStreamCache:updated")
 	return nil
 }
 
+// prefixDecision is a decision of an IPv6 prefix, see updatePrefixDecisions.
+type prefixDecision struct {
+	Member   string `json:"member"`
+	Value    string `json:"value"`
+	Expiry   int64  `json:"expiry"`
+	ID       int    `json:"id"`
+	Scenario string `json:"scenario"`
+}
+
+// isPrefixKey reports whether key is an IPv6 prefix grouping the decisions of its addresses and ranges.
+func isPrefixKey(bouncer *Bouncer, key string) bool {
+	return strings.Contains(key, "/") && ip.RangeKey(key, bouncer.ipv6PrefixLength) == key
+}
+
+// updatePrefixDecisions adds the decision to the ones of the prefix key, or removes it when value is empty,
+// and stores the most severe remediation of the remaining decisions under key.
+// A decision is identified by its ID, or by its value and type without ID.
+func updatePrefixDecisions(bouncer *Bouncer, key string, decision Decision, value string, duration int64) {
+	member := decision.Value + " " + decision.Type
+	if decision.ID != 0 {
+		member = strconv.Itoa(decision.ID)
+	}
+	now := time.Now().Unix()
+	var stored []prefixDecision
+	if raw, err := bouncer.cacheClient.Get(prefixMembersPrefix + key); err == nil {
+		_ = json.Unmarshal([]byte(raw), &stored)
+	}
+	decisions := make([]prefixDecision, 0, len(stored)+1)
+	for _, d := range stored {
+		if d.Member != member && d.Expiry > now {
+			decisions = append(decisions, d)
+		}
+	}
+	if value != "" {
+		decisions = append(decisions, prefixDecision{Member: member, Value: value, Expiry: now + duration, ID: decision.ID, Scenario: decision.Scenario})
+	}
+	if len(decisions) == 0 {
+		bouncer.cacheClient.Delete(key)
+		bouncer.cacheClient.Delete(prefixMembersPrefix + key)
+		if bouncer.annotate || bouncer.redirect != nil {
+			bouncer.cacheClient.Delete(decisionInfoPrefix + key)
+		}
+		return
+	}
+	// The most severe decision applies, the longest one among the equally severe.
+	winner := decisions[0]
+	lastExpiry := winner.Expiry
+	for _, d := range decisions[1:] {
+		severity, winnerSeverity := remediationSeverity(d.Value), remediationSeverity(winner.Value)
+		if severity > winnerSeverity || (severity == winnerSeverity && d.Expiry > winner.Expiry) {
+			winner = d
+		}
+		if d.Expiry > lastExpiry {
+			lastExpiry = d.Expiry
+		}
+	}
+	encoded, _ := json.Marshal(decisions)
+	bouncer.cacheClient.Set(prefixMembersPrefix+key, string(encoded), lastExpiry-now)
+	bouncer.cacheClient.Set(key, winner.Value, winner.Expiry-now)
+	setDecisionInfo(bouncer, key, Decision{ID: winner.ID, Scenario: winner.Scenario}, winner.Expiry-now)
+}
+
+// handleAllowlists pulls the content of the CrowdSec allowlists, expired items are skipped.
+// On failure the previous content is kept.
+func handleAllowlists(bouncer *Bouncer) error {
+	routeURL := url.URL{
+		Scheme:   bouncer.crowdsecScheme,
+		Host:     bouncer.crowdsecHost,
+		Path:     bouncer.crowdsecPath + crowdsecAllowlistsRoute,
+		RawQuery: "with_content=true",
+	}
+	body, err := crowdsecQuery(bouncer, routeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	var allowlists []Allowlist
+	err = json.Unmarshal(body, &allowlists)
+	if err != nil {
+		return fmt.Errorf("handleAllowlists:parsingBody %w", err)
+	}
+	now := time.Now()
+	var values []string
+	for _, allowlist := range allowlists {
+		for _, item := range allowlist.Items {
+			expiration, errTime := time.Parse(time.RFC3339, item.Expiration)
+			if errTime == nil && !expiration.IsZero() && expiration.Before(now) {
+				continue
+			}
+			values = append(values, item.Value)
+		}
+	}
+	invalid := allowlistChecker.Update(bouncer.log, values)
+	for _, value := range invalid {
+		bouncer.log.Info("handleAllowlists:invalidValue " + value)
+	}
+	bouncer.log.Debug(fmt.Sprintf("handleAllowlists:updated allowlists:%d values:%d", len(allowlists), len(values)-len(invalid)))
+	return nil
+}
+
+// setDecisionInfo stores the ID and the scenario of the decision applied to key,
+// only when they are forwarded in annotate mode or to the redirect portal.
+func setDecisionInfo(bouncer *Bouncer, key string, decision Decision, duration int64) {
+	if !bouncer.annotate && bouncer.redirect == nil {
+		return
+	}
+	bouncer.cacheClient.Set(decisionInfoPrefix+key, strconv.Itoa(decision.ID)+":"+decision.Scenario, duration)
+}
+
+// getDecisionInfo returns the ID and the scenario of the decision applied to key, empty when unknown.
+func getDecisionInfo(bouncer *Bouncer, key string) (string, string) {
+	value, err := bouncer.cacheClient.Get(decisionInfoPrefix + key)
+	if err != nil {
+		return "", ""
+	}
+	id, scenario, _ := strings.Cut(value, ":")
+	return id, scenario
+}
+
+// streamScopes returns the scopes of the decisions enforced by the bouncer.
+func streamScopes(bouncer *Bouncer) []string {
+	scopes := []string{"ip", "range"}
+	if bouncer.geoCountry != nil {
+		scopes = append(scopes, "country")
+	}
+	if bouncer.geoASN != nil {
+		scopes = append(scopes, "as")
+	}
+	for _, extractor := range bouncer.customScopes {
+		scopes = append(scopes, extractor.Scope)
+	}
+	return scopes
+}
+
+// decisionKey returns the cache key of a decision, matching the key computed in ServeHTTP.
+func decisionKey(bouncer *Bouncer, decision Decision) string {
+	if strings.EqualFold(decision.Scope, "country") {
+		return geo.CountryKey(decision.Value)
+	}
+	if strings.EqualFold(decision.Scope, "as") {
+		return geo.ASKey(decision.Value)
+	}
+	for _, extractor := range bouncer.customScopes {
+		if strings.EqualFold(decision.Scope, extractor.Scope) {
+			return scope.Key(extractor.Scope, decision.Value)
+		}
+	}
+	if strings.EqualFold(decision.Scope, "range") {
+		if key := ip.RangeKey(decision.Value, bouncer.ipv6PrefixLength); key != "" {
+			return key
+		}
+		return decision.Value
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(decision.Value))
+	if err != nil {
+		return decision.Value
+	}
+	return ip.Key(addr, decision.Value, bouncer.ipv6PrefixLength)
+}
+
 func crowdsecQuery(bouncer *Bouncer, stringURL string, data []byte) ([]byte, error) {
 	var req *http.Request
 	if len(data) > 0 {
@@ -723,9 +1884,11 @@ func appsecQuery(bouncer *Bouncer, ip string, httpReq *http.Request) error {
 func reportMetrics(bouncer *Bouncer) error {
 	now := time.Now()
 	currentCount := atomic.LoadInt64(&blockedRequests)
+	bypassedCount := atomic.LoadInt64(&bypassedRequests)
+	dryRunCount := atomic.LoadInt64(&dryRunRequests)
 	windowSizeSeconds := int(now.Sub(lastMetricsPush).Seconds())
 
-	bouncer.log.Debug(fmt.Sprintf("reportMetrics: blocked_requests=%d window_size=%ds", currentCount, windowSizeSeconds))
+	bouncer.log.Debug(fmt.Sprintf("reportMetrics: blocked_requests=%d bypassed_requests=%d dry_run_requests=%d window_size=%ds", currentCount, bypassedCount, dryRunCount, windowSizeSeconds))
 
 	metrics := map[string]interface{}{
 		"remediation_components": []map[string]interface{}{
@@ -744,6 +1907,22 @@ func reportMetrics(bouncer *Bouncer) error {
 									"type": "traefik_plugin",
 								},
 							},
+							{
+								"name":  "bypassed",
+								"value": bypassedCount,
+								"unit":  "request",
+								"labels": map[string]string{
+									"type": "traefik_plugin",
+								},
+							},
+							{
+								"name":  "dry_run",
+								"value": dryRunCount,
+								"unit":  "request",
+								"labels": map[string]string{
+									"type": "traefik_plugin",
+								},
+							},
 						},
 						"meta": map[string]interface{}{
 							"window_size_seconds": windowSizeSeconds,
@@ -778,6 +1957,8 @@ func reportMetrics(bouncer *Bouncer) error {
 	}
 
 	atomic.StoreInt64(&blockedRequests, 0)
+	atomic.StoreInt64(&bypassedRequests, 0)
+	atomic.StoreInt64(&dryRunRequests, 0)
 	lastMetricsPush = now
 	return nil
 }
@@ -2,15 +2,40 @@ package crowdsec_bouncer_traefik_plugin //nolint:revive,stylecheck
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"text/template"
+	"time"
 
+	bypass "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/bypass"
 	cache "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/cache"
+	captcha "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/captcha"
 	configuration "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/configuration"
+	geo "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/geo"
+	goodbot "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/goodbot"
 	ip "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/ip"
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+	redirect "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/redirect"
+	response "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/response"
+	rules "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/rules"
+	scope "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/scope"
+	throttle "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/throttle"
 )
 
 func TestServeHTTP(t *testing.T) {
@@ -75,7 +100,7 @@ func TestBouncer_ServeHTTP(t *testing.T) {
 		crowdsecMode           string
 		updateInterval         int64
 		defaultDecisionTimeout int64
-		forwardedCustomHeader  string
+		forwardedHeaders       []string
 		clientPoolStrategy     *ip.PoolStrategy
 		serverPoolStrategy     *ip.PoolStrategy
 		httpClient             *http.Client
@@ -105,7 +130,7 @@ func TestBouncer_ServeHTTP(t *testing.T) {
 				crowdsecMode:           tt.fields.crowdsecMode,
 				updateInterval:         tt.fields.updateInterval,
 				defaultDecisionTimeout: tt.fields.defaultDecisionTimeout,
-				forwardedCustomHeader:  tt.fields.forwardedCustomHeader,
+				forwardedHeaders:       tt.fields.forwardedHeaders,
 				clientPoolStrategy:     tt.fields.clientPoolStrategy,
 				serverPoolStrategy:     tt.fields.serverPoolStrategy,
 				httpClient:             tt.fields.httpClient,
@@ -117,6 +142,31 @@ func TestBouncer_ServeHTTP(t *testing.T) {
 }
 
 func Test_handleNoStreamCache(t *testing.T) {
+	lapi := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		switch {
+		case query.Get("ip") == "198.51.100.20":
+			_, _ = rw.Write([]byte(`[{"type":"captcha","scope":"Ip","value":"198.51.100.20","duration":"1h"}]`))
+		case query.Get("range") == "2001:db8:1::/64" && query.Get("contains") == "false":
+			_, _ = rw.Write([]byte(`[{"type":"captcha","scope":"Ip","value":"2001:db8:1::5","duration":"1h"}]`))
+		case strings.HasPrefix(query.Get("range"), "2001:db8:") && query.Get("contains") == "true":
+			_, _ = rw.Write([]byte(`[{"type":"ban","scope":"Range","value":"2001:db8::/48","duration":"1h"}]`))
+		default:
+			_, _ = rw.Write([]byte("null"))
+		}
+	}))
+	defer lapi.Close()
+	newBouncer := func() *Bouncer {
+		bouncer, _ := newTestBouncer(t, "198.51.100.7")
+		bouncer.crowdsecMode = configuration.NoneMode
+		bouncer.crowdsecScheme = "http"
+		bouncer.crowdsecHost = strings.TrimPrefix(lapi.URL, "http://")
+		bouncer.crowdsecPath = "/"
+		bouncer.crowdsecHeader = crowdsecLapiHeader
+		bouncer.httpClient = lapi.Client()
+		bouncer.ipv6PrefixLength = 64
+		return bouncer
+	}
 	type args struct {
 		bouncer  *Bouncer
 		remoteIP string
@@ -124,15 +174,24 @@ func Test_handleNoStreamCache(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
+		want    string
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{name: "IP decision", args: args{bouncer: newBouncer(), remoteIP: "198.51.100.20"}, want: cache.CaptchaValue, wantErr: true},
+		{name: "IP without decision", args: args{bouncer: newBouncer(), remoteIP: "198.51.100.21"}, want: cache.NoBannedValue},
+		{name: "Range covering the prefix", args: args{bouncer: newBouncer(), remoteIP: "2001:db8:2::/64"}, want: cache.BannedValue, wantErr: true},
+		{name: "Most severe of the prefix and covering decisions", args: args{bouncer: newBouncer(), remoteIP: "2001:db8:1::/64"}, want: cache.BannedValue, wantErr: true},
+		{name: "Prefix without decision", args: args{bouncer: newBouncer(), remoteIP: "2001:db9::/64"}, want: cache.NoBannedValue},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if _, err := handleNoStreamCache(tt.args.bouncer, tt.args.remoteIP); (err != nil) != tt.wantErr {
+			got, err := handleNoStreamCache(tt.args.bouncer, tt.args.remoteIP)
+			if (err != nil) != tt.wantErr {
 				t.Errorf("handleNoStreamCache() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if got != tt.want {
+				t.Errorf("handleNoStreamCache() = %v, want %v", got, tt.want)
+			}
 		})
 	}
 }
@@ -159,6 +218,72 @@ func Test_handleStreamCache(t *testing.T) {
 	}
 }
 
+func Test_handleStreamCacheIPv6Prefix(t *testing.T) {
+	var stream string
+	lapi := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte(stream))
+	}))
+	defer lapi.Close()
+	bouncer, _ := newTestBouncer(t, "198.51.100.7")
+	bouncer.crowdsecScheme = "http"
+	bouncer.crowdsecHost = strings.TrimPrefix(lapi.URL, "http://")
+	bouncer.crowdsecPath = "/"
+	bouncer.crowdsecStreamRoute = crowdsecLapiStreamRoute
+	bouncer.crowdsecHeader = crowdsecLapiHeader
+	bouncer.httpClient = lapi.Client()
+	bouncer.updateInterval = 60
+	bouncer.ipv6PrefixLength = 64
+	t.Cleanup(func() {
+		for _, key := range []string{cacheTimeoutKey, "2001:db8::/64", prefixMembersPrefix + "2001:db8::/64"} {
+			bouncer.cacheClient.Delete(key)
+		}
+	})
+	tests := []struct {
+		name   string
+		stream string
+		want   string
+	}{
+		{
+			name:   "Ban then captcha in the prefix",
+			stream: `{"new":[{"id":1,"type":"ban","scope":"Ip","value":"2001:db8::1","duration":"1h"},{"id":2,"type":"captcha","scope":"Ip","value":"2001:db8::2","duration":"1h"}]}`,
+			want:   cache.BannedValue,
+		},
+		{
+			name:   "Range of the prefix",
+			stream: `{"new":[{"id":3,"type":"captcha","scope":"Range","value":"2001:db8::/64","duration":"1h"}]}`,
+			want:   cache.BannedValue,
+		},
+		{
+			name:   "Ban deleted",
+			stream: `{"deleted":[{"id":1,"type":"ban","scope":"Ip","value":"2001:db8::1","duration":"0s"}]}`,
+			want:   cache.CaptchaValue,
+		},
+		{
+			name:   "Captchas deleted",
+			stream: `{"deleted":[{"id":2,"type":"captcha","scope":"Ip","value":"2001:db8::2","duration":"0s"},{"id":3,"type":"captcha","scope":"Range","value":"2001:db8::/64","duration":"0s"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream = tt.stream
+			bouncer.cacheClient.Delete(cacheTimeoutKey)
+			if err := handleStreamCache(bouncer); err != nil {
+				t.Fatal(err)
+			}
+			got, err := bouncer.cacheClient.Get("2001:db8::/64")
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("handleStreamCache() prefix = %v, want no decision", got)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("handleStreamCache() prefix = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_crowdsecQuery(t *testing.T) {
 	type args struct {
 		bouncer   *Bouncer
@@ -186,3 +311,1427 @@ func Test_crowdsecQuery(t *testing.T) {
 		})
 	}
 }
+
+func Test_streamScopes(t *testing.T) {
+	geoCountry, err := geo.Open("tests/GeoLite2-Country-Test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		bouncer *Bouncer
+		want    []string
+	}{
+		{name: "IP scopes only", bouncer: &Bouncer{}, want: []string{"ip", "range"}},
+		{name: "Country scope with a country database", bouncer: &Bouncer{geoCountry: geoCountry}, want: []string{"ip", "range", "country"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamScopes(tt.bouncer); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("streamScopes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testRemediationHeader is the remediation header set by the bouncers of newTestBouncer.
+const testRemediationHeader = "X-Crowdsec-Remediation"
+
+// testNextBody is the body written by the service behind the bouncers of newTestBouncer.
+var testNextBody = []byte("next")
+
+// newTestBouncer returns a stream bouncer behind a trusted proxy, with the allowed IP in cache,
+// banning with a 403 and the remediation header. The cache entries of the client IP are removed after the test.
+func newTestBouncer(tb testing.TB, clientIP string) (*Bouncer, *http.Request) {
+	tb.Helper()
+	log := logger.New("INFO", "")
+	serverChecker, _ := ip.NewChecker(log, []string{"10.0.0.0/8"})
+	clientChecker, _ := ip.NewChecker(log, []string{"192.168.0.0/16"})
+	cacheClient := &cache.Client{}
+	cacheClient.New(log, false, false, "", "", "", "")
+	bouncer := &Bouncer{
+		next: http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			_, _ = rw.Write(testNextBody)
+		}),
+		enabled:                 true,
+		crowdsecMode:            configuration.StreamMode,
+		forwardedHeaders:        []string{"X-Forwarded-For"},
+		serverPoolStrategy:      &ip.PoolStrategy{Checker: serverChecker},
+		clientPoolStrategy:      &ip.PoolStrategy{Checker: clientChecker},
+		remediationStatusCode:   http.StatusForbidden,
+		remediationCustomHeader: testRemediationHeader,
+		cacheClient:             cacheClient,
+		captchaClient:           &captcha.Client{},
+		responses:               &response.Renderer{},
+		log:                     log,
+	}
+	setTestDecision(tb, bouncer, "198.51.100.7", cache.NoBannedValue)
+	tb.Cleanup(func() {
+		for _, key := range []string{clientIP, clientIP + "_captcha", allowlistKeyPrefix + clientIP, decisionInfoPrefix + clientIP} {
+			cacheClient.Delete(key)
+		}
+	})
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("X-Forwarded-For", clientIP+", 10.0.0.1")
+	return bouncer, req
+}
+
+// setTestDecision caches the remediation of a key until the end of the test.
+func setTestDecision(tb testing.TB, bouncer *Bouncer, key, value string) {
+	tb.Helper()
+	bouncer.cacheClient.Set(key, value, 60)
+	tb.Cleanup(func() { bouncer.cacheClient.Delete(key) })
+}
+
+// checkResponse checks the status and the remediation header of a response of a bouncer of newTestBouncer,
+// and that its body comes from the service when the request is forwarded, and is empty when it is banned without template.
+func checkResponse(tb testing.TB, rw *httptest.ResponseRecorder, want int, wantRemediation string) {
+	tb.Helper()
+	if rw.Code != want {
+		tb.Errorf("ServeHTTP() status = %d, want %d", rw.Code, want)
+	}
+	if got := rw.Header().Get(testRemediationHeader); got != wantRemediation {
+		tb.Errorf("ServeHTTP() remediation header = %q, want %q", got, wantRemediation)
+	}
+	switch wantRemediation {
+	case "":
+		if rw.Body.String() != string(testNextBody) {
+			tb.Errorf("ServeHTTP() body = %q, want the body of the service", rw.Body.String())
+		}
+	case "ban":
+		if rw.Body.Len() != 0 {
+			tb.Errorf("ServeHTTP() body = %q, want no body", rw.Body.String())
+		}
+	default:
+		if rw.Body.String() == string(testNextBody) {
+			tb.Error("ServeHTTP() forwarded the request")
+		}
+	}
+}
+
+// checkBan checks the response of a bouncer of newTestBouncer, forwarding the request when want is 200 and banning it otherwise.
+func checkBan(tb testing.TB, rw *httptest.ResponseRecorder, want int) {
+	tb.Helper()
+	if want == http.StatusOK {
+		checkResponse(tb, rw, want, "")
+		return
+	}
+	checkResponse(tb, rw, want, "ban")
+}
+
+func newBanPages(tb testing.TB, templates map[string]string) *response.Pages {
+	tb.Helper()
+	compiledTemplates := map[string]*htmltemplate.Template{}
+	for lang, content := range templates {
+		compiledTemplate, err := htmltemplate.New(lang).Parse(content)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		compiledTemplates[lang] = compiledTemplate
+	}
+	return response.NewPages(compiledTemplates)
+}
+
+func TestServeHTTPAllocations(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientIP string
+	}{
+		{name: "Allowed from cache", clientIP: "198.51.100.7"},
+		{name: "Missing from stream cache", clientIP: "198.51.100.8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, tt.clientIP)
+			rw := httptest.NewRecorder()
+			allocs := testing.AllocsPerRun(100, func() {
+				bouncer.ServeHTTP(rw, req)
+			})
+			if allocs != 0 {
+				t.Errorf("ServeHTTP() allocs = %v, want 0", allocs)
+			}
+		})
+	}
+}
+
+func BenchmarkServeHTTPCacheHit(b *testing.B) {
+	bouncer, req := newTestBouncer(b, "198.51.100.7")
+	rw := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bouncer.ServeHTTP(rw, req)
+	}
+}
+
+func Test_decisionKey(t *testing.T) {
+	username, _ := scope.Parse("username=jwt:sub", "")
+	bouncer := &Bouncer{ipv6PrefixLength: 64, customScopes: []*scope.Extractor{username}}
+	tests := []struct {
+		name     string
+		decision Decision
+		want     string
+	}{
+		{name: "IPv4 decision", decision: Decision{Scope: "Ip", Value: "1.2.3.4"}, want: "1.2.3.4"},
+		{name: "IPv4-mapped decision", decision: Decision{Scope: "Ip", Value: "::ffff:1.2.3.4"}, want: "1.2.3.4"},
+		{name: "IPv6 decision grouped by prefix", decision: Decision{Scope: "Ip", Value: "2001:0db8:0:0:1::1"}, want: "2001:db8::/64"},
+		{name: "IPv6 range of the prefix length", decision: Decision{Scope: "Range", Value: "2001:db8::/64"}, want: "2001:db8::/64"},
+		{name: "Other range kept as is", decision: Decision{Scope: "Range", Value: "1.2.3.0/24"}, want: "1.2.3.0/24"},
+		{name: "Country decision", decision: Decision{Scope: "Country", Value: "fr"}, want: "country:FR"},
+		{name: "AS decision", decision: Decision{Scope: "AS", Value: "AS64496"}, want: "as:64496"},
+		{name: "Custom scope decision", decision: Decision{Scope: "Username", Value: "Alice"}, want: "username:Alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decisionKey(bouncer, tt.decision); got != tt.want {
+				t.Errorf("decisionKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPDeepChain(t *testing.T) {
+	tests := []struct {
+		name      string
+		deepChain bool
+		maxHops   int
+		xff       string
+		want      int
+	}{
+		{name: "Banned hop ignored by default", deepChain: false, maxHops: 5, xff: "203.0.113.9, 198.51.100.7, 10.0.0.1", want: http.StatusOK},
+		{name: "Banned hop found in deep chain", deepChain: true, maxHops: 5, xff: "203.0.113.9, 198.51.100.7, 10.0.0.1", want: http.StatusForbidden},
+		{name: "Banned hop beyond the maximum hops", deepChain: true, maxHops: 2, xff: "203.0.113.9, 198.51.100.7, 10.0.0.1", want: http.StatusOK},
+		{name: "Trusted client hop ignored", deepChain: true, maxHops: 5, xff: "203.0.113.9, 192.168.1.1, 10.0.0.1", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, "")
+			bouncer.deepChain = tt.deepChain
+			bouncer.deepChainMaxHops = tt.maxHops
+			setTestDecision(t, bouncer, "203.0.113.9", cache.BannedValue)
+			req.Header.Set("X-Forwarded-For", tt.xff)
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			checkBan(t, rw, tt.want)
+		})
+	}
+}
+
+func TestServeHTTPGeo(t *testing.T) {
+	geoCountry, err := geo.Open("tests/GeoLite2-Country-Test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	geoASN, err := geo.Open("tests/GeoLite2-ASN-Test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		allowList []string
+		denyList  []string
+		decisions map[string]string
+		clientIP  string
+		want      int
+	}{
+		{name: "No list nor decision", clientIP: "192.0.2.1", want: http.StatusOK},
+		{name: "Country in deny list", denyList: []string{"FR"}, clientIP: "192.0.2.1", want: http.StatusForbidden},
+		{name: "Country not in allow list", allowList: []string{"US"}, clientIP: "192.0.2.1", want: http.StatusForbidden},
+		{name: "Country in allow list", allowList: []string{"FR"}, clientIP: "192.0.2.1", want: http.StatusOK},
+		{name: "Unknown country not blocked by allow list", allowList: []string{"FR"}, clientIP: "203.0.113.200", want: http.StatusOK},
+		{name: "Country decision", decisions: map[string]string{"country:JP": cache.BannedValue}, clientIP: "203.0.113.1", want: http.StatusForbidden},
+		{name: "AS decision", decisions: map[string]string{"as:64497": cache.BannedValue}, clientIP: "198.51.100.9", want: http.StatusForbidden},
+		{name: "Decision on another AS", decisions: map[string]string{"as:64497": cache.BannedValue}, clientIP: "192.0.2.1", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, tt.clientIP)
+			bouncer.geoCountry = geoCountry
+			bouncer.geoASN = geoASN
+			bouncer.countryAllowList = tt.allowList
+			bouncer.countryDenyList = tt.denyList
+			for key, value := range tt.decisions {
+				setTestDecision(t, bouncer, key, value)
+			}
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			checkBan(t, rw, tt.want)
+		})
+	}
+}
+
+func TestServeHTTPCustomScopes(t *testing.T) {
+	lapi := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("scope") == "username" && req.URL.Query().Get("value") == "mallory" {
+			_, _ = rw.Write([]byte(`[{"type":"ban","scope":"username","value":"mallory","duration":"1h"}]`))
+			return
+		}
+		_, _ = rw.Write([]byte("null"))
+	}))
+	defer lapi.Close()
+	username, _ := scope.Parse("username=header:X-Username", "")
+	apiKey, _ := scope.Parse("api_key=cookie:api_key", "")
+	tests := []struct {
+		name      string
+		mode      string
+		decisions map[string]string
+		header    string
+		cookie    string
+		want      int
+	}{
+		{name: "Stream header decision", mode: configuration.StreamMode, decisions: map[string]string{"username:eve": cache.BannedValue}, header: "eve", want: http.StatusForbidden},
+		{name: "Stream cookie decision", mode: configuration.StreamMode, decisions: map[string]string{"api_key:k1": cache.BannedValue}, cookie: "k1", want: http.StatusForbidden},
+		{name: "Stream without decision", mode: configuration.StreamMode, header: "bob", want: http.StatusOK},
+		{name: "Live decision from LAPI", mode: configuration.LiveMode, header: "mallory", want: http.StatusForbidden},
+		{name: "Live without decision", mode: configuration.LiveMode, header: "bob", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, "198.51.100.7")
+			bouncer.crowdsecMode = tt.mode
+			bouncer.crowdsecScheme = "http"
+			bouncer.crowdsecHost = strings.TrimPrefix(lapi.URL, "http://")
+			bouncer.crowdsecPath = "/"
+			bouncer.crowdsecHeader = crowdsecLapiHeader
+			bouncer.defaultDecisionTimeout = 60
+			bouncer.httpClient = lapi.Client()
+			bouncer.customScopes = []*scope.Extractor{username, apiKey}
+			for key, value := range tt.decisions {
+				setTestDecision(t, bouncer, key, value)
+			}
+			t.Cleanup(func() { bouncer.cacheClient.Delete(scope.Key("username", tt.header)) })
+			if tt.header != "" {
+				req.Header.Set("X-Username", tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "api_key", Value: tt.cookie})
+			}
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			checkBan(t, rw, tt.want)
+		})
+	}
+}
+
+// staticResolver resolves names and addresses from static records.
+type staticResolver struct {
+	names map[string][]string
+	hosts map[string][]string
+}
+
+func (r staticResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	return r.names[addr], nil
+}
+
+func (r staticResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	return r.hosts[host], nil
+}
+
+func TestServeHTTPGoodBot(t *testing.T) {
+	resolver := staticResolver{
+		names: map[string][]string{"66.249.66.10": {"crawl-66-249-66-10.googlebot.com."}},
+		hosts: map[string][]string{"crawl-66-249-66-10.googlebot.com": {"66.249.66.10"}},
+	}
+	tests := []struct {
+		name      string
+		clientIP  string
+		userAgent string
+		want      int
+	}{
+		{name: "Verified crawler bypasses the ban", clientIP: "66.249.66.10", userAgent: "Googlebot/2.1", want: http.StatusOK},
+		{name: "Spoofed crawler is banned", clientIP: "203.0.113.10", userAgent: "Googlebot/2.1", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, tt.clientIP)
+			verifier, err := goodbot.New(bouncer.log, bouncer.cacheClient, resolver, nil, 60)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bouncer.goodBots = verifier
+			setTestDecision(t, bouncer, tt.clientIP, cache.BannedValue)
+			req.Header.Set("User-Agent", tt.userAgent)
+			bypassed := atomic.LoadInt64(&bypassedRequests)
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			checkBan(t, rw, tt.want)
+			wantBypassed := int64(0)
+			if tt.want == http.StatusOK {
+				wantBypassed = 1
+			}
+			if got := atomic.LoadInt64(&bypassedRequests) - bypassed; got != wantBypassed {
+				t.Errorf("ServeHTTP() counted %d bypassed requests, want %d", got, wantBypassed)
+			}
+		})
+	}
+}
+
+func TestServeHTTPBypass(t *testing.T) {
+	secret := "a-secret-long-enough-for-hmac-sha256"
+	probe := &x509.Certificate{Subject: pkix.Name{CommonName: "probe"}}
+	tests := []struct {
+		name     string
+		token    string
+		verified bool
+		want     int
+	}{
+		{name: "No bypass", want: http.StatusForbidden},
+		{name: "Valid token", token: bypass.Sign(secret, "uptime", time.Now().Add(time.Hour)), want: http.StatusOK},
+		{name: "Expired token", token: bypass.Sign(secret, "uptime", time.Now().Add(-time.Hour)), want: http.StatusForbidden},
+		{name: "Verified certificate", verified: true, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, "203.0.113.20")
+			bouncer.bypassRules = bypass.New([]string{"probe"}, nil, nil, "X-Crowdsec-Bypass-Token", secret)
+			bouncer.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("X-Crowdsec-Bypass-Token") != "" {
+					t.Error("ServeHTTP() forwarded the bypass token")
+				}
+				_, _ = rw.Write(testNextBody)
+			})
+			setTestDecision(t, bouncer, "203.0.113.20", cache.BannedValue)
+			if tt.token != "" {
+				req.Header.Set("X-Crowdsec-Bypass-Token", tt.token)
+			}
+			if tt.verified {
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{probe}}}
+			}
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			checkBan(t, rw, tt.want)
+		})
+	}
+}
+
+func Test_reportMetrics(t *testing.T) {
+	var items []map[string]interface{}
+	lapi := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		var metrics struct {
+			RemediationComponents []struct {
+				Metrics []struct {
+					Items []map[string]interface{} `json:"items"`
+				} `json:"metrics"`
+			} `json:"remediation_components"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&metrics); err != nil {
+			t.Error(err)
+			return
+		}
+		items = metrics.RemediationComponents[0].Metrics[0].Items
+	}))
+	defer lapi.Close()
+	bouncer, _ := newTestBouncer(t, "198.51.100.7")
+	bouncer.crowdsecScheme = "http"
+	bouncer.crowdsecHost = strings.TrimPrefix(lapi.URL, "http://")
+	bouncer.crowdsecPath = "/"
+	bouncer.crowdsecHeader = crowdsecLapiHeader
+	bouncer.httpClient = lapi.Client()
+	atomic.StoreInt64(&blockedRequests, 3)
+	atomic.StoreInt64(&bypassedRequests, 2)
+	atomic.StoreInt64(&dryRunRequests, 1)
+	want := map[string]float64{"dropped": 3, "bypassed": 2, "dry_run": 1}
+	if err := reportMetrics(bouncer); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, item := range items {
+		got[item["name"].(string)], _ = item["value"].(float64)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reportMetrics() items = %v, want %v", got, want)
+	}
+	if atomic.LoadInt64(&blockedRequests) != 0 || atomic.LoadInt64(&bypassedRequests) != 0 || atomic.LoadInt64(&dryRunRequests) != 0 {
+		t.Error("reportMetrics() did not reset the counters")
+	}
+}
+
+func TestServeHTTPRequestRules(t *testing.T) {
+	healthz, _ := rules.New("", "/healthz", "", nil, "", "", rules.ActionBypass, nil)
+	admin, _ := rules.New("", "/admin", "", nil, "", "", rules.ActionBan, nil)
+	login, _ := rules.New("", "/login", "", nil, "", "", rules.ActionEnforce, []string{"captcha"})
+	tests := []struct {
+		name            string
+		clientIP        string
+		path            string
+		want            int
+		wantRemediation string
+	}{
+		{name: "Banned IP on a bypassed path", clientIP: "203.0.113.30", path: "/healthz", want: http.StatusOK},
+		{name: "Banned IP on another path", clientIP: "203.0.113.30", path: "/", want: http.StatusForbidden, wantRemediation: "ban"},
+		{name: "Allowed IP on a banned path", clientIP: "198.51.100.7", path: "/admin/users", want: http.StatusForbidden, wantRemediation: "ban"},
+		{name: "Allowed IP on another path", clientIP: "198.51.100.7", path: "/", want: http.StatusOK},
+		{name: "Captcha IP on the enforced path", clientIP: "203.0.113.31", path: "/login", want: http.StatusOK, wantRemediation: "captcha"},
+		{name: "Captcha IP on another path", clientIP: "203.0.113.31", path: "/", want: http.StatusOK},
+		{name: "Banned IP on the captcha enforced path", clientIP: "203.0.113.30", path: "/login", want: http.StatusForbidden, wantRemediation: "ban"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, tt.clientIP)
+			bouncer.requestRules = []*rules.Rule{healthz, admin, login}
+			if err := bouncer.captchaClient.New(bouncer.log, bouncer.cacheClient, http.DefaultClient, configuration.TurnstileProvider, "", "", "", "", "", "", "", "captcha.html", "en", "", 0, 60); err != nil {
+				t.Fatal(err)
+			}
+			setTestDecision(t, bouncer, "203.0.113.30", cache.BannedValue)
+			setTestDecision(t, bouncer, "203.0.113.31", cache.CaptchaValue)
+			req.URL.Path = tt.path
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			checkResponse(t, rw, tt.want, tt.wantRemediation)
+		})
+	}
+}
+
+func TestServeHTTPAllowlists(t *testing.T) {
+	var checks int64
+	lapi := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/"+crowdsecAllowCheckRoute) {
+			atomic.AddInt64(&checks, 1)
+		}
+		switch req.URL.Path {
+		case "/" + crowdsecAllowlistsRoute:
+			_, _ = rw.Write([]byte(`[{"name":"partners","items":[` +
+				`{"value":"203.0.113.0/28","expiration":"0001-01-01T00:00:00.000Z"},` +
+				`{"value":"203.0.113.30","expiration":"2000-01-01T00:00:00.000Z"},` +
+				`{"value":"not-an-ip"}]}]`))
+		case "/" + crowdsecAllowCheckRoute + "203.0.113.5":
+			_, _ = rw.Write([]byte(`{"allowlisted":true,"reason":"203.0.113.0/28 from partners"}`))
+		default:
+			_, _ = rw.Write([]byte(`{"allowlisted":false}`))
+		}
+	}))
+	defer lapi.Close()
+	tests := []struct {
+		name     string
+		mode     string
+		clientIP string
+		want     int
+	}{
+		{name: "Stream allowlisted range", mode: configuration.StreamMode, clientIP: "203.0.113.5", want: http.StatusOK},
+		{name: "Stream expired item", mode: configuration.StreamMode, clientIP: "203.0.113.30", want: http.StatusForbidden},
+		{name: "Stream not allowlisted", mode: configuration.StreamMode, clientIP: "203.0.113.20", want: http.StatusForbidden},
+		{name: "Live allowlisted", mode: configuration.LiveMode, clientIP: "203.0.113.5", want: http.StatusOK},
+		{name: "Live not allowlisted", mode: configuration.LiveMode, clientIP: "203.0.113.20", want: http.StatusForbidden},
+		{name: "None allowlisted", mode: configuration.NoneMode, clientIP: "203.0.113.5", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, tt.clientIP)
+			bouncer.crowdsecMode = tt.mode
+			bouncer.crowdsecScheme = "http"
+			bouncer.crowdsecHost = strings.TrimPrefix(lapi.URL, "http://")
+			bouncer.crowdsecPath = "/"
+			bouncer.crowdsecHeader = crowdsecLapiHeader
+			bouncer.defaultDecisionTimeout = 60
+			bouncer.httpClient = lapi.Client()
+			bouncer.allowlistsEnabled = true
+			if tt.mode == configuration.StreamMode {
+				if err := handleAllowlists(bouncer); err != nil {
+					t.Fatal(err)
+				}
+				defer allowlistChecker.Update(bouncer.log, nil)
+			}
+			setTestDecision(t, bouncer, tt.clientIP, cache.BannedValue)
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			checkBan(t, rw, tt.want)
+			if tt.mode == configuration.StreamMode {
+				return
+			}
+			if value, _ := bouncer.cacheClient.Get(allowlistKeyPrefix + tt.clientIP); value != strconv.FormatBool(tt.want == http.StatusOK) {
+				t.Errorf("isAllowlisted() cached %q", value)
+			}
+			// The second request is answered from the cache.
+			atomic.StoreInt64(&checks, 0)
+			bouncer.ServeHTTP(httptest.NewRecorder(), req)
+			if got := atomic.LoadInt64(&checks); got != 0 {
+				t.Errorf("isAllowlisted() queried LAPI %d times for a cached IP", got)
+			}
+		})
+	}
+}
+
+func TestNewAllowlistsTicker(t *testing.T) {
+	lapi := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/"+crowdsecAllowlistsRoute {
+			_, _ = rw.Write([]byte(`[{"name":"partners","items":[{"value":"203.0.113.0/28"}]}]`))
+			return
+		}
+		_, _ = rw.Write([]byte(`{"new":null,"deleted":null}`))
+	}))
+	defer lapi.Close()
+	t.Cleanup(func() {
+		for _, ticker := range []*chan bool{&streamTicker, &allowlistsTicker} {
+			if *ticker != nil {
+				*ticker <- true
+				*ticker = nil
+			}
+		}
+		isStartup = true
+		allowlistChecker.Update(nil, nil)
+	})
+
+	newConfig := func(allowlistsEnabled bool) *configuration.Config {
+		cfg := CreateConfig()
+		cfg.CrowdsecMode = configuration.StreamMode
+		cfg.CrowdsecLapiScheme = "http"
+		cfg.CrowdsecLapiHost = strings.TrimPrefix(lapi.URL, "http://")
+		cfg.CrowdsecLapiKey = "test"
+		cfg.MetricsUpdateIntervalSeconds = 0
+		cfg.CrowdsecAllowlistsEnabled = allowlistsEnabled
+		return cfg
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	// The first middleware pulls the stream without the allowlists, the second one enables them.
+	first, err := New(context.Background(), next, newConfig(false), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { first.(*Bouncer).cacheClient.Delete(cacheTimeoutKey) })
+	if allowlistChecker.ContainsAddr(netip.MustParseAddr("203.0.113.5")) {
+		t.Fatal("New() pulled the allowlists of a middleware without them")
+	}
+	if _, err = New(context.Background(), next, newConfig(true), "second"); err != nil {
+		t.Fatal(err)
+	}
+	if !allowlistChecker.ContainsAddr(netip.MustParseAddr("203.0.113.5")) {
+		t.Error("New() expected the allowlists to be pulled by the first middleware enabling them")
+	}
+}
+
+func TestServeHTTPRemediationPolicies(t *testing.T) {
+	lapi := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("ip") {
+		case "203.0.113.40":
+			_, _ = rw.Write([]byte(`[{"type":"ban","origin":"lists","scenario":"tor-exit-nodes","scope":"Ip","value":"203.0.113.40","duration":"1h"}]`))
+		case "203.0.113.41":
+			_, _ = rw.Write([]byte(`[{"type":"ban","origin":"crowdsec","scenario":"crowdsecurity/http-bad-user-agent","scope":"Ip","value":"203.0.113.41","duration":"1h"}]`))
+		case "203.0.113.42":
+			_, _ = rw.Write([]byte(`[{"type":"custom","origin":"cscli","scenario":"manual","scope":"Ip","value":"203.0.113.42","duration":"1h"}]`))
+		default:
+			_, _ = rw.Write([]byte("null"))
+		}
+	}))
+	defer lapi.Close()
+	policies, err := configuration.GetRemediationPolicies(&configuration.Config{RemediationPolicies: []configuration.Policy{
+		{Origin: "lists:tor-*", Action: "bypass"},
+		{Scenario: "crowdsecurity/http-bad-user-agent", Action: "ban", StatusCode: http.StatusTooManyRequests},
+		{Type: "custom", Action: "ban", StatusCode: http.StatusUnavailableForLegalReasons},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		clientIP string
+		want     int
+	}{
+		{name: "Bypassed list", clientIP: "203.0.113.40", want: http.StatusOK},
+		{name: "Ban with a status code", clientIP: "203.0.113.41", want: http.StatusTooManyRequests},
+		{name: "Unknown type", clientIP: "203.0.113.42", want: http.StatusUnavailableForLegalReasons},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, tt.clientIP)
+			bouncer.crowdsecMode = configuration.LiveMode
+			bouncer.crowdsecScheme = "http"
+			bouncer.crowdsecHost = strings.TrimPrefix(lapi.URL, "http://")
+			bouncer.crowdsecPath = "/"
+			bouncer.crowdsecHeader = crowdsecLapiHeader
+			bouncer.defaultDecisionTimeout = 60
+			bouncer.httpClient = lapi.Client()
+			bouncer.remediationPolicies = policies
+			// The second request is answered from the cache.
+			for i := 0; i < 2; i++ {
+				rw := httptest.NewRecorder()
+				bouncer.ServeHTTP(rw, req)
+				checkBan(t, rw, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPUnknownDecisionType(t *testing.T) {
+	var queries int64
+	lapi := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&queries, 1)
+		if req.URL.Path == "/"+crowdsecLapiStreamRoute {
+			_, _ = rw.Write([]byte(`{"new":[{"id":1,"type":"mfa","scope":"Ip","value":"203.0.113.43","duration":"1h"}]}`))
+			return
+		}
+		_, _ = rw.Write([]byte(`[{"id":1,"type":"mfa","scope":"Ip","value":"203.0.113.43","duration":"1h"}]`))
+	}))
+	defer lapi.Close()
+	tests := []struct {
+		name        string
+		mode        string
+		wantQueries int64
+	}{
+		{name: "Stream", mode: configuration.StreamMode, wantQueries: 0},
+		{name: "Live", mode: configuration.LiveMode, wantQueries: 1},
+		{name: "None", mode: configuration.NoneMode, wantQueries: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, "203.0.113.43")
+			bouncer.crowdsecMode = tt.mode
+			bouncer.crowdsecScheme = "http"
+			bouncer.crowdsecHost = strings.TrimPrefix(lapi.URL, "http://")
+			bouncer.crowdsecPath = "/"
+			bouncer.crowdsecStreamRoute = crowdsecLapiStreamRoute
+			bouncer.crowdsecHeader = crowdsecLapiHeader
+			bouncer.httpClient = lapi.Client()
+			bouncer.updateInterval = 60
+			bouncer.defaultDecisionTimeout = 60
+			if tt.mode == configuration.StreamMode {
+				t.Cleanup(func() { bouncer.cacheClient.Delete(cacheTimeoutKey) })
+				if err := handleStreamCache(bouncer); err != nil {
+					t.Fatal(err)
+				}
+				if value, _ := bouncer.cacheClient.Get("203.0.113.43"); value != cache.BannedValue {
+					t.Errorf("handleStreamCache() cached %q, want %q", value, cache.BannedValue)
+				}
+			}
+			// The second request is answered from the cache in live mode.
+			atomic.StoreInt64(&queries, 0)
+			for i := 0; i < 2; i++ {
+				rw := httptest.NewRecorder()
+				bouncer.ServeHTTP(rw, req)
+				checkBan(t, rw, http.StatusForbidden)
+			}
+			if got := atomic.LoadInt64(&queries); got != tt.wantQueries {
+				t.Errorf("ServeHTTP() queried LAPI %d times, want %d", got, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func Test_decisionValue(t *testing.T) {
+	bouncer := &Bouncer{log: logger.New("INFO", "")}
+	bouncer.remediationPolicies, _ = configuration.GetRemediationPolicies(&configuration.Config{RemediationPolicies: []configuration.Policy{
+		{Scenario: "crowdsecurity/http-crawl-non_statics", Action: "captcha"},
+		{Scope: "country", Action: "bypass"},
+	}})
+	tests := []struct {
+		name     string
+		decision Decision
+		want     string
+		wantOk   bool
+	}{
+		{name: "Ban", decision: Decision{Type: "ban", Scope: "Ip"}, want: cache.BannedValue, wantOk: true},
+		{name: "Captcha", decision: Decision{Type: "captcha", Scope: "Ip"}, want: cache.CaptchaValue, wantOk: true},
+		{name: "Throttle", decision: Decision{Type: "throttle", Scope: "Ip"}, want: cache.ThrottleValue, wantOk: true},
+		{name: "Unknown type", decision: Decision{Type: "custom", Scope: "Ip"}, want: cache.BannedValue, wantOk: true},
+		{name: "Captcha policy", decision: Decision{Type: "ban", Scope: "Ip", Scenario: "crowdsecurity/http-crawl-non_statics"}, want: cache.CaptchaValue, wantOk: true},
+		{name: "Bypass policy", decision: Decision{Type: "ban", Scope: "Country"}, want: "", wantOk: false},
+		{name: "Simulated ban", decision: Decision{Type: "ban", Scope: "Ip", Simulated: true}, want: simulatedPrefix + cache.BannedValue, wantOk: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := decisionValue(bouncer, tt.decision)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("decisionValue() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestServeHTTPDryRun(t *testing.T) {
+	appsec := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusForbidden)
+	}))
+	defer appsec.Close()
+	admin, _ := rules.New("", "/admin", "", nil, "", "", rules.ActionBan, nil)
+	tests := []struct {
+		name         string
+		dryRun       bool
+		remediations []string
+		value        string
+		clientIP     string
+		path         string
+		appsec       bool
+		want         int
+		wantHeader   string
+	}{
+		{name: "Dry run of a ban", dryRun: true, value: cache.BannedValue, want: http.StatusOK, wantHeader: "ban"},
+		{name: "Dry run of a captcha", dryRun: true, value: cache.CaptchaValue, want: http.StatusOK, wantHeader: "captcha"},
+		{name: "Ban enforced with dry run of captchas", dryRun: true, remediations: []string{"captcha"}, value: cache.BannedValue, want: http.StatusForbidden},
+		{name: "Simulated ban", value: simulatedPrefix + cache.BannedValue, want: http.StatusOK, wantHeader: "ban"},
+		{name: "Ban enforced", value: cache.BannedValue, want: http.StatusForbidden},
+		{name: "Dry run of a request rule ban", dryRun: true, value: cache.NoBannedValue, path: "/admin", want: http.StatusOK, wantHeader: "ban"},
+		{name: "Request rule ban enforced", value: cache.NoBannedValue, path: "/admin", want: http.StatusForbidden},
+		{name: "Dry run of the ban of an invalid client IP", dryRun: true, clientIP: "not-an-ip", want: http.StatusOK, wantHeader: "ban"},
+		{name: "Ban of an invalid client IP enforced", clientIP: "not-an-ip", want: http.StatusForbidden},
+		{name: "Dry run of an AppSec block", dryRun: true, value: cache.NoBannedValue, appsec: true, want: http.StatusOK, wantHeader: "ban"},
+		{name: "AppSec block enforced with dry run of captchas", dryRun: true, remediations: []string{"captcha"}, value: cache.NoBannedValue, appsec: true, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientIP := "203.0.113.50"
+			if tt.clientIP != "" {
+				clientIP = tt.clientIP
+			}
+			bouncer, req := newTestBouncer(t, clientIP)
+			bouncer.dryRun = tt.dryRun
+			bouncer.dryRunRemediations = tt.remediations
+			bouncer.dryRunHeader = "X-Crowdsec-Dry-Run"
+			bouncer.requestRules = []*rules.Rule{admin}
+			if tt.appsec {
+				bouncer.appsecEnabled = true
+				bouncer.crowdsecScheme = "http"
+				bouncer.appsecHost = strings.TrimPrefix(appsec.URL, "http://")
+				bouncer.httpClient = appsec.Client()
+			}
+			var gotHeader string
+			bouncer.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				gotHeader = req.Header.Get("X-Crowdsec-Dry-Run")
+				_, _ = rw.Write(testNextBody)
+			})
+			if tt.value != "" {
+				setTestDecision(t, bouncer, clientIP, tt.value)
+			}
+			if tt.path != "" {
+				req.URL.Path = tt.path
+			}
+			req.Header.Set("X-Crowdsec-Dry-Run", "spoofed")
+			dryRun := atomic.LoadInt64(&dryRunRequests)
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			checkBan(t, rw, tt.want)
+			if gotHeader != tt.wantHeader {
+				t.Errorf("ServeHTTP() dry run header = %q, want %q", gotHeader, tt.wantHeader)
+			}
+			wantDryRun := int64(0)
+			if tt.wantHeader != "" {
+				wantDryRun = 1
+			}
+			if got := atomic.LoadInt64(&dryRunRequests) - dryRun; got != wantDryRun {
+				t.Errorf("ServeHTTP() counted %d requests in dry run, want %d", got, wantDryRun)
+			}
+			if tt.wantHeader == "" {
+				return
+			}
+			// The next dry runs of the remediation for this IP are logged at DEBUG level only.
+			key := dryRunKeyPrefix + clientIP + "_" + tt.wantHeader
+			t.Cleanup(func() { bouncer.cacheClient.Delete(key) })
+			if _, err := bouncer.cacheClient.Get(key); err != nil {
+				t.Errorf("ServeHTTP() expected the dry run log of %s to be deduplicated: %v", key, err)
+			}
+		})
+	}
+}
+
+func Test_remediationSeverity(t *testing.T) {
+	ordered := []string{
+		cache.NoBannedValue,
+		simulatedPrefix + cache.ThrottleValue,
+		simulatedPrefix + cache.CaptchaValue,
+		simulatedPrefix + cache.BannedValue,
+		cache.ThrottleValue,
+		cache.CaptchaValue,
+		cache.BannedValue,
+	}
+	for i := 1; i < len(ordered); i++ {
+		if remediationSeverity(ordered[i-1]) >= remediationSeverity(ordered[i]) {
+			t.Errorf("remediationSeverity(%q) >= remediationSeverity(%q)", ordered[i-1], ordered[i])
+		}
+	}
+	if remediationSeverity(banValue(http.StatusTooManyRequests)) != remediationSeverity(cache.BannedValue) {
+		t.Error("remediationSeverity() of a ban with a status code differs from a ban")
+	}
+}
+
+func TestServeHTTPAnnotate(t *testing.T) {
+	tests := []struct {
+		name            string
+		value           string
+		scenario        string
+		captchaPassed   bool
+		want            int
+		wantRemediation string
+		wantHeaders     map[string]string
+	}{
+		{
+			name: "Ban", value: cache.BannedValue, scenario: "crowdsecurity/http-probing", want: http.StatusOK,
+			wantHeaders: map[string]string{annotateRemediationHeader: "ban", annotateScenarioHeader: "crowdsecurity/http-probing", annotateCaptchaPassedHeader: ""},
+		},
+		{
+			name: "Captcha passed", value: cache.CaptchaValue, captchaPassed: true, want: http.StatusOK,
+			wantHeaders: map[string]string{annotateRemediationHeader: "captcha", annotateScenarioHeader: "", annotateCaptchaPassedHeader: "true"},
+		},
+		{
+			name: "Captcha served", value: cache.CaptchaValue, want: http.StatusOK, wantRemediation: "captcha",
+			wantHeaders: map[string]string{annotateRemediationHeader: "", annotateScenarioHeader: "", annotateCaptchaPassedHeader: ""},
+		},
+		{
+			name: "No remediation", value: cache.NoBannedValue, want: http.StatusOK,
+			wantHeaders: map[string]string{annotateRemediationHeader: "", annotateScenarioHeader: "", annotateCaptchaPassedHeader: ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, "203.0.113.60")
+			bouncer.annotate = true
+			if err := bouncer.captchaClient.New(bouncer.log, bouncer.cacheClient, http.DefaultClient, configuration.TurnstileProvider, "", "", "", "", "", "", "", "captcha.html", "en", "", 0, 60); err != nil {
+				t.Fatal(err)
+			}
+			var got http.Header
+			bouncer.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header
+				_, _ = rw.Write(testNextBody)
+			})
+			setTestDecision(t, bouncer, "203.0.113.60", tt.value)
+			if tt.scenario != "" {
+				setDecisionInfo(bouncer, "203.0.113.60", Decision{ID: 7, Scenario: tt.scenario}, 60)
+			}
+			if tt.captchaPassed {
+				setTestDecision(t, bouncer, "203.0.113.60_captcha", cache.CaptchaDoneValue)
+			}
+			for header := range tt.wantHeaders {
+				req.Header.Set(header, "spoofed")
+			}
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			checkResponse(t, rw, tt.want, tt.wantRemediation)
+			if got == nil {
+				// The captcha page was served.
+				return
+			}
+			for header, want := range tt.wantHeaders {
+				if got.Get(header) != want {
+					t.Errorf("ServeHTTP() header %s = %q, want %q", header, got.Get(header), want)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTPRedirect(t *testing.T) {
+	portal, err := redirect.New("https://portal.example.com/denied", "a-secret-long-enough-for-hmac-sha256", http.StatusSeeOther)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		value           string
+		banTemplate     string
+		want            int
+		wantRemediation string
+	}{
+		{name: "Ban without template", value: cache.BannedValue, want: http.StatusSeeOther, wantRemediation: "redirect"},
+		{name: "Ban with template", value: cache.BannedValue, banTemplate: "<html>banned</html>", want: http.StatusForbidden, wantRemediation: "ban"},
+		{name: "Redirect with template", value: cache.RedirectValue, banTemplate: "<html>banned</html>", want: http.StatusSeeOther, wantRemediation: "redirect"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, "203.0.113.70")
+			if tt.banTemplate != "" {
+				bouncer.banPages = newBanPages(t, map[string]string{"": tt.banTemplate})
+			}
+			bouncer.redirect = portal
+			setTestDecision(t, bouncer, "203.0.113.70", tt.value)
+			// TLS is terminated by the trusted proxy.
+			req.Header.Set("X-Forwarded-Proto", "https")
+			setDecisionInfo(bouncer, "203.0.113.70", Decision{ID: 42, Scenario: "crowdsecurity/http-probing"}, 60)
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			if rw.Code != tt.want {
+				t.Fatalf("ServeHTTP() status = %d, want %d", rw.Code, tt.want)
+			}
+			if got := rw.Header().Get(testRemediationHeader); got != tt.wantRemediation {
+				t.Errorf("ServeHTTP() remediation header = %q, want %q", got, tt.wantRemediation)
+			}
+			if rw.Code != http.StatusSeeOther {
+				if rw.Body.String() != tt.banTemplate {
+					t.Errorf("ServeHTTP() body = %q, want %q", rw.Body.String(), tt.banTemplate)
+				}
+				return
+			}
+			location, err := url.Parse(rw.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := location.Query()
+			if query.Get(redirect.ParamIP) != "203.0.113.70" || query.Get(redirect.ParamDecision) != "42" || query.Get(redirect.ParamURL) != "https://localhost/" {
+				t.Errorf("ServeHTTP() Location = %v", location)
+			}
+			if err := redirect.Verify([]byte("a-secret-long-enough-for-hmac-sha256"), query, time.Minute, time.Now()); err != nil {
+				t.Errorf("ServeHTTP() Location %v", err)
+			}
+		})
+	}
+}
+
+func TestServeHTTPCustomScopeDecisionInfo(t *testing.T) {
+	username, _ := scope.Parse("username=header:X-Username", "")
+	portal, err := redirect.New("https://portal.example.com/denied", "a-secret-long-enough-for-hmac-sha256", http.StatusSeeOther)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, annotate := range []bool{true, false} {
+		bouncer, req := newTestBouncer(t, "203.0.113.75")
+		bouncer.customScopes = []*scope.Extractor{username}
+		bouncer.annotate = annotate
+		bouncer.redirect = portal
+		var got http.Header
+		bouncer.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			got = req.Header
+			_, _ = rw.Write(testNextBody)
+		})
+		// The ban of the user wins over the throttle of the IP, the info of its decision is used.
+		setTestDecision(t, bouncer, "203.0.113.75", cache.ThrottleValue)
+		setDecisionInfo(bouncer, "203.0.113.75", Decision{ID: 41, Scenario: "crowdsecurity/http-crawl-non_statics"}, 60)
+		setTestDecision(t, bouncer, "username:eve", cache.BannedValue)
+		setDecisionInfo(bouncer, "username:eve", Decision{ID: 42, Scenario: "crowdsecurity/account-takeover"}, 60)
+		t.Cleanup(func() { bouncer.cacheClient.Delete(decisionInfoPrefix + "username:eve") })
+		req.Header.Set("X-Username", "eve")
+		rw := httptest.NewRecorder()
+		bouncer.ServeHTTP(rw, req)
+		if annotate {
+			checkResponse(t, rw, http.StatusOK, "")
+			if scenario := got.Get(annotateScenarioHeader); scenario != "crowdsecurity/account-takeover" {
+				t.Errorf("ServeHTTP() scenario header = %q, want the one of the custom scope decision", scenario)
+			}
+			continue
+		}
+		location, err := url.Parse(rw.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision := location.Query().Get(redirect.ParamDecision); decision != "42" {
+			t.Errorf("ServeHTTP() redirect decision = %q, want the one of the custom scope decision", decision)
+		}
+	}
+}
+
+func TestServeHTTPTarpit(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxConnections  int64
+		cancel          bool
+		wantMin         time.Duration
+		wantRemediation string
+		wantBody        string
+	}{
+		{name: "Tarpitted", maxConnections: 1, wantMin: 50 * time.Millisecond, wantRemediation: "tarpit", wantBody: "<html>banned</html>"},
+		{name: "Too many tarpitted connections", maxConnections: 0, wantRemediation: "ban", wantBody: "<html>banned</html>"},
+		{name: "Client gone", maxConnections: 1, cancel: true, wantRemediation: "tarpit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, "203.0.113.80")
+			bouncer.banPages = newBanPages(t, map[string]string{"": "<html>banned</html>"})
+			bouncer.tarpitDelay = 50 * time.Millisecond
+			bouncer.tarpitInterval = 10 * time.Millisecond
+			bouncer.tarpitMaxConnections = tt.maxConnections
+			setTestDecision(t, bouncer, "203.0.113.80", cache.TarpitValue)
+			if tt.cancel {
+				ctx, cancel := context.WithCancel(req.Context())
+				cancel()
+				req = req.WithContext(ctx)
+			}
+			rw := httptest.NewRecorder()
+			start := time.Now()
+			bouncer.ServeHTTP(rw, req)
+			elapsed := time.Since(start)
+			if rw.Code != http.StatusForbidden {
+				t.Errorf("ServeHTTP() status = %d, want %d", rw.Code, http.StatusForbidden)
+			}
+			if got := rw.Header().Get(testRemediationHeader); got != tt.wantRemediation {
+				t.Errorf("ServeHTTP() remediation header = %q, want %q", got, tt.wantRemediation)
+			}
+			if elapsed < tt.wantMin || (tt.wantMin == 0 && elapsed > 40*time.Millisecond) {
+				t.Errorf("ServeHTTP() took %v", elapsed)
+			}
+			if strings.TrimLeft(rw.Body.String(), " ") != tt.wantBody {
+				t.Errorf("ServeHTTP() body = %q, want %q", rw.Body.String(), tt.wantBody)
+			}
+			if got := atomic.LoadInt64(&tarpittedConnections); got != 0 {
+				t.Errorf("tarpittedConnections = %d, want 0", got)
+			}
+		})
+	}
+}
+
+func TestServeHTTPThrottle(t *testing.T) {
+	bouncer, req := newTestBouncer(t, "203.0.113.90")
+	// 1 request per minute, bursts of 2 requests.
+	bouncer.throttle = throttle.New(bouncer.cacheClient, 1, 60, 2)
+	setTestDecision(t, bouncer, "203.0.113.90", cache.ThrottleValue)
+	t.Cleanup(func() { bouncer.cacheClient.Delete("throttle:203.0.113.90") })
+	for _, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rw := httptest.NewRecorder()
+		bouncer.ServeHTTP(rw, req)
+		if want == http.StatusOK {
+			checkResponse(t, rw, want, "")
+			continue
+		}
+		checkResponse(t, rw, want, "throttle")
+		if retryAfter, _ := strconv.Atoi(rw.Header().Get("Retry-After")); retryAfter < 1 || retryAfter > 60 {
+			t.Errorf("ServeHTTP() Retry-After = %q", rw.Header().Get("Retry-After"))
+		}
+	}
+
+	// Without valid throttle settings, the throttle decisions are bans.
+	bouncer.throttle = nil
+	rw := httptest.NewRecorder()
+	bouncer.ServeHTTP(rw, req)
+	checkBan(t, rw, http.StatusForbidden)
+}
+
+func TestServeHTTPProtocols(t *testing.T) {
+	tests := []struct {
+		name            string
+		headers         map[string]string
+		value           string
+		want            int
+		wantBody        string
+		wantContentType string
+		wantGRPCStatus  string
+	}{
+		{name: "Browser", value: cache.BannedValue, want: http.StatusForbidden, wantBody: "<html>banned</html>", wantContentType: response.ContentTypeHTML},
+		{name: "gRPC", headers: map[string]string{"Content-Type": "application/grpc+proto"}, value: cache.BannedValue, want: http.StatusOK, wantContentType: "application/grpc+proto", wantGRPCStatus: "7"},
+		{name: "gRPC captcha", headers: map[string]string{"Content-Type": "application/grpc"}, value: cache.CaptchaValue, want: http.StatusOK, wantContentType: "application/grpc", wantGRPCStatus: "7"},
+		{name: "gRPC-Web", headers: map[string]string{"Content-Type": "application/grpc-web+proto"}, value: cache.BannedValue, want: http.StatusOK, wantContentType: "application/grpc-web+proto", wantGRPCStatus: "7"},
+		{name: "gRPC-Web text tarpit", headers: map[string]string{"Content-Type": "application/grpc-web-text"}, value: cache.TarpitValue, want: http.StatusOK, wantContentType: "application/grpc-web-text", wantGRPCStatus: "7"},
+		{name: "gRPC throttle", headers: map[string]string{"Content-Type": "application/grpc"}, value: cache.ThrottleValue, want: http.StatusOK, wantContentType: "application/grpc", wantGRPCStatus: "8"},
+		{name: "WebSocket", headers: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, value: cache.BannedValue, want: http.StatusUnauthorized},
+		{name: "WebSocket throttle", headers: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, value: cache.ThrottleValue, want: http.StatusTooManyRequests},
+		{name: "Event stream", headers: map[string]string{"Accept": "text/event-stream"}, value: cache.BannedValue, want: http.StatusNoContent},
+		{name: "Event stream tarpit", headers: map[string]string{"Accept": "text/event-stream"}, value: cache.TarpitValue, want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, "203.0.113.100")
+			bouncer.banPages = newBanPages(t, map[string]string{"": "<html>banned</html>"})
+			bouncer.grpcStatusCode = 7
+			bouncer.webSocketStatusCode = http.StatusUnauthorized
+			bouncer.sseStatusCode = http.StatusNoContent
+			// The bucket is empty, every throttled request is over the limit.
+			bouncer.throttle = throttle.New(bouncer.cacheClient, 1, 3600, 0)
+			if err := bouncer.captchaClient.New(bouncer.log, bouncer.cacheClient, http.DefaultClient, configuration.TurnstileProvider, "", "", "", "", "", "", "", "captcha.html", "en", "", 0, 60); err != nil {
+				t.Fatal(err)
+			}
+			setTestDecision(t, bouncer, "203.0.113.100", tt.value)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			res := rw.Result()
+			if res.StatusCode != tt.want {
+				t.Errorf("ServeHTTP() status = %d, want %d", res.StatusCode, tt.want)
+			}
+			if rw.Body.String() != tt.wantBody {
+				t.Errorf("ServeHTTP() body = %q, want %q", rw.Body.String(), tt.wantBody)
+			}
+			if got := res.Header.Get("Content-Type"); !strings.HasPrefix(got, tt.wantContentType) || (tt.wantContentType == "" && got != "") {
+				t.Errorf("ServeHTTP() Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			// A trailers-only response, readable by gRPC-Web clients.
+			if got := res.Header.Get("Grpc-Status"); got != tt.wantGRPCStatus {
+				t.Errorf("ServeHTTP() Grpc-Status = %q, want %q", got, tt.wantGRPCStatus)
+			}
+			if len(res.Trailer) != 0 {
+				t.Errorf("ServeHTTP() trailers = %v, want none", res.Trailer)
+			}
+		})
+	}
+}
+
+func TestServeHTTPContentNegotiation(t *testing.T) {
+	tests := []struct {
+		name            string
+		path            string
+		accept          string
+		value           string
+		want            int
+		wantContentType string
+		wantRemediation string
+	}{
+		{name: "Browser ban", path: "/", accept: "text/html", value: cache.BannedValue, want: http.StatusForbidden, wantContentType: response.ContentTypeHTML},
+		{name: "JSON ban", path: "/", accept: "application/json", value: cache.BannedValue, want: http.StatusForbidden, wantContentType: response.ContentTypeProblem, wantRemediation: "ban"},
+		{name: "Text ban", path: "/", accept: "text/plain", value: cache.BannedValue, want: http.StatusForbidden, wantContentType: response.ContentTypeText},
+		{name: "API ban", path: "/api/users", accept: "*/*", value: cache.BannedValue, want: http.StatusForbidden, wantContentType: response.ContentTypeProblem, wantRemediation: "ban"},
+		{name: "API ban with status", path: "/api/users", value: banValue(http.StatusTooManyRequests), want: http.StatusTooManyRequests, wantContentType: response.ContentTypeProblem, wantRemediation: "ban"},
+		{name: "Browser captcha", path: "/", accept: "text/html", value: cache.CaptchaValue, want: http.StatusOK, wantContentType: response.ContentTypeHTML},
+		{name: "API captcha", path: "/api/users", value: cache.CaptchaValue, want: http.StatusForbidden, wantContentType: response.ContentTypeProblem, wantRemediation: "captcha"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, "203.0.113.110")
+			bouncer.banPages = newBanPages(t, map[string]string{"": "<html>banned</html>"})
+			bouncer.apiPathPrefixes = []string{"/api/"}
+			if err := bouncer.captchaClient.New(bouncer.log, bouncer.cacheClient, http.DefaultClient, configuration.TurnstileProvider, "", "", "", "", "", "", "", "captcha.html", "en", "", 0, 60); err != nil {
+				t.Fatal(err)
+			}
+			setTestDecision(t, bouncer, "203.0.113.110", tt.value)
+			req.URL.Path = tt.path
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			res := rw.Result()
+			if res.StatusCode != tt.want {
+				t.Errorf("ServeHTTP() status = %d, want %d", res.StatusCode, tt.want)
+			}
+			if got := res.Header.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("ServeHTTP() Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if tt.wantRemediation == "" {
+				return
+			}
+			var problem struct {
+				Status      int    `json:"status"`
+				Remediation string `json:"remediation"`
+			}
+			if err := json.Unmarshal(rw.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Status != tt.want || problem.Remediation != tt.wantRemediation {
+				t.Errorf("ServeHTTP() body = %s, want the status %d and the remediation %s", rw.Body.String(), tt.want, tt.wantRemediation)
+			}
+		})
+	}
+}
+
+func TestServeHTTPLanguages(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"captcha.html": "captcha", "captcha.fr.html": "captcha fr"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		value          string
+		wantBody       string
+	}{
+		{name: "Default ban page", acceptLanguage: "en-US,en;q=0.9", value: cache.BannedValue, wantBody: "banned"},
+		{name: "Translated ban page", acceptLanguage: "fr-FR,fr;q=0.9,en;q=0.8", value: cache.BannedValue, wantBody: "banni"},
+		{name: "Untranslated ban page", acceptLanguage: "es", value: cache.BannedValue, wantBody: "banned"},
+		{name: "Default captcha page", value: cache.CaptchaValue, wantBody: "captcha"},
+		{name: "Translated captcha page", acceptLanguage: "fr", value: cache.CaptchaValue, wantBody: "captcha fr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, "203.0.113.120")
+			bouncer.banPages = newBanPages(t, map[string]string{"": "banned", "fr": "banni"})
+			bouncer.defaultLanguage = "en"
+			if err := bouncer.captchaClient.New(bouncer.log, bouncer.cacheClient, http.DefaultClient, configuration.TurnstileProvider, "", "", "", "", "", "", "", filepath.Join(dir, "captcha.html"), "en", "", 0, 60); err != nil {
+				t.Fatal(err)
+			}
+			setTestDecision(t, bouncer, "203.0.113.120", tt.value)
+			if tt.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			if rw.Body.String() != tt.wantBody {
+				t.Errorf("ServeHTTP() body = %q, want %q", rw.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestServeHTTPHostOverrides(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"captcha.html": "{{ .SiteKey }}", "shop.html": "shop {{ .SiteKey }}"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provider := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(`{"success":` + strconv.FormatBool(r.FormValue("secret") == "shop-secret") + `}`))
+	}))
+	defer provider.Close()
+	tests := []struct {
+		name     string
+		host     string
+		value    string
+		response string
+		want     int
+		wantBody string
+	}{
+		{name: "Default ban page", host: "www.example.org", value: cache.BannedValue, want: http.StatusForbidden, wantBody: "banned"},
+		{name: "Host ban page", host: "shop.example.com:8443", value: cache.BannedValue, want: http.StatusForbidden, wantBody: "shop banned"},
+		{name: "Host without ban page", host: "blog.example.com", value: cache.BannedValue, want: http.StatusForbidden, wantBody: "banned"},
+		{name: "Default captcha page", host: "www.example.org", value: cache.CaptchaValue, want: http.StatusOK, wantBody: "site-key"},
+		{name: "Host captcha page", host: "SHOP.example.com", value: cache.CaptchaValue, want: http.StatusOK, wantBody: "shop shop-key"},
+		{name: "Host captcha keys", host: "blog.example.com", value: cache.CaptchaValue, want: http.StatusOK, wantBody: "blog-key"},
+		{name: "Host secret key", host: "shop.example.com", value: cache.CaptchaValue, response: "token", want: http.StatusFound},
+		{name: "Default secret key", host: "www.example.org", value: cache.CaptchaValue, response: "token", want: http.StatusOK, wantBody: "site-key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer, req := newTestBouncer(t, "203.0.113.130")
+			bouncer.banPages = newBanPages(t, map[string]string{"": "banned"})
+			bouncer.hostBans = []*hostBan{
+				{host: "shop.example.com", pages: newBanPages(t, map[string]string{"": "shop banned"})},
+				{host: "*.example.com", pages: bouncer.banPages},
+			}
+			if err := bouncer.captchaClient.New(bouncer.log, bouncer.cacheClient, http.DefaultClient, configuration.CustomProvider, "https://captcha.example.com/api.js", "custom-captcha", "custom-response", provider.URL, "site-key", "secret", "", filepath.Join(dir, "captcha.html"), "en", "", 0, 60); err != nil {
+				t.Fatal(err)
+			}
+			if err := bouncer.captchaClient.AddHost("shop.example.com", "shop-key", "shop-secret", filepath.Join(dir, "shop.html")); err != nil {
+				t.Fatal(err)
+			}
+			if err := bouncer.captchaClient.AddHost("*.example.com", "blog-key", "blog-secret", ""); err != nil {
+				t.Fatal(err)
+			}
+			setTestDecision(t, bouncer, "203.0.113.130", tt.value)
+			req.Host = tt.host
+			if tt.response != "" {
+				req.Method = http.MethodPost
+				req.Body = io.NopCloser(strings.NewReader(url.Values{"custom-response": {tt.response}}.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			if rw.Code != tt.want {
+				t.Errorf("ServeHTTP() status = %d, want %d", rw.Code, tt.want)
+			}
+			if tt.wantBody != "" && rw.Body.String() != tt.wantBody {
+				t.Errorf("ServeHTTP() body = %q, want %q", rw.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestServeHTTPSecurityHeaders(t *testing.T) {
+	const noncePage = `<script nonce="{{ .Nonce }}"></script>`
+	// Custom templates written before the nonces, their inline tags are blocked by the default policies.
+	const legacyPage = `<style>body{}</style><script>function captchaCallback(){}</script>`
+	tests := []struct {
+		name          string
+		accept        string
+		value         string
+		page          string
+		banPolicy     string
+		captchaPolicy string
+		wantPolicy    string
+		wantBody      string
+	}{
+		{name: "Ban page", accept: "text/html", value: cache.BannedValue, page: noncePage, wantPolicy: "script-src 'nonce-"},
+		{name: "Captcha page", accept: "text/html", value: cache.CaptchaValue, page: noncePage, wantPolicy: "https://challenges.cloudflare.com"},
+		{name: "Captcha page with policy", accept: "text/html", value: cache.CaptchaValue, page: noncePage, captchaPolicy: "script-src 'nonce-{nonce}' https://captcha.example.com", wantPolicy: "script-src 'nonce-"},
+		{name: "Ban page without nonce", accept: "text/html", value: cache.BannedValue, page: legacyPage, banPolicy: response.NoContentSecurityPolicy, wantBody: legacyPage},
+		{name: "Captcha page without nonce", accept: "text/html", value: cache.CaptchaValue, page: legacyPage, captchaPolicy: response.NoContentSecurityPolicy, wantBody: legacyPage},
+		{name: "Ban page without nonce and default policy", accept: "text/html", value: cache.BannedValue, page: legacyPage, wantBody: legacyPage},
+		{name: "Captcha page without nonce and default policy", accept: "text/html", value: cache.CaptchaValue, page: legacyPage, wantBody: legacyPage},
+		{name: "JSON ban", accept: "application/json", value: cache.BannedValue, page: noncePage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captchaPath := filepath.Join(t.TempDir(), "captcha.html")
+			if err := os.WriteFile(captchaPath, []byte(tt.page), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			bouncer, req := newTestBouncer(t, "203.0.113.140")
+			bouncer.banPages = newBanPages(t, map[string]string{"": tt.page})
+			bouncer.banSecurityPolicy = tt.banPolicy
+			if err := bouncer.captchaClient.New(bouncer.log, bouncer.cacheClient, http.DefaultClient, configuration.TurnstileProvider, "", "", "", "", "", "", "", captchaPath, "en", tt.captchaPolicy, 0, 60); err != nil {
+				t.Fatal(err)
+			}
+			setTestDecision(t, bouncer, "203.0.113.140", tt.value)
+			req.Header.Set("Accept", tt.accept)
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, req)
+			res := rw.Result()
+			if res.Header.Get("Cache-Control") != "no-store" || res.Header.Get("X-Frame-Options") != "DENY" {
+				t.Errorf("ServeHTTP() headers = %v, want the security headers", res.Header)
+			}
+			if tt.wantBody != "" && !strings.Contains(rw.Body.String(), tt.wantBody) {
+				t.Errorf("ServeHTTP() body = %q, want %q", rw.Body.String(), tt.wantBody)
+			}
+			policy := res.Header.Get("Content-Security-Policy")
+			if tt.wantPolicy == "" {
+				if _, ok := res.Header["Content-Security-Policy"]; ok {
+					t.Errorf("ServeHTTP() Content-Security-Policy = %q, want none", policy)
+				}
+				return
+			}
+			if !strings.Contains(policy, tt.wantPolicy) {
+				t.Errorf("ServeHTTP() Content-Security-Policy = %q, want %q", policy, tt.wantPolicy)
+			}
+			_, nonce, _ := strings.Cut(policy, "'nonce-")
+			nonce, _, _ = strings.Cut(nonce, "'")
+			if nonce == "" || !strings.Contains(rw.Body.String(), `nonce="`+nonce+`"`) {
+				t.Errorf("ServeHTTP() body = %q, want the nonce %q of the Content-Security-Policy", rw.Body.String(), nonce)
+			}
+		})
+	}
+}
+
+func TestServeHTTPPowCaptcha(t *testing.T) {
+	bouncer, req := newTestBouncer(t, "203.0.113.150")
+	if err := bouncer.captchaClient.New(bouncer.log, bouncer.cacheClient, http.DefaultClient, configuration.PowProvider, "", "", "", "", "", "0123456789abcdef0123456789abcdef", "", "captcha.html", "en", "", 4, 60); err != nil {
+		t.Fatal(err)
+	}
+	setTestDecision(t, bouncer, "203.0.113.150", cache.CaptchaValue)
+
+	rw := httptest.NewRecorder()
+	bouncer.ServeHTTP(rw, req)
+	_, challenge, _ := strings.Cut(rw.Body.String(), `data-sitekey="`)
+	challenge, _, _ = strings.Cut(challenge, `"`)
+	if rw.Code != http.StatusOK || strings.Count(challenge, ".") != 3 || !strings.Contains(rw.Body.String(), `src="/.crowdsec-bouncer/pow.js"`) {
+		t.Fatalf("ServeHTTP() status = %d, challenge = %q, want the challenge page", rw.Code, challenge)
+	}
+	if policy := rw.Header().Get("Content-Security-Policy"); !strings.Contains(policy, "script-src 'nonce-") || !strings.Contains(policy, "'self'") {
+		t.Errorf("ServeHTTP() Content-Security-Policy = %q, want the script of the provider allowed", policy)
+	}
+
+	// The script is served before the remediation, the format negotiation and the metrics.
+	bouncer.apiPathPrefixes = []string{"/.crowdsec-bouncer/"}
+	blocked := atomic.LoadInt64(&blockedRequests)
+	for _, clientIP := range []string{"203.0.113.150", "198.51.100.7"} {
+		script := req.Clone(req.Context())
+		script.Header.Set("X-Forwarded-For", clientIP+", 10.0.0.1")
+		script.URL.Path = "/.crowdsec-bouncer/pow.js"
+		script.Header.Set("Accept", "application/json")
+		rw = httptest.NewRecorder()
+		bouncer.ServeHTTP(rw, script)
+		if rw.Code != http.StatusOK || !strings.HasPrefix(rw.Header().Get("Content-Type"), "text/javascript") || !strings.Contains(rw.Body.String(), "crowdsec-pow-response") {
+			t.Errorf("ServeHTTP() script of %s status = %d, Content-Type = %q", clientIP, rw.Code, rw.Header().Get("Content-Type"))
+		}
+	}
+	if got := atomic.LoadInt64(&blockedRequests); got != blocked {
+		t.Errorf("ServeHTTP() script counted %d blocked requests", got-blocked)
+	}
+	bouncer.apiPathPrefixes = nil
+
+	solution := ""
+	for counter := 0; solution == ""; counter++ {
+		candidate := challenge + ":" + strconv.Itoa(counter)
+		if digest := sha256.Sum256([]byte(candidate)); digest[0]>>4 == 0 {
+			solution = candidate
+		}
+	}
+	tests := []struct {
+		name     string
+		solution string
+		want     int
+	}{
+		{name: "Invalid solution", solution: challenge + ":x", want: http.StatusOK},
+		{name: "Valid solution", solution: solution, want: http.StatusFound},
+		{name: "Reused solution", solution: solution, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bouncer.cacheClient.Delete("203.0.113.150_captcha")
+			post := req.Clone(req.Context())
+			post.Method = http.MethodPost
+			post.Body = io.NopCloser(strings.NewReader(url.Values{"crowdsec-pow-response": {tt.solution}}.Encode()))
+			post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rw := httptest.NewRecorder()
+			bouncer.ServeHTTP(rw, post)
+			if rw.Code != tt.want {
+				t.Errorf("ServeHTTP() status = %d, want %d", rw.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+// Package bypass implements the authentication of requests allowed to skip remediations:
+// clients presenting a verified TLS certificate matching patterns, or an HMAC-signed token.
+package bypass
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rules allows requests to bypass remediations.
+type Rules struct {
+	subjects    []string
+	sans        []string
+	issuers     []string
+	tokenHeader string
+	tokenSecret []byte
+}
+
+// New creates Rules. Certificates must match a pattern of each non empty list of patterns,
+// patterns are case insensitive and * matches any sequence of characters.
+// Tokens are read from tokenHeader and verified with tokenSecret, they are disabled if the secret is empty.
+func New(subjects, sans, issuers []string, tokenHeader, tokenSecret string) *Rules {
+	rules := &Rules{
+		subjects:    subjects,
+		sans:        sans,
+		issuers:     issuers,
+		tokenHeader: http.CanonicalHeaderKey(tokenHeader),
+	}
+	if tokenSecret != "" {
+		rules.tokenSecret = []byte(tokenSecret)
+	}
+	return rules
+}
+
+// TakeToken returns the bypass token of a request and removes it from the headers,
+// so that it is never forwarded to the service.
+func (r *Rules) TakeToken(req *http.Request) string {
+	if r.tokenSecret == nil {
+		return ""
+	}
+	token := req.Header.Get(r.tokenHeader)
+	if token != "" {
+		req.Header.Del(r.tokenHeader)
+	}
+	return token
+}
+
+// Match returns who is authenticated (ex: certificate:CN=probe or token:monitoring) if the request
+// presents a matching certificate or a valid token, see TakeToken.
+func (r *Rules) Match(req *http.Request, token string) (string, bool) {
+	if len(r.subjects)+len(r.sans)+len(r.issuers) > 0 && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		// Only certificates verified by Traefik are trusted (clientAuth VerifyClientCertIfGiven or RequireAndVerifyClientCert).
+		certificate := req.TLS.VerifiedChains[0][0]
+		if r.matchCertificate(certificate) {
+			return "certificate:" + certificate.Subject.String(), true
+		}
+	}
+	if token != "" && r.tokenSecret != nil {
+		name, err := Verify(r.tokenSecret, token, time.Now())
+		if err == nil {
+			return "token:" + name, true
+		}
+	}
+	return "", false
+}
+
+func (r *Rules) matchCertificate(certificate *x509.Certificate) bool {
+	if len(r.subjects) > 0 && !matchAny(r.subjects, certificate.Subject.CommonName, certificate.Subject.String()) {
+		return false
+	}
+	if len(r.issuers) > 0 && !matchAny(r.issuers, certificate.Issuer.CommonName, certificate.Issuer.String()) {
+		return false
+	}
+	if len(r.sans) > 0 {
+		sans := append([]string{}, certificate.DNSNames...)
+		sans = append(sans, certificate.EmailAddresses...)
+		for _, uri := range certificate.URIs {
+			sans = append(sans, uri.String())
+		}
+		for _, ip := range certificate.IPAddresses {
+			sans = append(sans, ip.String())
+		}
+		if !matchAny(r.sans, sans...) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if MatchGlob(pattern, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchGlob checks a value against a case insensitive pattern where * matches any sequence of characters.
+func MatchGlob(pattern, value string) bool {
+	pattern, value = strings.ToLower(pattern), strings.ToLower(value)
+	star, next := -1, 0
+	p, v := 0, 0
+	for v < len(value) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, v
+			p++
+		case p < len(pattern) && pattern[p] == value[v]:
+			p++
+			v++
+		case star >= 0:
+			// Backtrack: the last star absorbs one more character.
+			next++
+			p, v = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// TOKENS
+
+// Sign returns a bypass token <name>.<expiry>.<signature> valid until expiry,
+// the name identifies its holder in the logs and cannot contain dots.
+func Sign(secret, name string, expiry time.Time) string {
+	payload := name + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + signature([]byte(secret), payload)
+}
+
+// Verify checks the signature and the expiry of a bypass token and returns its name.
+func Verify(secret []byte, token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] == "" {
+		return "", errors.New("bypass:Verify token must be <name>.<expiry>.<signature>")
+	}
+	expected := signature(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return "", errors.New("bypass:Verify invalid signature")
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("bypass:Verify parse expiry %w", err)
+	}
+	if now.Unix() >= expiry {
+		return "", errors.New("bypass:Verify token expired")
+	}
+	return parts[0], nil
+}
+
+func signature(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,119 @@
+package bypass
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		{pattern: "probe", value: "probe", want: true},
+		{pattern: "probe", value: "Probe", want: true},
+		{pattern: "*.internal.example.com", value: "a.internal.example.com", want: true},
+		{pattern: "*.internal.example.com", value: "internal.example.com", want: false},
+		{pattern: "spiffe://example.com/*", value: "spiffe://example.com/ns/monitoring/sa/probe", want: true},
+		{pattern: "*probe*", value: "CN=probe-1,O=Example", want: true},
+		{pattern: "a*b*c", value: "aXbYbZc", want: true},
+		{pattern: "a*b*c", value: "aXbYbZ", want: false},
+		{pattern: "*", value: "", want: true},
+		{pattern: "", value: "a", want: false},
+	}
+	for _, tt := range tests {
+		if got := MatchGlob(tt.pattern, tt.value); got != tt.want {
+			t.Errorf("MatchGlob(%q, %q) = %v, want %v", tt.pattern, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	valid := Sign("secret", "monitoring", now.Add(time.Hour))
+	tests := []struct {
+		name    string
+		token   string
+		want    string
+		wantErr bool
+	}{
+		{name: "Valid token", token: valid, want: "monitoring"},
+		{name: "Expired token", token: Sign("secret", "monitoring", now.Add(-time.Second)), wantErr: true},
+		{name: "Other secret", token: Sign("other", "monitoring", now.Add(time.Hour)), wantErr: true},
+		{name: "Tampered name", token: "admin" + valid[len("monitoring"):], wantErr: true},
+		{name: "Malformed token", token: "monitoring", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Verify([]byte("secret"), tt.token, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRules_Match(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/ns/monitoring/sa/probe")
+	probe := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "probe", Organization: []string{"Example"}},
+		Issuer:   pkix.Name{CommonName: "Internal CA"},
+		DNSNames: []string{"probe.internal.example.com"},
+		URIs:     []*url.URL{spiffe},
+	}
+	token := Sign("secret", "uptime", time.Now().Add(time.Hour))
+	tests := []struct {
+		name     string
+		rules    *Rules
+		verified bool
+		token    string
+		want     string
+		wantOk   bool
+	}{
+		{name: "Subject", rules: New([]string{"probe"}, nil, nil, "", ""), verified: true, want: "certificate:CN=probe,O=Example", wantOk: true},
+		{name: "Subject and issuer", rules: New([]string{"probe"}, nil, []string{"Internal CA"}, "", ""), verified: true, want: "certificate:CN=probe,O=Example", wantOk: true},
+		{name: "Other issuer", rules: New([]string{"probe"}, nil, []string{"Public CA"}, "", ""), verified: true},
+		{name: "SAN DNS", rules: New(nil, []string{"*.internal.example.com"}, nil, "", ""), verified: true, want: "certificate:CN=probe,O=Example", wantOk: true},
+		{name: "SAN URI", rules: New(nil, []string{"spiffe://example.com/ns/monitoring/*"}, nil, "", ""), verified: true, want: "certificate:CN=probe,O=Example", wantOk: true},
+		{name: "Unverified certificate", rules: New([]string{"probe"}, nil, nil, "", ""), verified: false},
+		{name: "Token", rules: New(nil, nil, nil, "X-Bypass", "secret"), token: token, want: "token:uptime", wantOk: true},
+		{name: "Invalid token", rules: New(nil, nil, nil, "X-Bypass", "secret"), token: token + "x"},
+		{name: "Token disabled without secret", rules: New(nil, nil, nil, "X-Bypass", ""), token: token},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "https://localhost/", nil)
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{probe}}
+			if tt.verified {
+				req.TLS.VerifiedChains = [][]*x509.Certificate{{probe}}
+			}
+			req.Header.Set("X-Bypass", tt.token)
+			got, ok := tt.rules.Match(req, tt.rules.TakeToken(req))
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Match() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestRules_TakeToken(t *testing.T) {
+	rules := New(nil, nil, nil, "x-bypass", "secret")
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("X-Bypass", "token")
+	if got := rules.TakeToken(req); got != "token" {
+		t.Errorf("TakeToken() = %v, want token", got)
+	}
+	if req.Header.Get("X-Bypass") != "" {
+		t.Error("TakeToken() did not remove the header")
+	}
+}
@@ -21,6 +21,12 @@ const (
 	CaptchaValue = "c"
 	// CaptchaDoneValue Captcha done string.
 	CaptchaDoneValue = "d"
+	// RedirectValue Redirect to the portal string.
+	RedirectValue = "r"
+	// TarpitValue Tarpit string.
+	TarpitValue = "p"
+	// ThrottleValue Throttle string.
+	ThrottleValue = "h"
 	// CacheMiss error string when cache is miss.
 	CacheMiss = "cache:miss"
 	// CacheUnreachable error string when cache is unreachable.
@@ -31,6 +37,9 @@ const (
 var (
 	redis simpleredis.SimpleRedis
 	cache = ttl_map.New()
+	// Errors are allocated once as a miss is the most common answer on the request path.
+	errCacheMiss        = errors.New(CacheMiss)
+	errCacheUnreachable = errors.New(CacheUnreachable)
 )
 
 type localCache struct{}
@@ -41,7 +50,7 @@ func (localCache) get(key string) (string, error) {
 	if isCached && isValid && len(valueString) > 0 {
 		return valueString, nil
 	}
-	return "", errors.New(CacheMiss)
+	return "", errCacheMiss
 }
 
 func (localCache) set(key, value string, duration int64) {
@@ -64,10 +73,10 @@ func (redisCache) get(key string) (string, error) {
 	}
 	errRedisMessage := err.Error()
 	if errRedisMessage == simpleredis.RedisMiss {
-		return "", errors.New(CacheMiss)
+		return "", errCacheMiss
 	}
 	if errRedisMessage == simpleredis.RedisUnreachable {
-		return "", errors.New(CacheUnreachable)
+		return "", errCacheUnreachable
 	}
 	return "", err
 }
@@ -97,32 +106,41 @@ type Client struct {
 }
 
 // New Initialize cache client.
-func (c *Client) New(log *logger.Log, isRedis bool, host, pass, database string) {
+func (c *Client) New(log *logger.Log, isRedis, isFile bool, host, pass, database, filePath string) {
 	c.log = log
-	if isRedis {
+	switch {
+	case isRedis:
 		redis.Init(host, pass, database)
 		c.cache = &redisCache{log: log}
-	} else {
+	case isFile:
+		c.cache = getFileCache(log, filePath)
+	default:
 		c.cache = &localCache{}
 	}
-	c.log.Debug(fmt.Sprintf("cache:New initialized isRedis:%v", isRedis))
+	c.log.Debug(fmt.Sprintf("cache:New initialized isRedis:%v isFile:%v", isRedis, isFile))
 }
 
 // Delete delete decision in cache.
 func (c *Client) Delete(key string) {
-	c.log.Debug(fmt.Sprintf("cache:Delete key:%v", key))
+	if c.log.DebugEnabled() {
+		c.log.Debug(fmt.Sprintf("cache:Delete key:%v", key))
+	}
 	c.cache.delete(key)
 }
 
 // Get check in the cache if the IP has the banned / not banned value.
 // Otherwise return with an error to add the IP in cache if we are on.
 func (c *Client) Get(key string) (string, error) {
-	c.log.Debug(fmt.Sprintf("cache:Get key:%v", key))
+	if c.log.DebugEnabled() {
+		c.log.Debug(fmt.Sprintf("cache:Get key:%v", key))
+	}
 	return c.cache.get(key)
 }
 
 // Set update the cache with the IP as key and the value banned / not banned.
 func (c *Client) Set(key string, value string, duration int64) {
-	c.log.Debug(fmt.Sprintf("cache:Set key:%v value:%v duration:%vs", key, value, duration))
+	if c.log.DebugEnabled() {
+		c.log.Debug(fmt.Sprintf("cache:Set key:%v value:%v duration:%vs", key, value, duration))
+	}
 	c.cache.set(key, value, duration)
 }
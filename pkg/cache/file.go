@@ -0,0 +1,348 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+)
+
+const (
+	fileOpSet             = "set"
+	fileOpDelete          = "del"
+	fileLockSuffix        = ".lock"
+	fileStaleSuffix       = ".stale"
+	fileCompactSuffix     = ".compact"
+	fileLockRetryInterval = 5 * time.Millisecond
+	fileLockTimeout       = 2 * time.Second
+	// A lock older than this is considered left behind by a dead process.
+	fileLockStaleAfter = 10 * time.Second
+	// The lines appended by the other processes are looked for at most this often when reading.
+	fileReplayInterval = time.Second
+	// Compaction happens once the log holds this many more lines than live entries.
+	fileCompactThreshold = 10000
+)
+
+//nolint:gochecknoglobals
+var (
+	fileCachesMu sync.Mutex
+	fileCaches   = map[string]*fileCache{}
+)
+
+type fileEntry struct {
+	value  string
+	expiry int64
+}
+
+// fileCache is an append-only log shared between processes of the same host.
+// Every process replays the lines appended by the others before reading, and
+// writes are serialized with a lock file so that compaction is safe.
+// The lock file holds the token of its owner: a process only removes its own lock,
+// and gives up a write or a compaction when its lock was taken over.
+type fileCache struct {
+	mu             sync.Mutex
+	path           string
+	lockPath       string
+	token          string
+	log            *logger.Log
+	entries        map[string]fileEntry
+	info           os.FileInfo
+	offset         int64
+	lines          int
+	replayInterval time.Duration
+	replayed       time.Time
+}
+
+// getFileCache returns the file cache of the path, shared by every middleware of the process.
+func getFileCache(log *logger.Log, path string) *fileCache {
+	path = filepath.Clean(path)
+	fileCachesMu.Lock()
+	defer fileCachesMu.Unlock()
+	if fc, ok := fileCaches[path]; ok {
+		return fc
+	}
+	fc := newFileCache(log, path)
+	fc.replayInterval = fileReplayInterval
+	fileCaches[path] = fc
+	return fc
+}
+
+func newFileCache(log *logger.Log, path string) *fileCache {
+	random := make([]byte, 8)
+	_, _ = rand.Read(random)
+	return &fileCache{
+		path:     path,
+		lockPath: path + fileLockSuffix,
+		token:    strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(random),
+		log:      log,
+		entries:  map[string]fileEntry{},
+	}
+}
+
+func (fc *fileCache) get(key string) (string, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	// The file is not checked on every read, the writes of the other processes are seen within the interval.
+	if now := time.Now(); now.Sub(fc.replayed) >= fc.replayInterval {
+		if err := fc.replay(); err != nil {
+			fc.log.Error("cache:getDecisionFileCache " + err.Error())
+			return "", errCacheUnreachable
+		}
+		fc.replayed = now
+	}
+	entry, ok := fc.entries[key]
+	if !ok || len(entry.value) == 0 {
+		return "", errCacheMiss
+	}
+	if entry.expiry >= 0 && entry.expiry <= time.Now().Unix() {
+		delete(fc.entries, key)
+		return "", errCacheMiss
+	}
+	return entry.value, nil
+}
+
+func (fc *fileCache) set(key, value string, duration int64) {
+	// Same semantics as the memory cache: 0 is a no-op, negative never expires.
+	if duration == 0 {
+		return
+	}
+	expiry := int64(-1)
+	if duration > 0 {
+		expiry = time.Now().Unix() + duration
+	}
+	line := fileOpSet + "\t" + strconv.FormatInt(expiry, 10) + "\t" + strconv.Quote(key) + "\t" + strconv.Quote(value) + "\n"
+	if err := fc.write(line); err != nil {
+		fc.log.Error("cache:setDecisionFileCache " + err.Error())
+	}
+}
+
+func (fc *fileCache) delete(key string) {
+	if err := fc.write(fileOpDelete + "\t" + strconv.Quote(key) + "\n"); err != nil {
+		fc.log.Error("cache:deleteDecisionFileCache " + err.Error())
+	}
+}
+
+func (fc *fileCache) write(line string) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := fc.lock(); err != nil {
+		return err
+	}
+	defer fc.unlock()
+
+	if err := fc.checkLock(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(fc.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("write:open %w", err)
+	}
+	_, err = file.WriteString(line)
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return fmt.Errorf("write:append %w", err)
+	}
+	// Replaying also applies our own line, keeping the offset in sync with the file.
+	if err = fc.replay(); err != nil {
+		return err
+	}
+	fc.replayed = time.Now()
+	if fc.lines-len(fc.entries) > fileCompactThreshold {
+		if err = fc.checkLock(); err != nil {
+			return err
+		}
+		return fc.compact()
+	}
+	return nil
+}
+
+// replay reads the lines appended since the last call.
+// If the file was replaced by a compaction, it is read again from the start.
+func (fc *fileCache) replay() error {
+	info, err := os.Stat(fc.path)
+	if errors.Is(err, os.ErrNotExist) {
+		fc.reset(nil)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("replay:stat %w", err)
+	}
+	if fc.info == nil || !os.SameFile(fc.info, info) || info.Size() < fc.offset {
+		fc.reset(info)
+	}
+	if info.Size() == fc.offset {
+		return nil
+	}
+
+	file, err := os.Open(fc.path)
+	if err != nil {
+		return fmt.Errorf("replay:open %w", err)
+	}
+	defer func() {
+		if err = file.Close(); err != nil {
+			fc.log.Error("cache:replay:close " + err.Error())
+		}
+	}()
+	if _, err = file.Seek(fc.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("replay:seek %w", err)
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, errRead := reader.ReadBytes('\n')
+		// An unterminated line is still being written by another process, it will be read next time.
+		if errRead != nil {
+			break
+		}
+		fc.offset += int64(len(line))
+		fc.lines++
+		fc.apply(line[:len(line)-1])
+	}
+	return nil
+}
+
+func (fc *fileCache) reset(info os.FileInfo) {
+	fc.info = info
+	fc.offset = 0
+	fc.lines = 0
+	fc.entries = map[string]fileEntry{}
+}
+
+func (fc *fileCache) apply(line []byte) {
+	fields := bytes.Split(line, []byte("\t"))
+	switch {
+	case len(fields) == 4 && string(fields[0]) == fileOpSet:
+		expiry, err := strconv.ParseInt(string(fields[1]), 10, 64)
+		if err != nil {
+			return
+		}
+		key, errKey := strconv.Unquote(string(fields[2]))
+		value, errValue := strconv.Unquote(string(fields[3]))
+		if errKey != nil || errValue != nil {
+			return
+		}
+		fc.entries[key] = fileEntry{value: value, expiry: expiry}
+	case len(fields) == 2 && string(fields[0]) == fileOpDelete:
+		key, err := strconv.Unquote(string(fields[1]))
+		if err != nil {
+			return
+		}
+		delete(fc.entries, key)
+	default:
+		fc.log.Debug("cache:replay invalid line ignored")
+	}
+}
+
+// compact rewrites the live entries in a new file and atomically replaces the log.
+// It must be called with the lock file held.
+func (fc *fileCache) compact() error {
+	now := time.Now().Unix()
+	var buf bytes.Buffer
+	for key, entry := range fc.entries {
+		if entry.expiry >= 0 && entry.expiry <= now {
+			continue
+		}
+		buf.WriteString(fileOpSet + "\t" + strconv.FormatInt(entry.expiry, 10) + "\t" + strconv.Quote(key) + "\t" + strconv.Quote(entry.value) + "\n")
+	}
+	tmpPath := fc.path + fileCompactSuffix
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("compact:write %w", err)
+	}
+	if err := os.Rename(tmpPath, fc.path); err != nil {
+		return fmt.Errorf("compact:rename %w", err)
+	}
+	fc.log.Debug(fmt.Sprintf("cache:compact path:%s lines:%d entries:%d", fc.path, fc.lines, len(fc.entries)))
+	fc.reset(nil)
+	return fc.replay()
+}
+
+// lock acquires the lock file shared by every process using the cache, writing the token of the cache in it.
+func (fc *fileCache) lock() error {
+	deadline := time.Now().Add(fileLockTimeout)
+	for {
+		file, err := os.OpenFile(fc.lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = file.WriteString(fc.token)
+			if errClose := file.Close(); err == nil {
+				err = errClose
+			}
+			if err != nil {
+				_ = os.Remove(fc.lockPath)
+				return fmt.Errorf("lock:write %w", err)
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("lock:create %w", err)
+		}
+		if info, errStat := os.Stat(fc.lockPath); errStat == nil && time.Since(info.ModTime()) > fileLockStaleAfter {
+			if owner, errRead := os.ReadFile(fc.lockPath); errRead == nil && fc.takeOver(string(owner)) {
+				// The lock is created again with O_EXCL, a process creating it meanwhile gets it.
+				continue
+			}
+		}
+		if time.Now().After(deadline) {
+			return errors.New("lock:timeout " + fc.lockPath)
+		}
+		time.Sleep(fileLockRetryInterval)
+	}
+}
+
+// takeOver removes the stale lock of owner. The lock is moved away atomically, so that only one process
+// takes it over. A lock released and taken again meanwhile is not given back, its owner finds out
+// with checkLock before writing.
+func (fc *fileCache) takeOver(owner string) bool {
+	stalePath := fc.lockPath + "." + fc.token + fileStaleSuffix
+	if err := os.Rename(fc.lockPath, stalePath); err != nil {
+		return false
+	}
+	moved, err := os.ReadFile(stalePath)
+	if err == nil && string(moved) == owner {
+		fc.log.Info("cache:lock removing stale lock " + fc.lockPath)
+	} else {
+		fc.log.Info("cache:lock removing lock renewed meanwhile " + fc.lockPath)
+	}
+	if err = os.Remove(stalePath); err != nil {
+		fc.log.Error("cache:lock " + err.Error())
+	}
+	return true
+}
+
+// checkLock reads the token of the lock file back, it fails when the lock was taken over.
+func (fc *fileCache) checkLock() error {
+	owner, err := os.ReadFile(fc.lockPath)
+	if err != nil {
+		return fmt.Errorf("checkLock:read %w", err)
+	}
+	if string(owner) != fc.token {
+		return errors.New("checkLock:lock taken over " + fc.lockPath)
+	}
+	return nil
+}
+
+// unlock removes the lock file if it is still ours.
+func (fc *fileCache) unlock() {
+	owner, err := os.ReadFile(fc.lockPath)
+	if err != nil {
+		fc.log.Error("cache:unlock " + err.Error())
+		return
+	}
+	if string(owner) != fc.token {
+		fc.log.Error("cache:unlock lock taken over " + fc.lockPath)
+		return
+	}
+	if err = os.Remove(fc.lockPath); err != nil {
+		fc.log.Error("cache:unlock " + err.Error())
+	}
+}
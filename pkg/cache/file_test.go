@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+)
+
+// newTestFileCache returns a cache not registered in the process registry,
+// so that two of them on the same path behave like two processes.
+func newTestFileCache(path string) *fileCache {
+	return newFileCache(logger.New("INFO", ""), path)
+}
+
+func Test_fileCacheShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	first := &Client{cache: newTestFileCache(path), log: logger.New("INFO", "")}
+	second := &Client{cache: newTestFileCache(path), log: logger.New("INFO", "")}
+
+	first.Set("10.0.0.10", BannedValue, 10)
+	first.Set("10.0.0.11", CaptchaValue, 0)
+	second.Set("10.0.0.12", NoBannedValue, -1)
+	second.Delete("10.0.0.10")
+
+	tests := []struct {
+		name     string
+		client   *Client
+		key      string
+		want     string
+		valueErr string
+	}{
+		{name: "Deleted by another process", client: first, key: "10.0.0.10", want: "", valueErr: CacheMiss},
+		{name: "Not stored for 0 sec", client: second, key: "10.0.0.11", want: "", valueErr: CacheMiss},
+		{name: "Stored forever by another process", client: first, key: "10.0.0.12", want: NoBannedValue, valueErr: ""},
+		{name: "Stored forever by the same process", client: second, key: "10.0.0.12", want: NoBannedValue, valueErr: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.client.Get(tt.key)
+			if got != tt.want {
+				t.Errorf("Get() = %v, want %v", got, tt.want)
+				return
+			}
+			if tt.valueErr != "" && (err == nil || tt.valueErr != err.Error()) {
+				t.Errorf("Get() err = %v, want %v", err, tt.valueErr)
+			}
+		})
+	}
+}
+
+func Test_fileCacheCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	writer := newTestFileCache(path)
+	reader := newTestFileCache(path)
+
+	reader.set("kept", BannedValue, 60)
+	// The last write makes the log exceed the live entries by more than the threshold.
+	last := fileCompactThreshold + 1
+	for i := 0; i <= last; i++ {
+		writer.set("churn", strconv.Itoa(i), 60)
+	}
+	if writer.lines != len(writer.entries) {
+		t.Fatalf("compact() lines = %d, want %d", writer.lines, len(writer.entries))
+	}
+	if _, err := os.Stat(path + fileLockSuffix); !os.IsNotExist(err) {
+		t.Errorf("compact() lock file still present: %v", err)
+	}
+	for key, want := range map[string]string{"kept": BannedValue, "churn": strconv.Itoa(last)} {
+		if got, err := reader.get(key); got != want {
+			t.Errorf("get(%s) after compact = %v %v, want %v", key, got, err, want)
+		}
+	}
+}
+
+func Test_fileCacheStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	fc := newTestFileCache(path)
+	if err := os.WriteFile(fc.lockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := fileLockStaleAfter * -2
+	if err := os.Chtimes(fc.lockPath, time.Now().Add(old), time.Now().Add(old)); err != nil {
+		t.Fatal(err)
+	}
+	fc.set("10.0.0.10", BannedValue, 10)
+	if got, _ := fc.get("10.0.0.10"); got != BannedValue {
+		t.Errorf("get() with stale lock = %v, want %v", got, BannedValue)
+	}
+}
+
+func Test_fileCacheLockOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	first := newTestFileCache(path)
+	second := newTestFileCache(path)
+	if err := first.lock(); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(fileLockStaleAfter * -2)
+	if err := os.Chtimes(first.lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	// The stale lock of the first cache is taken over, its unlock leaves the lock of the second one.
+	if err := second.lock(); err != nil {
+		t.Fatal(err)
+	}
+	first.unlock()
+	if owner, _ := os.ReadFile(path + fileLockSuffix); string(owner) != second.token {
+		t.Errorf("unlock() lock owner = %q, want %q", owner, second.token)
+	}
+	if err := first.checkLock(); err == nil {
+		t.Errorf("checkLock() of a lock taken over = nil, want an error")
+	}
+	// A lock renewed meanwhile is moved away and not given back: a third cache creating the lock gets it,
+	// and its former owner gives up writing instead of writing along with the new one.
+	if !first.takeOver(first.token) {
+		t.Fatal("takeOver() failed")
+	}
+	third := newTestFileCache(path)
+	if err := third.lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.checkLock(); err == nil {
+		t.Errorf("checkLock() of a lock taken over = nil, want an error")
+	}
+	if err := third.checkLock(); err != nil {
+		t.Errorf("checkLock() = %v", err)
+	}
+	second.unlock()
+	if owner, _ := os.ReadFile(path + fileLockSuffix); string(owner) != third.token {
+		t.Errorf("unlock() lock owner = %q, want %q", owner, third.token)
+	}
+	third.unlock()
+	if _, err := os.Stat(path + fileLockSuffix); !os.IsNotExist(err) {
+		t.Errorf("unlock() lock file still present: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), fileStaleSuffix) {
+			t.Errorf("takeOver() left %s", entry.Name())
+		}
+	}
+}
+
+func Test_fileCacheReplayInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	writer := newTestFileCache(path)
+	reader := newTestFileCache(path)
+	reader.replayInterval = time.Hour
+	if _, err := reader.get("10.0.0.10"); err == nil {
+		t.Fatal("get() found a missing key")
+	}
+	writer.set("10.0.0.10", BannedValue, 10)
+	if got, _ := reader.get("10.0.0.10"); got != "" {
+		t.Errorf("get() within the replay interval = %v, want the file not checked", got)
+	}
+	reader.replayed = time.Time{}
+	if got, _ := reader.get("10.0.0.10"); got != BannedValue {
+		t.Errorf("get() after the replay interval = %v, want %v", got, BannedValue)
+	}
+}
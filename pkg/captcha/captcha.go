@@ -4,36 +4,51 @@ package captcha
 import (
 	"encoding/json"
 	"fmt"
-	"html/template"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	cache "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/cache"
 	configuration "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/configuration"
 	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+	response "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/response"
+	rules "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/rules"
 )
 
 // Client Captcha client.
 type Client struct {
 	Valid                   bool
-	siteKey                 string
-	secretKey               string
+	site                    *site
+	hosts                   []*site
 	remediationCustomHeader string
 	gracePeriodSeconds      int64
-	captchaTemplate         *template.Template
+	defaultLanguage         string
+	contentSecurityPolicy   string
+	defaultSecurityPolicy   string
+	pow                     bool
+	powDifficulty           int
 	cacheClient             *cache.Client
 	httpClient              *http.Client
 	log                     *logger.Log
 	infoProvider            *infoProvider
 }
 
+// Keys and templates of the captcha, for the requests to the hosts matching a glob.
+type site struct {
+	host      string
+	siteKey   string
+	secretKey string
+	pages     *response.Pages
+}
+
 // Information for self-hosted provider.
 type infoProvider struct {
 	js       string
 	key      string
 	response string
 	validate string
+	sources  string
 }
 
 //nolint:gochecknoglobals
@@ -43,23 +58,32 @@ var infoProviders = map[string]*infoProvider{
 		key:      "h-captcha",
 		response: "h-captcha-response",
 		validate: "https://api.hcaptcha.com/siteverify",
+		sources:  "https://hcaptcha.com https://*.hcaptcha.com",
 	},
 	configuration.RecaptchaProvider: {
 		js:       "https://www.google.com/recaptcha/api.js",
 		key:      "g-recaptcha",
 		response: "g-recaptcha-response",
 		validate: "https://www.google.com/recaptcha/api/siteverify",
+		sources:  "https://www.google.com/recaptcha/ https://www.gstatic.com/recaptcha/ https://recaptcha.google.com/recaptcha/",
 	},
 	configuration.TurnstileProvider: {
 		js:       "https://challenges.cloudflare.com/turnstile/v0/api.js",
 		key:      "cf-turnstile",
 		response: "cf-turnstile-response",
 		validate: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		sources:  "https://challenges.cloudflare.com",
+	},
+	configuration.PowProvider: {
+		js:       powScriptPath,
+		key:      powKey,
+		response: powResponse,
+		sources:  "'self'",
 	},
 }
 
 // New Initialize captcha client.
-func (c *Client) New(log *logger.Log, cacheClient *cache.Client, httpClient *http.Client, provider, js, key, response, validate, siteKey, secretKey, remediationCustomHeader, captchaTemplatePath string, gracePeriodSeconds int64) error {
+func (c *Client) New(log *logger.Log, cacheClient *cache.Client, httpClient *http.Client, provider, js, key, response, validate, siteKey, secretKey, remediationCustomHeader, captchaTemplatePath, defaultLanguage, contentSecurityPolicy string, powDifficulty int, gracePeriodSeconds int64) error {
 	c.Valid = provider != ""
 	if !c.Valid {
 		return nil
@@ -67,22 +91,105 @@ func (c *Client) New(log *logger.Log, cacheClient *cache.Client, httpClient *htt
 	var info *infoProvider
 	if provider == configuration.CustomProvider {
 		info = &infoProvider{js: js, key: key, response: response, validate: validate}
+		// The custom provider is trusted on the origin of its script.
+		if jsURL, err := url.Parse(js); err == nil {
+			info.sources = jsURL.Scheme + "://" + jsURL.Host
+		}
 	} else {
 		info = infoProviders[provider]
 	}
 	c.infoProvider = info
-	c.siteKey = siteKey
-	c.secretKey = secretKey
+	c.pow = provider == configuration.PowProvider
+	c.powDifficulty = powDifficulty
+	c.site = &site{siteKey: siteKey, secretKey: secretKey}
+	if err := c.site.setTemplates(captchaTemplatePath); err != nil {
+		return err
+	}
+	c.hosts = nil
 	c.remediationCustomHeader = remediationCustomHeader
-	html, _ := configuration.GetHTMLTemplate(captchaTemplatePath)
-	c.captchaTemplate = html
+	c.defaultLanguage = defaultLanguage
+	c.contentSecurityPolicy = contentSecurityPolicy
+	c.defaultSecurityPolicy = defaultContentSecurityPolicy(info.sources)
 	c.gracePeriodSeconds = gracePeriodSeconds
 	c.log = log
 	c.httpClient = httpClient
 	c.cacheClient = cacheClient
+	c.warnMissingNonce(captchaTemplatePath, c.site.pages)
 	return nil
 }
 
+// AddHost overrides the keys and the template of the captcha for the requests to the hosts matching a glob,
+// the empty values are the ones of the client. Hosts are evaluated in the order they are added.
+func (c *Client) AddHost(host, siteKey, secretKey, captchaTemplatePath string) error {
+	hostSite := &site{
+		host:      host,
+		siteKey:   c.site.siteKey,
+		secretKey: c.site.secretKey,
+		pages:     c.site.pages,
+	}
+	if siteKey != "" || secretKey != "" {
+		hostSite.siteKey = siteKey
+		hostSite.secretKey = secretKey
+	}
+	if captchaTemplatePath != "" {
+		if err := hostSite.setTemplates(captchaTemplatePath); err != nil {
+			return err
+		}
+		c.warnMissingNonce(captchaTemplatePath, hostSite.pages)
+	}
+	c.hosts = append(c.hosts, hostSite)
+	return nil
+}
+
+func (s *site) setTemplates(captchaTemplatePath string) error {
+	templates, err := configuration.GetHTMLTemplates(captchaTemplatePath)
+	if err != nil {
+		return err
+	}
+	s.pages = response.NewPages(templates)
+	return nil
+}
+
+// warnMissingNonce logs the template sent without the default Content-Security-Policy, see response.PagesContentSecurityPolicy.
+func (c *Client) warnMissingNonce(path string, pages *response.Pages) {
+	if strings.TrimSpace(c.contentSecurityPolicy) == "" && !pages.UsesNonce() {
+		c.log.Info("captcha:New template without nonce, sent without Content-Security-Policy path:" + path)
+	}
+}
+
+// defaultContentSecurityPolicy allows the script, the frames, the styles and the requests of the provider,
+// and the inline scripts and styles having the nonce of the response.
+func defaultContentSecurityPolicy(sources string) string {
+	return "default-src 'none'; script-src 'nonce-{nonce}' " + sources + "; style-src 'nonce-{nonce}' " + sources +
+		"; frame-src " + sources + "; connect-src " + sources + "; img-src 'self' data: " + sources +
+		"; base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+}
+
+// siteOf returns the keys and templates of the captcha for the host of the request.
+func (c *Client) siteOf(r *http.Request) *site {
+	for _, hostSite := range c.hosts {
+		if rules.MatchHost(hostSite.host, r.Host) {
+			return hostSite
+		}
+	}
+	return c.site
+}
+
+// ServeScript serves the script of the pow provider, it reports whether the request was the one of the script.
+// It is served to every client, the captcha page being already blocked for the ones loading it.
+func (c *Client) ServeScript(rw http.ResponseWriter, r *http.Request) bool {
+	if !c.pow || r.URL.Path != powScriptPath {
+		return false
+	}
+	rw.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	if _, err := rw.Write([]byte(powScript)); err != nil {
+		c.log.Info("captcha:ServeScript powScript " + err.Error())
+	}
+	return true
+}
+
 // ServeHTTP Handle captcha html page or validation.
 func (c *Client) ServeHTTP(rw http.ResponseWriter, r *http.Request, remoteIP string) {
 	valid, err := c.Validate(r)
@@ -101,9 +208,18 @@ func (c *Client) ServeHTTP(rw http.ResponseWriter, r *http.Request, remoteIP str
 	if c.remediationCustomHeader != "" {
 		rw.Header().Set(c.remediationCustomHeader, "captcha")
 	}
+	nonce := response.Nonce()
+	requestSite := c.siteOf(r)
+	response.SetSecurityHeaders(rw.Header(), response.PagesContentSecurityPolicy(c.contentSecurityPolicy, c.defaultSecurityPolicy, requestSite.pages), nonce)
+	siteKey := requestSite.siteKey
+	if c.pow {
+		// The challenge of the built-in provider is given to its script as the site key.
+		siteKey = powChallenge(requestSite.secretKey, c.powDifficulty, time.Now())
+	}
 	rw.WriteHeader(http.StatusOK)
-	err = c.captchaTemplate.Execute(rw, map[string]string{
-		"SiteKey":     c.siteKey,
+	err = requestSite.pages.Template(r, c.defaultLanguage).Execute(rw, map[string]string{
+		"Nonce":       nonce,
+		"SiteKey":     siteKey,
 		"FrontendJS":  c.infoProvider.js,
 		"FrontendKey": c.infoProvider.key,
 	})
@@ -120,6 +236,21 @@ func (c *Client) Check(remoteIP string) bool {
 	return passed
 }
 
+// validatePow verifies the proof-of-work locally, each challenge is accepted once.
+func (c *Client) validatePow(r *http.Request, solution string) bool {
+	nonce, ttl, err := powVerify(c.siteOf(r).secretKey, solution, time.Now())
+	if err != nil {
+		c.log.Debug(err.Error())
+		return false
+	}
+	if _, err = c.cacheClient.Get(powUsedPrefix + nonce); err == nil {
+		c.log.Debug("captcha:validatePow challenge already used")
+		return false
+	}
+	c.cacheClient.Set(powUsedPrefix+nonce, cache.CaptchaDoneValue, ttl)
+	return true
+}
+
 type responseProvider struct {
 	Success bool `json:"success"`
 }
@@ -135,8 +266,11 @@ func (c *Client) Validate(r *http.Request) (bool, error) {
 		c.log.Debug("captcha:Validate no captcha response found in request")
 		return false, nil
 	}
+	if c.pow {
+		return c.validatePow(r, response), nil
+	}
 	var body = url.Values{}
-	body.Add("secret", c.secretKey)
+	body.Add("secret", c.siteOf(r).secretKey)
 	body.Add("response", response)
 	res, err := c.httpClient.PostForm(c.infoProvider.validate, body)
 	if err != nil {
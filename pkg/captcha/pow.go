@@ -0,0 +1,192 @@
+package captcha
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Built-in proof-of-work provider, the challenge is solved by the browser and verified without outbound call.
+const (
+	powScriptPath       = "/.crowdsec-bouncer/pow.js"
+	powKey              = "crowdsec-pow"
+	powResponse         = "crowdsec-pow-response"
+	powChallengeSeconds = 300
+	powUsedPrefix       = "pow:"
+)
+
+// powScript solves the challenge of the widgets: it finds a counter such as SHA-256(challenge:counter)
+// starts with difficulty zero bits, adds it to the form of the widget and calls the callback of the widget.
+// SHA-256 is computed with Web Crypto, only available over HTTPS, or else with the JavaScript implementation.
+const powScript = `(function () {
+  'use strict';
+  var K = [
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+  ];
+  function rotate(x, n) {
+    return (x >>> n) | (x << (32 - n));
+  }
+  function sha256(bytes) {
+    var padded = new Uint8Array(((bytes.length + 72) >> 6) << 6);
+    padded.set(bytes);
+    padded[bytes.length] = 0x80;
+    var view = new DataView(padded.buffer);
+    view.setUint32(padded.length - 8, Math.floor(bytes.length / 0x20000000));
+    view.setUint32(padded.length - 4, (bytes.length << 3) >>> 0);
+    var h = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+    var w = new Array(64);
+    for (var offset = 0; offset < padded.length; offset += 64) {
+      var i;
+      for (i = 0; i < 16; i++) {
+        w[i] = view.getUint32(offset + i * 4) | 0;
+      }
+      for (i = 16; i < 64; i++) {
+        var s0 = rotate(w[i - 15], 7) ^ rotate(w[i - 15], 18) ^ (w[i - 15] >>> 3);
+        var s1 = rotate(w[i - 2], 17) ^ rotate(w[i - 2], 19) ^ (w[i - 2] >>> 10);
+        w[i] = (w[i - 16] + s0 + w[i - 7] + s1) | 0;
+      }
+      var a = h[0], b = h[1], c = h[2], d = h[3], e = h[4], f = h[5], g = h[6], k = h[7];
+      for (i = 0; i < 64; i++) {
+        var t1 = (k + (rotate(e, 6) ^ rotate(e, 11) ^ rotate(e, 25)) + ((e & f) ^ (~e & g)) + K[i] + w[i]) | 0;
+        var t2 = ((rotate(a, 2) ^ rotate(a, 13) ^ rotate(a, 22)) + ((a & b) ^ (a & c) ^ (b & c))) | 0;
+        k = g;
+        g = f;
+        f = e;
+        e = (d + t1) | 0;
+        d = c;
+        c = b;
+        b = a;
+        a = (t1 + t2) | 0;
+      }
+      h[0] = (h[0] + a) | 0;
+      h[1] = (h[1] + b) | 0;
+      h[2] = (h[2] + c) | 0;
+      h[3] = (h[3] + d) | 0;
+      h[4] = (h[4] + e) | 0;
+      h[5] = (h[5] + f) | 0;
+      h[6] = (h[6] + g) | 0;
+      h[7] = (h[7] + k) | 0;
+    }
+    var digest = new DataView(new ArrayBuffer(32));
+    for (var j = 0; j < 8; j++) {
+      digest.setUint32(j * 4, h[j] >>> 0);
+    }
+    return new Uint8Array(digest.buffer);
+  }
+  var subtle = window.crypto && window.crypto.subtle;
+  async function digest(bytes) {
+    if (subtle) {
+      return new Uint8Array(await subtle.digest('SHA-256', bytes));
+    }
+    return sha256(bytes);
+  }
+  function zeroBits(digest) {
+    var count = 0;
+    for (var i = 0; i < digest.length; i++) {
+      if (digest[i] === 0) {
+        count += 8;
+        continue;
+      }
+      return count + Math.clz32(digest[i]) - 24;
+    }
+    return count;
+  }
+  async function solve(widget) {
+    var challenge = widget.getAttribute('data-sitekey');
+    var difficulty = parseInt(challenge.split('.')[1], 10);
+    var encoder = new TextEncoder();
+    for (var counter = 0; ; counter++) {
+      if (zeroBits(await digest(encoder.encode(challenge + ':' + counter))) >= difficulty) {
+        var input = document.createElement('input');
+        input.type = 'hidden';
+        input.name = '` + powResponse + `';
+        input.value = challenge + ':' + counter;
+        widget.closest('form').appendChild(input);
+        var callback = window[widget.getAttribute('data-callback')];
+        if (typeof callback === 'function') {
+          callback();
+        } else {
+          widget.closest('form').submit();
+        }
+        return;
+      }
+    }
+  }
+  function start() {
+    document.querySelectorAll('.` + powKey + `').forEach(solve);
+  }
+  if (document.readyState === 'loading') {
+    document.addEventListener('DOMContentLoaded', start);
+  } else {
+    start();
+  }
+})();
+`
+
+// powChallenge returns a signed challenge: nonce.difficulty.expiration.signature.
+func powChallenge(secretKey string, difficulty int, now time.Time) string {
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	payload := base64.RawURLEncoding.EncodeToString(nonce) + "." + strconv.Itoa(difficulty) + "." +
+		strconv.FormatInt(now.Add(powChallengeSeconds*time.Second).Unix(), 10)
+	return payload + "." + powSign(secretKey, payload)
+}
+
+func powSign(secretKey, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secretKey))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// powVerify checks the signature and the expiration of the challenge and the proof-of-work of the solution,
+// it returns the nonce of the challenge to prevent its reuse, and the seconds before it expires.
+func powVerify(secretKey, solution string, now time.Time) (string, int64, error) {
+	challenge, counter, ok := strings.Cut(solution, ":")
+	if !ok || counter == "" || len(counter) > 20 || strings.Trim(counter, "0123456789") != "" {
+		return "", 0, errors.New("captcha:powVerify invalid solution")
+	}
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 {
+		return "", 0, errors.New("captcha:powVerify invalid challenge")
+	}
+	if !hmac.Equal([]byte(parts[3]), []byte(powSign(secretKey, strings.Join(parts[:3], ".")))) {
+		return "", 0, errors.New("captcha:powVerify invalid signature")
+	}
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, errors.New("captcha:powVerify invalid difficulty")
+	}
+	expiration, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || now.Unix() > expiration {
+		return "", 0, errors.New("captcha:powVerify expired challenge")
+	}
+	digest := sha256.Sum256([]byte(solution))
+	if zeroBits(digest[:]) < difficulty {
+		return "", 0, errors.New("captcha:powVerify insufficient proof-of-work")
+	}
+	return parts[0], expiration - now.Unix() + 1, nil
+}
+
+func zeroBits(digest []byte) int {
+	count := 0
+	for _, b := range digest {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+	return count
+}
@@ -0,0 +1,79 @@
+package captcha
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPowSecret = "0123456789abcdef0123456789abcdef"
+
+// solvePow finds the counter of a challenge like the script of the provider.
+func solvePow(challenge string, difficulty int) string {
+	for counter := 0; ; counter++ {
+		solution := challenge + ":" + strconv.Itoa(counter)
+		digest := sha256.Sum256([]byte(solution))
+		if zeroBits(digest[:]) >= difficulty {
+			return solution
+		}
+	}
+}
+
+func Test_powVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	challenge := powChallenge(testPowSecret, 8, now)
+	solution := solvePow(challenge, 8)
+	weak := ""
+	for counter := 0; weak == ""; counter++ {
+		candidate := challenge + ":" + strconv.Itoa(counter)
+		if digest := sha256.Sum256([]byte(candidate)); zeroBits(digest[:]) < 8 {
+			weak = candidate
+		}
+	}
+	harder := strings.Replace(challenge, ".8.", ".1.", 1)
+	tests := []struct {
+		name     string
+		secret   string
+		solution string
+		now      time.Time
+		wantErr  bool
+	}{
+		{name: "Valid solution", secret: testPowSecret, solution: solution, now: now.Add(time.Minute), wantErr: false},
+		{name: "Other secret", secret: strings.Repeat("x", 32), solution: solution, now: now, wantErr: true},
+		{name: "Expired challenge", secret: testPowSecret, solution: solution, now: now.Add(powChallengeSeconds*time.Second + time.Second), wantErr: true},
+		{name: "Insufficient proof-of-work", secret: testPowSecret, solution: weak, now: now, wantErr: true},
+		{name: "Tampered difficulty", secret: testPowSecret, solution: solvePow(harder, 1), now: now, wantErr: true},
+		{name: "Without counter", secret: testPowSecret, solution: challenge, now: now, wantErr: true},
+		{name: "Invalid counter", secret: testPowSecret, solution: challenge + ":-1", now: now, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nonce, ttl, err := powVerify(tt.secret, tt.solution, tt.now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("powVerify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (nonce != strings.Split(challenge, ".")[0] || ttl <= 0) {
+				t.Errorf("powVerify() = %v, %v", nonce, ttl)
+			}
+		})
+	}
+}
+
+func Test_zeroBits(t *testing.T) {
+	tests := []struct {
+		digest []byte
+		want   int
+	}{
+		{digest: []byte{0x80, 0x00}, want: 0},
+		{digest: []byte{0x01, 0xff}, want: 7},
+		{digest: []byte{0x00, 0x10}, want: 11},
+		{digest: []byte{0x00, 0x00}, want: 16},
+	}
+	for _, tt := range tests {
+		if got := zeroBits(tt.digest); got != tt.want {
+			t.Errorf("zeroBits(%x) = %v, want %v", tt.digest, got, tt.want)
+		}
+	}
+}
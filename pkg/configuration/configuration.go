@@ -10,13 +10,21 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
 
+	geo "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/geo"
+	goodbot "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/goodbot"
 	ip "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/ip"
 	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+	policy "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/policy"
+	redirect "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/redirect"
+	response "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/response"
+	rules "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/rules"
+	scope "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/scope"
 )
 
 // Enums for crowdsec mode.
@@ -35,6 +43,7 @@ const (
 	RecaptchaProvider = "recaptcha"
 	TurnstileProvider = "turnstile"
 	CustomProvider    = "custom"
+	PowProvider       = "pow"
 )
 
 // Config the plugin configuration.
@@ -74,15 +83,66 @@ type Config struct {
 	HTTPTimeoutSeconds                       int64    `json:"httpTimeoutSeconds,omitempty"`
 	RemediationHeadersCustomName             string   `json:"remediationHeadersCustomName,omitempty"`
 	ForwardedHeadersCustomName               string   `json:"forwardedHeadersCustomName,omitempty"`
+	ForwardedHeadersNames                    []string `json:"forwardedHeadersNames,omitempty"`
 	ForwardedHeadersTrustedIPs               []string `json:"forwardedHeadersTrustedIps,omitempty"`
+	ForwardedHeadersTrustedIPsFile           string   `json:"forwardedHeadersTrustedIpsFile,omitempty"`
+	TrustedIPsFileRefreshSeconds             int64    `json:"trustedIpsFileRefreshSeconds,omitempty"`
+	ForwardedHeadersDepth                    int      `json:"forwardedHeadersDepth,omitempty"`
+	ForwardedHeadersDeepChain                bool     `json:"forwardedHeadersDeepChain,omitempty"`
+	ForwardedHeadersMaxHops                  int      `json:"forwardedHeadersMaxHops,omitempty"`
 	ClientTrustedIPs                         []string `json:"clientTrustedIps,omitempty"`
+	IPv6DecisionPrefixLength                 int      `json:"ipv6DecisionPrefixLength,omitempty"`
 	RedisCacheEnabled                        bool     `json:"redisCacheEnabled,omitempty"`
 	RedisCacheHost                           string   `json:"redisCacheHost,omitempty"`
 	RedisCachePassword                       string   `json:"redisCachePassword,omitempty"`
 	RedisCachePasswordFile                   string   `json:"redisCachePasswordFile,omitempty"`
 	RedisCacheDatabase                       string   `json:"redisCacheDatabase,omitempty"`
 	RedisCacheUnreachableBlock               bool     `json:"redisCacheUnreachableBlock,omitempty"`
+	FileCacheEnabled                         bool     `json:"fileCacheEnabled,omitempty"`
+	FileCachePath                            string   `json:"fileCachePath,omitempty"`
+	GeoCountryDatabaseFilePath               string   `json:"geoCountryDatabaseFilePath,omitempty"`
+	GeoASNDatabaseFilePath                   string   `json:"geoAsnDatabaseFilePath,omitempty"`
+	GeoCountryAllowList                      []string `json:"geoCountryAllowList,omitempty"`
+	GeoCountryDenyList                       []string `json:"geoCountryDenyList,omitempty"`
+	CustomScopes                             []string `json:"customScopes,omitempty"`
+	CustomScopesJwtSecret                    string   `json:"customScopesJwtSecret,omitempty"`
+	CustomScopesJwtSecretFile                string   `json:"customScopesJwtSecretFile,omitempty"`
+	GoodBotsEnabled                          bool     `json:"goodBotsEnabled,omitempty"`
+	GoodBots                                 []string `json:"goodBots,omitempty"`
+	GoodBotsCacheSeconds                     int64    `json:"goodBotsCacheSeconds,omitempty"`
+	BypassCertificateSubjects                []string `json:"bypassCertificateSubjects,omitempty"`
+	BypassCertificateSANs                    []string `json:"bypassCertificateSans,omitempty"`
+	BypassCertificateIssuers                 []string `json:"bypassCertificateIssuers,omitempty"`
+	BypassTokenHeader                        string   `json:"bypassTokenHeader,omitempty"`
+	BypassTokenSecret                        string   `json:"bypassTokenSecret,omitempty"`
+	BypassTokenSecretFile                    string   `json:"bypassTokenSecretFile,omitempty"`
+	RequestRules                             []Rule   `json:"requestRules,omitempty"`
+	CrowdsecAllowlistsEnabled                bool     `json:"crowdsecAllowlistsEnabled,omitempty"`
+	RemediationPolicies                      []Policy `json:"remediationPolicies,omitempty"`
+	DryRunEnabled                            bool     `json:"dryRunEnabled,omitempty"`
+	DryRunRemediations                       []string `json:"dryRunRemediations,omitempty"`
+	DryRunHeaderName                         string   `json:"dryRunHeaderName,omitempty"`
+	AnnotateEnabled                          bool     `json:"annotateEnabled,omitempty"`
+	RedirectURL                              string   `json:"redirectUrl,omitempty"`
+	RedirectStatusCode                       int      `json:"redirectStatusCode,omitempty"`
+	RedirectSecret                           string   `json:"redirectSecret,omitempty"`
+	RedirectSecretFile                       string   `json:"redirectSecretFile,omitempty"`
+	TarpitDelaySeconds                       int64    `json:"tarpitDelaySeconds,omitempty"`
+	TarpitMaxConnections                     int64    `json:"tarpitMaxConnections,omitempty"`
+	ThrottleRequests                         int64    `json:"throttleRequests,omitempty"`
+	ThrottlePeriodSeconds                    int64    `json:"throttlePeriodSeconds,omitempty"`
+	ThrottleBurst                            int64    `json:"throttleBurst,omitempty"`
+	RemediationGRPCStatusCode                int      `json:"remediationGrpcStatusCode,omitempty"`
+	RemediationWebSocketStatusCode           int      `json:"remediationWebSocketStatusCode,omitempty"`
+	RemediationSSEStatusCode                 int      `json:"remediationSseStatusCode,omitempty"`
 	BanHTMLFilePath                          string   `json:"banHtmlFilePath,omitempty"`
+	BanJSONFilePath                          string   `json:"banJsonFilePath,omitempty"`
+	BanTextFilePath                          string   `json:"banTextFilePath,omitempty"`
+	APIPathPrefixes                          []string `json:"apiPathPrefixes,omitempty"`
+	DefaultLanguage                          string   `json:"defaultLanguage,omitempty"`
+	HostOverrides                            []Host   `json:"hostOverrides,omitempty"`
+	BanContentSecurityPolicy                 string   `json:"banContentSecurityPolicy,omitempty"`
+	CaptchaContentSecurityPolicy             string   `json:"captchaContentSecurityPolicy,omitempty"`
 	CaptchaHTMLFilePath                      string   `json:"captchaHtmlFilePath,omitempty"`
 	CaptchaProvider                          string   `json:"captchaProvider,omitempty"`
 	CaptchaCustomJsURL                       string   `json:"captchaCustomJsUrl,omitempty"`
@@ -94,6 +154,43 @@ type Config struct {
 	CaptchaSecretKey                         string   `json:"captchaSecretKey,omitempty"`
 	CaptchaSecretKeyFile                     string   `json:"captchaSecretKeyFile,omitempty"`
 	CaptchaGracePeriodSeconds                int64    `json:"captchaGracePeriodSeconds,omitempty"`
+	CaptchaPowDifficulty                     int      `json:"captchaPowDifficulty,omitempty"`
+}
+
+// Rule matches requests by their attributes to bypass or enforce the bouncer, or to force a remediation.
+// Every non empty attribute must match, rules are evaluated in order and the first matching one applies.
+type Rule struct {
+	Host         string   `json:"host,omitempty"`
+	PathPrefix   string   `json:"pathPrefix,omitempty"`
+	PathRegex    string   `json:"pathRegex,omitempty"`
+	Methods      []string `json:"methods,omitempty"`
+	Header       string   `json:"header,omitempty"`
+	HeaderValue  string   `json:"headerValue,omitempty"`
+	Action       string   `json:"action,omitempty"`
+	Remediations []string `json:"remediations,omitempty"`
+}
+
+// Policy maps the decisions matching its attributes to an action, and a status code for the ban action.
+// Every non empty attribute must match, policies are evaluated in order and the first matching one applies.
+type Policy struct {
+	Type       string `json:"type,omitempty"`
+	Scenario   string `json:"scenario,omitempty"`
+	Origin     string `json:"origin,omitempty"`
+	Scope      string `json:"scope,omitempty"`
+	Action     string `json:"action,omitempty"`
+	StatusCode int    `json:"statusCode,omitempty"`
+}
+
+// Host overrides the ban and captcha templates and the captcha keys for the requests to the hosts matching a glob.
+// Hosts are evaluated in order and the first matching one applies, its empty values are the global ones.
+type Host struct {
+	Host                 string `json:"host,omitempty"`
+	BanHTMLFilePath      string `json:"banHtmlFilePath,omitempty"`
+	CaptchaHTMLFilePath  string `json:"captchaHtmlFilePath,omitempty"`
+	CaptchaSiteKey       string `json:"captchaSiteKey,omitempty"`
+	CaptchaSiteKeyFile   string `json:"captchaSiteKeyFile,omitempty"`
+	CaptchaSecretKey     string `json:"captchaSecretKey,omitempty"`
+	CaptchaSecretKeyFile string `json:"captchaSecretKeyFile,omitempty"`
 }
 
 func contains(source []string, target string) bool {
@@ -137,24 +234,97 @@ func New() *Config {
 		CaptchaSiteKey:                 "",
 		CaptchaSecretKey:               "",
 		CaptchaGracePeriodSeconds:      1800,
+		CaptchaPowDifficulty:           16,
 		CaptchaHTMLFilePath:            "/captcha.html",
 		BanHTMLFilePath:                "",
+		BanJSONFilePath:                "",
+		BanTextFilePath:                "",
+		APIPathPrefixes:                []string{},
+		DefaultLanguage:                "en",
+		HostOverrides:                  []Host{},
+		BanContentSecurityPolicy:       "",
+		CaptchaContentSecurityPolicy:   "",
 		RemediationHeadersCustomName:   "",
 		ForwardedHeadersCustomName:     "X-Forwarded-For",
+		ForwardedHeadersNames:          []string{},
 		ForwardedHeadersTrustedIPs:     []string{},
+		ForwardedHeadersTrustedIPsFile: "",
+		ForwardedHeadersDepth:          0,
+		ForwardedHeadersDeepChain:      false,
+		ForwardedHeadersMaxHops:        5,
+		TrustedIPsFileRefreshSeconds:   60,
 		ClientTrustedIPs:               []string{},
+		IPv6DecisionPrefixLength:       128,
 		RedisCacheEnabled:              false,
 		RedisCacheHost:                 "redis:6379",
 		RedisCachePassword:             "",
 		RedisCacheDatabase:             "",
 		RedisCacheUnreachableBlock:     true,
+		FileCacheEnabled:               false,
+		FileCachePath:                  "/tmp/crowdsec-bouncer-traefik-plugin.cache",
+		GeoCountryDatabaseFilePath:     "",
+		GeoASNDatabaseFilePath:         "",
+		GeoCountryAllowList:            []string{},
+		GeoCountryDenyList:             []string{},
+		CustomScopes:                   []string{},
+		CustomScopesJwtSecret:          "",
+		GoodBotsEnabled:                false,
+		GoodBots:                       []string{},
+		GoodBotsCacheSeconds:           86400,
+		BypassCertificateSubjects:      []string{},
+		BypassCertificateSANs:          []string{},
+		BypassCertificateIssuers:       []string{},
+		BypassTokenHeader:              "X-Crowdsec-Bypass-Token",
+		BypassTokenSecret:              "",
+		RequestRules:                   []Rule{},
+		CrowdsecAllowlistsEnabled:      false,
+		RemediationPolicies:            []Policy{},
+		DryRunEnabled:                  false,
+		DryRunRemediations:             []string{},
+		DryRunHeaderName:               "",
+		AnnotateEnabled:                false,
+		RedirectURL:                    "",
+		RedirectStatusCode:             http.StatusFound,
+		RedirectSecret:                 "",
+		TarpitDelaySeconds:             30,
+		TarpitMaxConnections:           100,
+		ThrottleRequests:               60,
+		ThrottlePeriodSeconds:          60,
+		ThrottleBurst:                  10,
+		RemediationGRPCStatusCode:      7, // PERMISSION_DENIED
+		RemediationWebSocketStatusCode: http.StatusForbidden,
+		RemediationSSEStatusCode:       http.StatusNoContent,
 	}
 }
 
 // GetVariable get variable from file and after in the variables gave by user.
 func GetVariable(config *Config, key string) (string, error) {
+	return getVariable(reflect.Indirect(reflect.ValueOf(config)), key)
+}
+
+// GetHostOverrides returns the host overrides with the captcha keys read from their files.
+func GetHostOverrides(config *Config) ([]Host, error) {
+	hosts := make([]Host, 0, len(config.HostOverrides))
+	for i, host := range config.HostOverrides {
+		object := reflect.ValueOf(&host).Elem()
+		siteKey, err := getVariable(object, "CaptchaSiteKey")
+		if err != nil {
+			return nil, fmt.Errorf("HostOverrides[%d]: %w", i, err)
+		}
+		secretKey, err := getVariable(object, "CaptchaSecretKey")
+		if err != nil {
+			return nil, fmt.Errorf("HostOverrides[%d]: %w", i, err)
+		}
+		host.Host = strings.ToLower(strings.TrimSpace(host.Host))
+		host.CaptchaSiteKey = siteKey
+		host.CaptchaSecretKey = secretKey
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+func getVariable(object reflect.Value, key string) (string, error) {
 	value := ""
-	object := reflect.Indirect(reflect.ValueOf(config))
 	field := object.FieldByName(key + "File")
 	// Here linter say you should simplify this code, but lets not, performance is important not clarity and complexity
 	fp := field.String()
@@ -178,6 +348,47 @@ func GetVariable(config *Config, key string) (string, error) {
 	return strings.TrimSpace(value), nil
 }
 
+// GetForwardedHeaders get the ordered list of headers where the client IP is searched.
+// ForwardedHeadersNames takes precedence over the single ForwardedHeadersCustomName.
+func GetForwardedHeaders(config *Config) []string {
+	headers := make([]string, 0, len(config.ForwardedHeadersNames))
+	for _, header := range config.ForwardedHeadersNames {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, http.CanonicalHeaderKey(header))
+		}
+	}
+	if len(headers) == 0 && config.ForwardedHeadersCustomName != "" {
+		headers = append(headers, http.CanonicalHeaderKey(config.ForwardedHeadersCustomName))
+	}
+	return headers
+}
+
+// GetRequestRules compiles the request rules.
+func GetRequestRules(config *Config) ([]*rules.Rule, error) {
+	requestRules := make([]*rules.Rule, 0, len(config.RequestRules))
+	for i, rule := range config.RequestRules {
+		requestRule, err := rules.New(rule.Host, rule.PathPrefix, rule.PathRegex, rule.Methods, rule.Header, rule.HeaderValue, rule.Action, rule.Remediations)
+		if err != nil {
+			return nil, fmt.Errorf("RequestRules[%d]: %w", i, err)
+		}
+		requestRules = append(requestRules, requestRule)
+	}
+	return requestRules, nil
+}
+
+// GetRemediationPolicies returns the compiled remediation policies.
+func GetRemediationPolicies(config *Config) ([]*policy.Policy, error) {
+	policies := make([]*policy.Policy, 0, len(config.RemediationPolicies))
+	for i, item := range config.RemediationPolicies {
+		remediationPolicy, err := policy.New(item.Type, item.Scenario, item.Origin, item.Scope, item.Action, item.StatusCode)
+		if err != nil {
+			return nil, fmt.Errorf("RemediationPolicies[%d]: %w", i, err)
+		}
+		policies = append(policies, remediationPolicy)
+	}
+	return policies, nil
+}
+
 // GetHTMLTemplate get compiled HTML template.
 func GetHTMLTemplate(path string) (*template.Template, error) {
 	var err error
@@ -197,6 +408,32 @@ func GetHTMLTemplate(path string) (*template.Template, error) {
 	return compiledTemplate, nil
 }
 
+// GetHTMLTemplates get the compiled HTML template, under the empty language,
+// and its translations stored next to it as <name>.<lang><ext> (ex: ban.fr.html for ban.html).
+func GetHTMLTemplates(path string) (map[string]*template.Template, error) {
+	compiledTemplate, err := GetHTMLTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+	templates := map[string]*template.Template{"": compiledTemplate}
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(path, ext)
+	translations, _ := filepath.Glob(name + ".*" + ext)
+	reg := regexp.MustCompile(`^[a-zA-Z]{1,8}(-[a-zA-Z0-9]{1,8})*$`)
+	for _, translation := range translations {
+		lang := strings.TrimSuffix(strings.TrimPrefix(translation, name+"."), ext)
+		if !reg.MatchString(lang) {
+			continue
+		}
+		compiledTemplate, err = GetHTMLTemplate(translation)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", translation, err)
+		}
+		templates[strings.ToLower(lang)] = compiledTemplate
+	}
+	return templates, nil
+}
+
 // ValidateParams validate all the param gave by user.
 //
 //nolint:gocyclo,gocognit
@@ -215,12 +452,80 @@ func ValidateParams(config *Config) error {
 	if err := validateParamsIPs(config.ClientTrustedIPs, "ClientTrustedIPs"); err != nil {
 		return err
 	}
+	if config.ForwardedHeadersTrustedIPsFile != "" {
+		listIP, err := ip.ReadFile(config.ForwardedHeadersTrustedIPsFile)
+		if err != nil {
+			return fmt.Errorf("ForwardedHeadersTrustedIPsFile: %w", err)
+		}
+		if err = validateParamsIPs(listIP, "ForwardedHeadersTrustedIPsFile"); err != nil {
+			return err
+		}
+	}
 
 	if _, err := GetVariable(config, "RedisCachePassword"); err != nil {
 		return err
 	}
 
+	if err := validateFileCache(config); err != nil {
+		return err
+	}
+
+	if err := validateGeo(config); err != nil {
+		return err
+	}
+
+	if err := validateCustomScopes(config); err != nil {
+		return err
+	}
+
+	if err := goodbot.Parse(config.GoodBots); err != nil {
+		return fmt.Errorf("GoodBots: %w", err)
+	}
+
+	if err := validateBypass(config); err != nil {
+		return err
+	}
+
+	for _, remediation := range config.DryRunRemediations {
+		if !contains([]string{"ban", "captcha", "throttle"}, strings.ToLower(strings.TrimSpace(remediation))) {
+			return fmt.Errorf("DryRunRemediations: %q must be ban, captcha or throttle", remediation)
+		}
+	}
+
+	requestRules, err := GetRequestRules(config)
+	if err != nil {
+		return err
+	}
+	for _, rule := range requestRules {
+		if rule.Action == rules.ActionCaptcha && config.CaptchaProvider == "" {
+			return errors.New("RequestRules: the captcha action needs a CaptchaProvider")
+		}
+	}
+
+	policies, err := GetRemediationPolicies(config)
+	if err != nil {
+		return err
+	}
+	for _, remediationPolicy := range policies {
+		if remediationPolicy.Action == policy.ActionCaptcha && config.CaptchaProvider == "" {
+			return errors.New("RemediationPolicies: the captcha action needs a CaptchaProvider")
+		}
+		if remediationPolicy.Action == policy.ActionRedirect && config.RedirectURL == "" {
+			return errors.New("RemediationPolicies: the redirect action needs a RedirectURL")
+		}
+	}
+	if err := validateTarpitThrottle(config, policies); err != nil {
+		return err
+	}
+
+	if err := validateRedirect(config); err != nil {
+		return err
+	}
+
 	if config.CrowdsecMode == AloneMode {
+		if config.CrowdsecAllowlistsEnabled {
+			return errors.New("CrowdsecAllowlistsEnabled: allowlists are only available from LAPI, not in alone mode")
+		}
 		if _, err := GetVariable(config, "CrowdsecCapiMachineID"); err != nil {
 			return err
 		}
@@ -237,15 +542,27 @@ func ValidateParams(config *Config) error {
 		if _, err := GetVariable(config, "CaptchaSecretKey"); err != nil {
 			return err
 		}
-		if _, err := GetHTMLTemplate(config.CaptchaHTMLFilePath); err != nil {
+		if _, err := GetHTMLTemplates(config.CaptchaHTMLFilePath); err != nil {
 			return err
 		}
 	}
 	if config.BanHTMLFilePath != "" {
-		if _, err := GetHTMLTemplate(config.BanHTMLFilePath); err != nil {
+		if _, err := GetHTMLTemplates(config.BanHTMLFilePath); err != nil {
 			return err
 		}
 	}
+	if err := validateHostOverrides(config); err != nil {
+		return err
+	}
+	if strings.ContainsAny(config.BanContentSecurityPolicy+config.CaptchaContentSecurityPolicy, "\r\n") {
+		return errors.New("BanContentSecurityPolicy and CaptchaContentSecurityPolicy: must be on a single line")
+	}
+	if !regexp.MustCompile(`^[a-zA-Z]{1,8}(-[a-zA-Z0-9]{1,8})*$`).MatchString(config.DefaultLanguage) {
+		return errors.New("DefaultLanguage: must be a language tag (ex: en, pt-BR)")
+	}
+	if _, err := response.New(config.BanJSONFilePath, config.BanTextFilePath); err != nil {
+		return err
+	}
 
 	if err := validateURL("CrowdsecLapi", config.CrowdsecLapiScheme, config.CrowdsecLapiHost, config.CrowdsecLapiPath); err != nil {
 		return err
@@ -344,9 +661,144 @@ func validateParamsIPs(listIP []string, key string) error {
 	return nil
 }
 
+func validateFileCache(config *Config) error {
+	if !config.FileCacheEnabled {
+		return nil
+	}
+	if config.RedisCacheEnabled {
+		return errors.New("FileCacheEnabled: cannot be enabled together with RedisCacheEnabled")
+	}
+	if config.FileCachePath == "" {
+		return errors.New("FileCachePath: cannot be empty when FileCacheEnabled is true")
+	}
+	file, err := os.OpenFile(filepath.Clean(config.FileCachePath), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("FileCachePath is not writable %w", err)
+	}
+	return file.Close()
+}
+
+func validateGeo(config *Config) error {
+	if config.GeoCountryDatabaseFilePath == "" && (len(config.GeoCountryAllowList) > 0 || len(config.GeoCountryDenyList) > 0) {
+		return errors.New("GeoCountryDatabaseFilePath: cannot be empty when GeoCountryAllowList or GeoCountryDenyList are set")
+	}
+	reg := regexp.MustCompile(`^[a-zA-Z]{2}$`)
+	for key, list := range map[string][]string{"GeoCountryAllowList": config.GeoCountryAllowList, "GeoCountryDenyList": config.GeoCountryDenyList} {
+		for _, isoCode := range list {
+			if !reg.MatchString(strings.TrimSpace(isoCode)) {
+				return fmt.Errorf("%s: %q is not an ISO 3166-1 alpha-2 country code", key, isoCode)
+			}
+		}
+	}
+	for key, path := range map[string]string{"GeoCountryDatabaseFilePath": config.GeoCountryDatabaseFilePath, "GeoASNDatabaseFilePath": config.GeoASNDatabaseFilePath} {
+		if path == "" {
+			continue
+		}
+		if _, err := geo.Open(path); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func validateCustomScopes(config *Config) error {
+	secret, err := GetVariable(config, "CustomScopesJwtSecret")
+	if err != nil {
+		return err
+	}
+	for _, definition := range config.CustomScopes {
+		if _, err = scope.Parse(definition, secret); err != nil {
+			return fmt.Errorf("CustomScopes: %w", err)
+		}
+	}
+	return nil
+}
+
+func validateBypass(config *Config) error {
+	patterns := map[string][]string{
+		"BypassCertificateSubjects": config.BypassCertificateSubjects,
+		"BypassCertificateSANs":     config.BypassCertificateSANs,
+		"BypassCertificateIssuers":  config.BypassCertificateIssuers,
+	}
+	for key, list := range patterns {
+		for _, pattern := range list {
+			if strings.TrimSpace(pattern) == "" {
+				return errors.New(key + ": cannot contain an empty pattern")
+			}
+		}
+	}
+	secret, err := GetVariable(config, "BypassTokenSecret")
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		return nil
+	}
+	if len(secret) < 32 {
+		return errors.New("BypassTokenSecret: cannot be shorter than 32 characters")
+	}
+	if config.BypassTokenHeader == "" {
+		return errors.New("BypassTokenHeader: cannot be empty when BypassTokenSecret is set")
+	}
+	return nil
+}
+
+// validateTarpitThrottle checks the settings of the tarpit and throttle actions used by the remediation policies.
+// Unused settings are not checked, throttle decisions are handled as a ban without valid throttle settings.
+func validateTarpitThrottle(config *Config, policies []*policy.Policy) error {
+	required := map[string]int64{}
+	for _, remediationPolicy := range policies {
+		switch remediationPolicy.Action {
+		case policy.ActionTarpit:
+			required["TarpitDelaySeconds"] = config.TarpitDelaySeconds
+			required["TarpitMaxConnections"] = config.TarpitMaxConnections
+		case policy.ActionThrottle:
+			required["ThrottleRequests"] = config.ThrottleRequests
+			required["ThrottlePeriodSeconds"] = config.ThrottlePeriodSeconds
+			required["ThrottleBurst"] = config.ThrottleBurst
+		}
+	}
+	for key, val := range required {
+		if val < 1 {
+			return errors.New(key + ": cannot be less than 1")
+		}
+	}
+	return nil
+}
+
+func validateRedirect(config *Config) error {
+	if config.RedirectURL == "" {
+		return nil
+	}
+	secret, err := GetVariable(config, "RedirectSecret")
+	if err != nil {
+		return err
+	}
+	if len(secret) < 32 {
+		return errors.New("RedirectSecret: cannot be shorter than 32 characters")
+	}
+	if _, err := redirect.New(config.RedirectURL, secret, config.RedirectStatusCode); err != nil {
+		return fmt.Errorf("RedirectURL: %w", err)
+	}
+	return nil
+}
+
 func validateCaptcha(config *Config) error {
-	if !contains([]string{"", HcaptchaProvider, RecaptchaProvider, TurnstileProvider, CustomProvider}, config.CaptchaProvider) {
-		return fmt.Errorf("CaptchaProvider: must be one of '%s', '%s', '%s' or '%s'", HcaptchaProvider, RecaptchaProvider, TurnstileProvider, CustomProvider)
+	if !contains([]string{"", HcaptchaProvider, RecaptchaProvider, TurnstileProvider, CustomProvider, PowProvider}, config.CaptchaProvider) {
+		return fmt.Errorf("CaptchaProvider: must be one of '%s', '%s', '%s', '%s' or '%s'", HcaptchaProvider, RecaptchaProvider, TurnstileProvider, CustomProvider, PowProvider)
+	}
+	if config.CaptchaProvider == PowProvider {
+		if config.CaptchaPowDifficulty < 1 || config.CaptchaPowDifficulty > 32 {
+			return errors.New("CaptchaPowDifficulty: cannot be less than 1 and more than 32")
+		}
+		// The secret key signs the challenges, there is no site key.
+		secret, err := GetVariable(config, "CaptchaSecretKey")
+		if err != nil {
+			return err
+		}
+		if len(secret) < 32 {
+			return errors.New("CaptchaSecretKey: cannot be shorter than 32 characters with the pow provider")
+		}
 	}
 	if config.CaptchaProvider == CustomProvider {
 		if config.CaptchaCustomKey == "" || config.CaptchaCustomResponse == "" || config.CaptchaCustomValidateURL == "" || config.CaptchaCustomJsURL == "" {
@@ -362,6 +814,46 @@ func validateCaptcha(config *Config) error {
 	return nil
 }
 
+func validateHostOverrides(config *Config) error {
+	hosts, err := GetHostOverrides(config)
+	if err != nil {
+		return err
+	}
+	for i, host := range hosts {
+		if host.Host == "" {
+			return fmt.Errorf("HostOverrides[%d]: host is required", i)
+		}
+		if _, err := path.Match(host.Host, ""); err != nil {
+			return fmt.Errorf("HostOverrides[%d]: host %q %w", i, host.Host, err)
+		}
+		if host.BanHTMLFilePath != "" {
+			if _, err := GetHTMLTemplates(host.BanHTMLFilePath); err != nil {
+				return fmt.Errorf("HostOverrides[%d]: %w", i, err)
+			}
+		}
+		if host.CaptchaHTMLFilePath == "" && host.CaptchaSiteKey == "" && host.CaptchaSecretKey == "" {
+			continue
+		}
+		if config.CaptchaProvider == "" {
+			return fmt.Errorf("HostOverrides[%d]: the captcha template and keys need a CaptchaProvider", i)
+		}
+		// Site keys are bound to domains by the providers, the secret key goes with its site key.
+		if config.CaptchaProvider == PowProvider {
+			if host.CaptchaSecretKey != "" && len(host.CaptchaSecretKey) < 32 {
+				return fmt.Errorf("HostOverrides[%d]: captchaSecretKey cannot be shorter than 32 characters with the pow provider", i)
+			}
+		} else if (host.CaptchaSiteKey == "") != (host.CaptchaSecretKey == "") {
+			return fmt.Errorf("HostOverrides[%d]: captchaSiteKey and captchaSecretKey must be set together", i)
+		}
+		if host.CaptchaHTMLFilePath != "" {
+			if _, err := GetHTMLTemplates(host.CaptchaHTMLFilePath); err != nil {
+				return fmt.Errorf("HostOverrides[%d]: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
 func validateParamsRequired(config *Config) error {
 	requiredStrings := map[string]string{
 		"CrowdsecLapiScheme": config.CrowdsecLapiScheme,
@@ -387,6 +879,7 @@ func validateParamsRequired(config *Config) error {
 		"DefaultDecisionSeconds":    config.DefaultDecisionSeconds,
 		"HTTPTimeoutSeconds":        config.HTTPTimeoutSeconds,
 		"CaptchaGracePeriodSeconds": config.CaptchaGracePeriodSeconds,
+		"GoodBotsCacheSeconds":      config.GoodBotsCacheSeconds,
 	}
 	for key, val := range requiredInt1 {
 		if val < 1 {
@@ -399,9 +892,27 @@ func validateParamsRequired(config *Config) error {
 	if config.CrowdsecAppsecBodyLimit < 0 {
 		return errors.New("CrowdsecAppsecBodyLimit: cannot be less than 0")
 	}
+	if config.ForwardedHeadersDepth < 0 {
+		return errors.New("ForwardedHeadersDepth: cannot be less than 0")
+	}
+	if config.ForwardedHeadersDeepChain && config.ForwardedHeadersMaxHops < 1 {
+		return errors.New("ForwardedHeadersMaxHops: cannot be less than 1")
+	}
+	if config.IPv6DecisionPrefixLength < 1 || config.IPv6DecisionPrefixLength > 128 {
+		return errors.New("IPv6DecisionPrefixLength: cannot be less than 1 and more than 128")
+	}
 	if config.RemediationStatusCode < 100 || config.RemediationStatusCode >= 600 {
 		return errors.New("RemediationStatusCode: cannot be less than 100 and more than 600")
 	}
+	if config.RemediationWebSocketStatusCode < 100 || config.RemediationWebSocketStatusCode >= 600 {
+		return errors.New("RemediationWebSocketStatusCode: cannot be less than 100 and more than 600")
+	}
+	if config.RemediationSSEStatusCode < 100 || config.RemediationSSEStatusCode >= 600 {
+		return errors.New("RemediationSSEStatusCode: cannot be less than 100 and more than 600")
+	}
+	if config.RemediationGRPCStatusCode < 1 || config.RemediationGRPCStatusCode > 16 {
+		return errors.New("RemediationGRPCStatusCode: must be a gRPC error code between 1 and 16")
+	}
 
 	if !contains([]string{NoneMode, LiveMode, StreamMode, AloneMode, AppsecMode}, config.CrowdsecMode) {
 		return errors.New("CrowdsecMode: must be one of 'none', 'live', 'stream', 'alone' or 'appsec'")
@@ -2,7 +2,10 @@ package configuration
 
 import (
 	"crypto/tls"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
 
 	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
@@ -93,6 +96,110 @@ func Test_ValidateParams(t *testing.T) {
 	cfg9.LogLevel = "info"
 	cfg10 := getMinimalConfig()
 	cfg10.LogLevel = "Warning"
+	cfg11 := getMinimalConfig()
+	cfg11.FileCacheEnabled = true
+	cfg11.RedisCacheEnabled = true
+	cfg12 := getMinimalConfig()
+	cfg12.FileCacheEnabled = true
+	cfg12.FileCachePath = "../../tests/missing/cache"
+	cfg13 := getMinimalConfig()
+	cfg13.GeoCountryDenyList = []string{"FR"}
+	cfg14 := getMinimalConfig()
+	cfg14.GeoCountryDatabaseFilePath = "../../tests/GeoLite2-Country-Test.mmdb"
+	cfg14.GeoCountryAllowList = []string{"FR", "de"}
+	cfg15 := getMinimalConfig()
+	cfg15.GeoCountryDatabaseFilePath = "../../tests/GeoLite2-Country-Test.mmdb"
+	cfg15.GeoCountryDenyList = []string{"France"}
+	cfg16 := getMinimalConfig()
+	cfg16.GeoASNDatabaseFilePath = "../../tests/.keytest"
+	cfg17 := getMinimalConfig()
+	cfg17.CustomScopes = []string{"username=jwt:sub", "api_key=header:X-Api-Key"}
+	cfg18 := getMinimalConfig()
+	cfg18.CustomScopes = []string{"ip=header:X-Real-Ip"}
+	cfg19 := getMinimalConfig()
+	cfg19.BypassTokenSecret = "too-short"
+	cfg20 := getMinimalConfig()
+	cfg20.BypassTokenSecret = "a-secret-long-enough-for-hmac-sha256"
+	cfg20.BypassCertificateSANs = []string{"*.internal.example.com"}
+	cfg21 := getMinimalConfig()
+	cfg21.RequestRules = []Rule{{PathPrefix: "/healthz", Action: "bypass"}, {PathRegex: "^/login$", Action: "ban"}}
+	cfg22 := getMinimalConfig()
+	cfg22.RequestRules = []Rule{{PathPrefix: "/healthz", Action: "allow"}}
+	cfg23 := getMinimalConfig()
+	cfg23.CrowdsecMode = AloneMode
+	cfg23.CrowdsecCapiMachineID = "test"
+	cfg23.CrowdsecCapiPassword = "test"
+	cfg23.CrowdsecAllowlistsEnabled = true
+	cfg24 := getMinimalConfig()
+	cfg24.RemediationPolicies = []Policy{{Origin: "lists:tor*", Action: "ban", StatusCode: 429}, {Type: "*", Action: "ban"}}
+	cfg25 := getMinimalConfig()
+	cfg25.RemediationPolicies = []Policy{{Scenario: "crowdsecurity/http-crawl-non_statics", Action: "captcha"}}
+	cfg26 := getMinimalConfig()
+	cfg26.DryRunEnabled = true
+	cfg26.DryRunRemediations = []string{"Ban"}
+	cfg27 := getMinimalConfig()
+	cfg27.DryRunRemediations = []string{"redirect"}
+	cfg28 := getMinimalConfig()
+	cfg28.RedirectURL = "https://portal.example.com/denied"
+	cfg28.RedirectSecret = "a-secret-long-enough-for-hmac-sha256"
+	cfg28.RemediationPolicies = []Policy{{Origin: "lists:*", Action: "redirect"}}
+	cfg29 := getMinimalConfig()
+	cfg29.RedirectURL = "https://portal.example.com/denied"
+	cfg29.RedirectSecret = "a-secret-long-enough-for-hmac-sha256"
+	cfg29.RedirectStatusCode = 301
+	cfg30 := getMinimalConfig()
+	cfg30.RemediationPolicies = []Policy{{Action: "redirect"}}
+	cfg31 := getMinimalConfig()
+	cfg31.RemediationPolicies = []Policy{{Scenario: "crowdsecurity/http-probing", Action: "tarpit"}}
+	cfg31.TarpitDelaySeconds = 60
+	cfg32 := getMinimalConfig()
+	cfg32.RemediationPolicies = []Policy{{Scenario: "crowdsecurity/http-probing", Action: "tarpit"}}
+	cfg32.TarpitMaxConnections = 0
+	cfg33 := getMinimalConfig()
+	cfg33.RemediationPolicies = []Policy{{Origin: "lists:*", Action: "throttle"}}
+	cfg33.ThrottlePeriodSeconds = 0
+	cfg34 := getMinimalConfig()
+	cfg34.RemediationGRPCStatusCode = 0
+	cfg35 := getMinimalConfig()
+	cfg35.BanJSONFilePath = "/nonexistent/ban.json"
+	cfg36 := getMinimalConfig()
+	cfg36.DefaultLanguage = "en_US"
+	cfg37 := getMinimalConfig()
+	cfg37.CaptchaProvider = TurnstileProvider
+	cfg37.CaptchaHTMLFilePath = "../../captcha.html"
+	cfg37.HostOverrides = []Host{
+		{Host: "shop.example.com", BanHTMLFilePath: "../../ban.html", CaptchaSiteKey: "site", CaptchaSecretKey: "secret"},
+		{Host: "*.example.com", CaptchaHTMLFilePath: "../../captcha.html"},
+	}
+	cfg38 := getMinimalConfig()
+	cfg38.HostOverrides = []Host{{BanHTMLFilePath: "../../ban.html"}}
+	cfg39 := getMinimalConfig()
+	cfg39.CaptchaProvider = TurnstileProvider
+	cfg39.CaptchaHTMLFilePath = "../../captcha.html"
+	cfg39.HostOverrides = []Host{{Host: "shop.example.com", CaptchaSiteKey: "site"}}
+	cfg40 := getMinimalConfig()
+	cfg40.HostOverrides = []Host{{Host: "shop.example.com", CaptchaHTMLFilePath: "../../captcha.html"}}
+	cfg41 := getMinimalConfig()
+	cfg41.BanContentSecurityPolicy = "default-src 'none';\r\nX-Injected: true"
+	cfg42 := getMinimalConfig()
+	cfg42.CaptchaProvider = PowProvider
+	cfg42.CaptchaSecretKey = "0123456789abcdef0123456789abcdef"
+	cfg42.CaptchaHTMLFilePath = "../../captcha.html"
+	cfg43 := getMinimalConfig()
+	cfg43.CaptchaProvider = PowProvider
+	cfg43.CaptchaSecretKey = "short"
+	cfg43.CaptchaHTMLFilePath = "../../captcha.html"
+	cfg44 := getMinimalConfig()
+	cfg44.CaptchaProvider = PowProvider
+	cfg44.CaptchaSecretKey = "0123456789abcdef0123456789abcdef"
+	cfg44.CaptchaHTMLFilePath = "../../captcha.html"
+	cfg44.CaptchaPowDifficulty = 33
+	cfg45 := getMinimalConfig()
+	cfg45.RequestRules = []Rule{{PathPrefix: "/login", Action: "bypass", Remediations: []string{"captcha"}}}
+	cfg46 := getMinimalConfig()
+	cfg46.TarpitMaxConnections = 0
+	cfg46.ThrottleRequests = 0
+	cfg46.ThrottlePeriodSeconds = 0
 	type args struct {
 		config *Config
 	}
@@ -114,6 +221,42 @@ func Test_ValidateParams(t *testing.T) {
 		{name: "Valid log level uppercase INFO", args: args{config: cfg8}, wantErr: false},
 		{name: "Valid log level lowercase info", args: args{config: cfg9}, wantErr: false},
 		{name: "Invalid log level Warning", args: args{config: cfg10}, wantErr: true},
+		{name: "Not validate file cache with redis cache", args: args{config: cfg11}, wantErr: true},
+		{name: "Not validate file cache in a missing directory", args: args{config: cfg12}, wantErr: true},
+		{name: "Not validate country lists without database", args: args{config: cfg13}, wantErr: true},
+		{name: "Validate country allow list", args: args{config: cfg14}, wantErr: false},
+		{name: "Not validate a country name instead of its code", args: args{config: cfg15}, wantErr: true},
+		{name: "Not validate an invalid ASN database", args: args{config: cfg16}, wantErr: true},
+		{name: "Validate custom scopes", args: args{config: cfg17}, wantErr: false},
+		{name: "Not validate a reserved custom scope", args: args{config: cfg18}, wantErr: true},
+		{name: "Not validate a short bypass token secret", args: args{config: cfg19}, wantErr: true},
+		{name: "Validate bypass rules", args: args{config: cfg20}, wantErr: false},
+		{name: "Validate request rules", args: args{config: cfg21}, wantErr: false},
+		{name: "Not validate a request rule with an unknown action", args: args{config: cfg22}, wantErr: true},
+		{name: "Not validate allowlists in alone mode", args: args{config: cfg23}, wantErr: true},
+		{name: "Validate remediation policies", args: args{config: cfg24}, wantErr: false},
+		{name: "Not validate a captcha policy without captcha provider", args: args{config: cfg25}, wantErr: true},
+		{name: "Validate dry run of bans", args: args{config: cfg26}, wantErr: false},
+		{name: "Not validate dry run of an unknown remediation", args: args{config: cfg27}, wantErr: true},
+		{name: "Validate redirect", args: args{config: cfg28}, wantErr: false},
+		{name: "Not validate a permanent redirect", args: args{config: cfg29}, wantErr: true},
+		{name: "Not validate a redirect policy without redirect URL", args: args{config: cfg30}, wantErr: true},
+		{name: "Validate tarpit", args: args{config: cfg31}, wantErr: false},
+		{name: "Not validate a tarpit without connections", args: args{config: cfg32}, wantErr: true},
+		{name: "Not validate a throttle without period", args: args{config: cfg33}, wantErr: true},
+		{name: "Not validate the gRPC OK status", args: args{config: cfg34}, wantErr: true},
+		{name: "Not validate a missing JSON ban template", args: args{config: cfg35}, wantErr: true},
+		{name: "Not validate a default language with underscore", args: args{config: cfg36}, wantErr: true},
+		{name: "Validate host overrides", args: args{config: cfg37}, wantErr: false},
+		{name: "Not validate a host override without host", args: args{config: cfg38}, wantErr: true},
+		{name: "Not validate a host site key without secret key", args: args{config: cfg39}, wantErr: true},
+		{name: "Not validate a host captcha template without provider", args: args{config: cfg40}, wantErr: true},
+		{name: "Not validate a multiline content security policy", args: args{config: cfg41}, wantErr: true},
+		{name: "Validate the pow captcha", args: args{config: cfg42}, wantErr: false},
+		{name: "Not validate the pow captcha with a short secret", args: args{config: cfg43}, wantErr: true},
+		{name: "Not validate the pow captcha with a too high difficulty", args: args{config: cfg44}, wantErr: true},
+		{name: "Not validate remediations of a request rule without the enforce action", args: args{config: cfg45}, wantErr: true},
+		{name: "Validate tarpit and throttle settings unused by the policies", args: args{config: cfg46}, wantErr: false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -124,6 +267,51 @@ func Test_ValidateParams(t *testing.T) {
 	}
 }
 
+func Test_GetHTMLTemplates(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"ban.html":        "banned",
+		"ban.fr.html":     "banni",
+		"ban.pt-BR.html":  "banido",
+		"ban.fr.html.bak": "old",
+		"ban.fr_FR.html":  "invalid language",
+		"broken.html":     "{{ .",
+		"broken.de.html":  "{{ .",
+		"captcha.fr.html": "without template",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		path    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "Template with translations", path: filepath.Join(dir, "ban.html"), want: []string{"", "fr", "pt-br"}},
+		{name: "Broken template", path: filepath.Join(dir, "broken.html"), wantErr: true},
+		{name: "Missing template", path: filepath.Join(dir, "captcha.html"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templates, err := GetHTMLTemplates(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetHTMLTemplates() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := []string{}
+			for lang := range templates {
+				got = append(got, lang)
+			}
+			sort.Strings(got)
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetHTMLTemplates() languages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_validateParamsTLS(t *testing.T) {
 	type args struct {
 		config *Config
@@ -0,0 +1,577 @@
+// Package geo implements a reader of MaxMind DB files (GeoLite2 / GeoIP2 Country and ASN).
+// It only relies on the standard library, following https://maxmind.github.io/MaxMind-DB/.
+package geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metadataMaxSize      = 128 * 1024
+	dataSectionSeparator = 16
+)
+
+//nolint:gochecknoglobals
+var (
+	metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+	readersMu      sync.Mutex
+	readers        = map[string]cachedReader{}
+)
+
+// Data types of the MaxMind DB format.
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEnd       = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+// Reader MaxMind DB reader, the whole file is kept in memory.
+// The country and the ASN are cached by record, as the networks of a country or an AS share their record.
+type Reader struct {
+	buffer       []byte
+	data         []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	ipv4Start    uint
+	DatabaseType string
+	cacheMu      sync.RWMutex
+	countries    map[uint]string
+	asns         map[uint]uint
+}
+
+// cachedReader Reader of a file, with the modification time and the size of the file when it was loaded.
+type cachedReader struct {
+	reader  *Reader
+	modTime time.Time
+	size    int64
+}
+
+// Open reads and parses a MaxMind DB file.
+// A file is loaded once and its Reader is shared by every caller, as a database can weigh several MB.
+// A file updated on disk (modification time or size changed) is loaded again and replaces the previous Reader.
+func Open(path string) (*Reader, error) {
+	path = filepath.Clean(path)
+	readersMu.Lock()
+	defer readersMu.Unlock()
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("geo:Open %w", err)
+	}
+	if cached, ok := readers[path]; ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.reader, nil
+	}
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("geo:Open %w", err)
+	}
+	reader, err := New(buffer)
+	if err != nil {
+		return nil, err
+	}
+	readers[path] = cachedReader{reader: reader, modTime: info.ModTime(), size: info.Size()}
+	return reader, nil
+}
+
+// New parses a MaxMind DB from its content.
+func New(buffer []byte) (*Reader, error) {
+	start := len(buffer) - metadataMaxSize
+	if start < 0 {
+		start = 0
+	}
+	index := bytes.LastIndex(buffer[start:], metadataMarker)
+	if index < 0 {
+		return nil, errors.New("geo:New metadata not found, not a MaxMind DB file")
+	}
+	metadataStart := start + index + len(metadataMarker)
+	metadataDecoder := &decoder{buffer: buffer[metadataStart:]}
+	rawMetadata, _, err := metadataDecoder.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("geo:New metadata %w", err)
+	}
+	metadata, ok := rawMetadata.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("geo:New metadata is not a map")
+	}
+
+	reader := &Reader{buffer: buffer, countries: map[uint]string{}, asns: map[uint]uint{}}
+	reader.nodeCount = toUint(metadata["node_count"])
+	reader.recordSize = toUint(metadata["record_size"])
+	reader.ipVersion = toUint(metadata["ip_version"])
+	reader.DatabaseType, _ = metadata["database_type"].(string)
+	if reader.recordSize != 24 && reader.recordSize != 28 && reader.recordSize != 32 {
+		return nil, fmt.Errorf("geo:New unsupported record size %d", reader.recordSize)
+	}
+	treeSize := reader.nodeCount * reader.recordSize / 4
+	if treeSize+dataSectionSeparator > uint(start+index) {
+		return nil, errors.New("geo:New search tree larger than the file")
+	}
+	reader.data = buffer[treeSize+dataSectionSeparator : start+index]
+
+	// IPv4 addresses are stored in IPv6 trees under ::/96.
+	if reader.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < reader.nodeCount; i++ {
+			node = reader.record(node, 0)
+		}
+		reader.ipv4Start = node
+	}
+	return reader, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (r *Reader) record(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		b := r.buffer[offset : offset+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buffer[node*7 : node*7+7]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		offset := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.buffer[offset : offset+4]))
+	}
+}
+
+// Lookup returns the record of an address, or nil if the address is not in the database.
+func (r *Reader) Lookup(addr netip.Addr) (map[string]interface{}, error) {
+	offset, found, err := r.recordOffset(addr)
+	if err != nil || !found {
+		return nil, err
+	}
+	value, _, err := (&decoder{buffer: r.data}).decode(offset)
+	if err != nil {
+		return nil, fmt.Errorf("geo:Lookup %w", err)
+	}
+	record, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("geo:Lookup record is not a map")
+	}
+	return record, nil
+}
+
+// recordOffset returns the offset of the record of an address in the data section,
+// and false if the address is not in the database.
+func (r *Reader) recordOffset(addr netip.Addr) (uint, bool, error) {
+	addr = addr.Unmap()
+	var ipBytes []byte
+	node := uint(0)
+	if addr.Is4() {
+		v4 := addr.As4()
+		ipBytes = v4[:]
+		node = r.ipv4Start
+	} else {
+		if r.ipVersion == 4 {
+			return 0, false, nil
+		}
+		v6 := addr.As16()
+		ipBytes = v6[:]
+	}
+
+	for i := 0; i < len(ipBytes)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(ipBytes[i/8]>>(7-uint(i%8))&1))
+	}
+	if node == r.nodeCount {
+		return 0, false, nil
+	}
+	if node < r.nodeCount {
+		return 0, false, errors.New("geo:Lookup invalid search tree")
+	}
+	offset := node - r.nodeCount - dataSectionSeparator
+	if offset >= uint(len(r.data)) {
+		return 0, false, errors.New("geo:Lookup invalid data pointer")
+	}
+	return offset, true, nil
+}
+
+// Country returns the ISO code of the country of an address (GeoLite2-Country or City database),
+// or the empty string if unknown. Only the iso_code of the record is decoded.
+func (r *Reader) Country(addr netip.Addr) (string, error) {
+	offset, found, err := r.recordOffset(addr)
+	if err != nil || !found {
+		return "", err
+	}
+	r.cacheMu.RLock()
+	isoCode, ok := r.countries[offset]
+	r.cacheMu.RUnlock()
+	if ok {
+		return isoCode, nil
+	}
+	d := &decoder{buffer: r.data}
+	for _, key := range []string{"country", "registered_country"} {
+		value, errPath := d.decodePath(offset, key, "iso_code")
+		if errPath != nil {
+			return "", fmt.Errorf("geo:Country %w", errPath)
+		}
+		if isoCode, ok = value.(string); ok {
+			break
+		}
+	}
+	r.cacheMu.Lock()
+	r.countries[offset] = isoCode
+	r.cacheMu.Unlock()
+	return isoCode, nil
+}
+
+// ASN returns the autonomous system number of an address (GeoLite2-ASN database), or 0 if unknown.
+// Only the autonomous_system_number of the record is decoded.
+func (r *Reader) ASN(addr netip.Addr) (uint, error) {
+	offset, found, err := r.recordOffset(addr)
+	if err != nil || !found {
+		return 0, err
+	}
+	r.cacheMu.RLock()
+	asn, ok := r.asns[offset]
+	r.cacheMu.RUnlock()
+	if ok {
+		return asn, nil
+	}
+	value, err := (&decoder{buffer: r.data}).decodePath(offset, "autonomous_system_number")
+	if err != nil {
+		return 0, fmt.Errorf("geo:ASN %w", err)
+	}
+	asn = toUint(value)
+	r.cacheMu.Lock()
+	r.asns[offset] = asn
+	r.cacheMu.Unlock()
+	return asn, nil
+}
+
+func toUint(value interface{}) uint {
+	switch v := value.(type) {
+	case uint64:
+		return uint(v)
+	case int64:
+		if v > 0 {
+			return uint(v)
+		}
+	}
+	return 0
+}
+
+// KEYS
+
+// CountryKey returns the cache key of the decisions on a country (ISO 3166-1 alpha-2 code).
+func CountryKey(isoCode string) string {
+	return "country:" + strings.ToUpper(strings.TrimSpace(isoCode))
+}
+
+// ASKey returns the cache key of the decisions on an autonomous system,
+// the number can be prefixed by AS (ex: AS64496 or 64496).
+func ASKey(asn string) string {
+	asn = strings.TrimSpace(asn)
+	if len(asn) > 2 && strings.EqualFold(asn[:2], "AS") {
+		asn = asn[2:]
+	}
+	return "as:" + asn
+}
+
+// DECODER
+
+// decodeMaxDepth bounds the nesting of maps, arrays and pointers, a corrupt database cannot overflow the stack.
+const decodeMaxDepth = 512
+
+type decoder struct {
+	buffer []byte
+	depth  int
+}
+
+// enter counts a nesting level, leave must be called when it is decoded.
+func (d *decoder) enter() error {
+	if d.depth >= decodeMaxDepth {
+		return errors.New("decode maximum depth exceeded")
+	}
+	d.depth++
+	return nil
+}
+
+func (d *decoder) leave() {
+	d.depth--
+}
+
+// decode returns the value at offset and the offset following it.
+//
+//nolint:gocyclo
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	if err := d.enter(); err != nil {
+		return nil, 0, err
+	}
+	defer d.leave()
+	dataType, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if dataType == typePointer {
+		pointer, next, errPointer := d.decodePointer(size, offset)
+		if errPointer != nil {
+			return nil, 0, errPointer
+		}
+		// The value pointed is decoded, but the decoding continues after the pointer itself.
+		value, _, errValue := d.decode(pointer)
+		return value, next, errValue
+	}
+	switch dataType {
+	case typeMap:
+		return d.decodeMap(size, offset)
+	case typeArray:
+		return d.decodeArray(size, offset)
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	end := offset + size
+	if end > uint(len(d.buffer)) {
+		return nil, 0, fmt.Errorf("decode type:%d size:%d out of buffer", dataType, size)
+	}
+	value := d.buffer[offset:end]
+	switch dataType {
+	case typeString:
+		return string(value), end, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("decode invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(value)), end, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("decode invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(value))), end, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), value...), end, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("decode invalid uint size %d", size)
+		}
+		var number uint64
+		for _, b := range value {
+			number = number<<8 | uint64(b)
+		}
+		return number, end, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("decode invalid int32 size %d", size)
+		}
+		var number uint32
+		for _, b := range value {
+			number = number<<8 | uint32(b)
+		}
+		if size == 4 {
+			return int64(int32(number)), end, nil
+		}
+		return int64(number), end, nil
+	default:
+		return nil, 0, fmt.Errorf("decode unsupported type %d", dataType)
+	}
+}
+
+// decodeControl returns the type and the size of the value at offset, and the offset of its payload.
+func (d *decoder) decodeControl(offset uint) (int, uint, uint, error) {
+	if offset >= uint(len(d.buffer)) {
+		return 0, 0, 0, errors.New("decode offset out of buffer")
+	}
+	control := d.buffer[offset]
+	offset++
+	dataType := int(control >> 5)
+	if dataType == typePointer {
+		return dataType, uint(control & 0x1F), offset, nil
+	}
+	if dataType == typeExtended {
+		if offset >= uint(len(d.buffer)) {
+			return 0, 0, 0, errors.New("decode extended type out of buffer")
+		}
+		dataType = 7 + int(d.buffer[offset])
+		offset++
+	}
+	size := uint(control & 0x1F)
+	if size >= 29 {
+		bytesCount := size - 28
+		if offset+bytesCount > uint(len(d.buffer)) {
+			return 0, 0, 0, errors.New("decode size out of buffer")
+		}
+		var extra uint
+		for _, b := range d.buffer[offset : offset+bytesCount] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += bytesCount
+		switch size {
+		case 29:
+			size = 29 + extra
+		case 30:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+	return dataType, size, offset, nil
+}
+
+// decodePointer returns the offset pointed and the offset following the pointer.
+func (d *decoder) decodePointer(size, offset uint) (uint, uint, error) {
+	pointerSize := (size>>3)&0x3 + 1
+	if offset+pointerSize > uint(len(d.buffer)) {
+		return 0, 0, errors.New("decode pointer out of buffer")
+	}
+	var pointer uint
+	if pointerSize != 4 {
+		pointer = size & 0x7
+	}
+	for _, b := range d.buffer[offset : offset+pointerSize] {
+		pointer = pointer<<8 | uint(b)
+	}
+	switch pointerSize {
+	case 2:
+		pointer += 2048
+	case 3:
+		pointer += 526336
+	}
+	return pointer, offset + pointerSize, nil
+}
+
+// decodePath decodes the value at the path of keys in the maps from offset, or returns nil if it is missing.
+// The values off the path are skipped without being decoded.
+func (d *decoder) decodePath(offset uint, path ...string) (interface{}, error) {
+	for _, key := range path {
+		dataType, size, next, err := d.resolve(offset)
+		if err != nil {
+			return nil, err
+		}
+		if dataType != typeMap {
+			return nil, nil
+		}
+		found := false
+		for i := uint(0); i < size && !found; i++ {
+			keyType, keySize, keyOffset, errKey := d.resolve(next)
+			if errKey != nil {
+				return nil, errKey
+			}
+			if keyType != typeString || keyOffset+keySize > uint(len(d.buffer)) {
+				return nil, errors.New("decode map key is not a string")
+			}
+			if next, err = d.skip(next); err != nil {
+				return nil, err
+			}
+			if string(d.buffer[keyOffset:keyOffset+keySize]) == key {
+				offset, found = next, true
+				continue
+			}
+			if next, err = d.skip(next); err != nil {
+				return nil, err
+			}
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+	value, _, err := d.decode(offset)
+	return value, err
+}
+
+// resolve returns the type, the size and the offset of the payload of the value at offset, following a pointer.
+func (d *decoder) resolve(offset uint) (int, uint, uint, error) {
+	dataType, size, offset, err := d.decodeControl(offset)
+	if err != nil || dataType != typePointer {
+		return dataType, size, offset, err
+	}
+	pointer, _, err := d.decodePointer(size, offset)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	// A pointer cannot point to a pointer.
+	return d.decodeControl(pointer)
+}
+
+// skip returns the offset following the value at offset, without decoding it.
+func (d *decoder) skip(offset uint) (uint, error) {
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+	dataType, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return 0, err
+	}
+	switch dataType {
+	case typePointer:
+		_, next, errPointer := d.decodePointer(size, offset)
+		return next, errPointer
+	case typeMap, typeArray:
+		count := size
+		if dataType == typeMap {
+			count *= 2
+		}
+		for i := uint(0); i < count; i++ {
+			if offset, err = d.skip(offset); err != nil {
+				return 0, err
+			}
+		}
+		return offset, nil
+	case typeBool:
+		return offset, nil
+	}
+	if offset+size > uint(len(d.buffer)) {
+		return 0, fmt.Errorf("decode type:%d size:%d out of buffer", dataType, size)
+	}
+	return offset + size, nil
+}
+
+func (d *decoder) decodeMap(size, offset uint) (interface{}, uint, error) {
+	values := make(map[string]interface{}, size)
+	for i := uint(0); i < size; i++ {
+		rawKey, next, err := d.decode(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		key, ok := rawKey.(string)
+		if !ok {
+			return nil, 0, errors.New("decode map key is not a string")
+		}
+		values[key], offset, err = d.decode(next)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return values, offset, nil
+}
+
+func (d *decoder) decodeArray(size, offset uint) (interface{}, uint, error) {
+	values := make([]interface{}, 0, size)
+	for i := uint(0); i < size; i++ {
+		var value interface{}
+		var err error
+		value, offset, err = d.decode(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		values = append(values, value)
+	}
+	return values, offset, nil
+}
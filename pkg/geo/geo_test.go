@@ -0,0 +1,526 @@
+package geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+//nolint:gochecknoglobals
+var update = flag.Bool("update", false, "regenerate the fixture databases of the tests folder")
+
+type fixtureEntry struct {
+	prefix string
+	record map[string]interface{}
+}
+
+//nolint:gochecknoglobals
+var (
+	countryEntries = []fixtureEntry{
+		{prefix: "192.0.2.0/24", record: map[string]interface{}{"country": map[string]interface{}{"iso_code": "FR"}}},
+		{prefix: "198.51.100.0/24", record: map[string]interface{}{"country": map[string]interface{}{"iso_code": "US"}}},
+		{prefix: "203.0.113.0/25", record: map[string]interface{}{"registered_country": map[string]interface{}{"iso_code": "JP"}}},
+		{prefix: "2001:db8:1::/48", record: map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}}},
+	}
+	asnEntries = []fixtureEntry{
+		{prefix: "192.0.2.0/24", record: map[string]interface{}{"autonomous_system_number": uint32(64496), "autonomous_system_organization": "Example FR"}},
+		{prefix: "198.51.100.0/24", record: map[string]interface{}{"autonomous_system_number": uint32(64497), "autonomous_system_organization": "Example US"}},
+		{prefix: "2001:db8:1::/48", record: map[string]interface{}{"autonomous_system_number": uint32(64498), "autonomous_system_organization": "Example DE"}},
+	}
+)
+
+// WRITER
+
+type writerNode struct {
+	children [2]*writerNode
+	data     [2]int
+}
+
+// buildDatabase writes a minimal MaxMind DB holding the entries, IPv4 prefixes are stored under ::/96.
+func buildDatabase(t *testing.T, databaseType string, recordSize, ipVersion int, entries []fixtureEntry) []byte {
+	t.Helper()
+	var data bytes.Buffer
+	root := &writerNode{data: [2]int{-1, -1}}
+	for _, entry := range entries {
+		prefix := netip.MustParsePrefix(entry.prefix)
+		var address []byte
+		bits := prefix.Bits()
+		if ipVersion == 4 {
+			v4 := prefix.Addr().As4()
+			address = v4[:]
+		} else if prefix.Addr().Is4() {
+			v4 := prefix.Addr().As4()
+			address = append(make([]byte, 12), v4[:]...)
+			bits += 96
+		} else {
+			v6 := prefix.Addr().As16()
+			address = v6[:]
+		}
+		node := root
+		for i := 0; i < bits; i++ {
+			bit := address[i/8] >> (7 - uint(i%8)) & 1
+			if i == bits-1 {
+				node.data[bit] = data.Len()
+				break
+			}
+			if node.children[bit] == nil {
+				node.children[bit] = &writerNode{data: [2]int{-1, -1}}
+			}
+			node = node.children[bit]
+		}
+		encode(t, &data, entry.record)
+	}
+
+	nodes := []*writerNode{root}
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	index := map[*writerNode]int{}
+	for i, node := range nodes {
+		index[node] = i
+	}
+	nodeCount := len(nodes)
+	var tree bytes.Buffer
+	for _, node := range nodes {
+		var records [2]uint32
+		for bit := 0; bit < 2; bit++ {
+			switch {
+			case node.children[bit] != nil:
+				records[bit] = uint32(index[node.children[bit]])
+			case node.data[bit] >= 0:
+				records[bit] = uint32(nodeCount + dataSectionSeparator + node.data[bit])
+			default:
+				records[bit] = uint32(nodeCount)
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree.Write([]byte{byte(records[0] >> 16), byte(records[0] >> 8), byte(records[0])})
+			tree.Write([]byte{byte(records[1] >> 16), byte(records[1] >> 8), byte(records[1])})
+		case 28:
+			tree.Write([]byte{
+				byte(records[0] >> 16), byte(records[0] >> 8), byte(records[0]),
+				byte(records[0]>>20)&0xF0 | byte(records[1]>>24)&0x0F,
+				byte(records[1] >> 16), byte(records[1] >> 8), byte(records[1]),
+			})
+		default:
+			_ = binary.Write(&tree, binary.BigEndian, records)
+		}
+	}
+
+	var database bytes.Buffer
+	database.Write(tree.Bytes())
+	database.Write(make([]byte, dataSectionSeparator))
+	database.Write(data.Bytes())
+	database.Write(metadataMarker)
+	encode(t, &database, map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(ipVersion),
+		"database_type":               databaseType,
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+	})
+	return database.Bytes()
+}
+
+func encodeControl(buffer *bytes.Buffer, dataType, size int) {
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		sizeBytes = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		sizeBytes = []byte{byte((size - 285) >> 8), byte(size - 285)}
+		size = 30
+	default:
+		sizeBytes = []byte{byte((size - 65821) >> 16), byte((size - 65821) >> 8), byte(size - 65821)}
+		size = 31
+	}
+	if dataType > typeMap {
+		buffer.Write([]byte{byte(size), byte(dataType - 7)})
+	} else {
+		buffer.WriteByte(byte(dataType<<5 | size))
+	}
+	buffer.Write(sizeBytes)
+}
+
+func encodeUint(buffer *bytes.Buffer, dataType int, value uint64) {
+	var payload []byte
+	for ; value > 0; value >>= 8 {
+		payload = append([]byte{byte(value)}, payload...)
+	}
+	encodeControl(buffer, dataType, len(payload))
+	buffer.Write(payload)
+}
+
+func encode(t *testing.T, buffer *bytes.Buffer, value interface{}) {
+	t.Helper()
+	switch v := value.(type) {
+	case string:
+		encodeControl(buffer, typeString, len(v))
+		buffer.WriteString(v)
+	case uint16:
+		encodeUint(buffer, typeUint16, uint64(v))
+	case uint32:
+		encodeUint(buffer, typeUint32, uint64(v))
+	case uint64:
+		encodeUint(buffer, typeUint64, v)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		encodeControl(buffer, typeBool, size)
+	case []interface{}:
+		encodeControl(buffer, typeArray, len(v))
+		for _, item := range v {
+			encode(t, buffer, item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		encodeControl(buffer, typeMap, len(v))
+		for _, key := range keys {
+			encode(t, buffer, key)
+			encode(t, buffer, v[key])
+		}
+	default:
+		t.Fatalf("encode: unsupported type %T", value)
+	}
+}
+
+// TESTS
+
+func TestFixtures(t *testing.T) {
+	fixtures := map[string][]byte{
+		"../../tests/GeoLite2-Country-Test.mmdb": buildDatabase(t, "GeoLite2-Country", 24, 6, countryEntries),
+		"../../tests/GeoLite2-ASN-Test.mmdb":     buildDatabase(t, "GeoLite2-ASN", 28, 6, asnEntries),
+	}
+	for path, want := range fixtures {
+		if *update {
+			if err := os.WriteFile(path, want, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read fixture %s: %v (run go test ./pkg/geo -update)", path, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("fixture %s is outdated, run go test ./pkg/geo -update", path)
+		}
+	}
+}
+
+func TestCountry(t *testing.T) {
+	reader, err := Open("../../tests/GeoLite2-Country-Test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.DatabaseType != "GeoLite2-Country" {
+		t.Errorf("DatabaseType = %v, want GeoLite2-Country", reader.DatabaseType)
+	}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{addr: "192.0.2.1", want: "FR"},
+		{addr: "192.0.2.255", want: "FR"},
+		{addr: "::ffff:192.0.2.10", want: "FR"},
+		{addr: "198.51.100.7", want: "US"},
+		{addr: "203.0.113.1", want: "JP"},
+		{addr: "203.0.113.200", want: ""},
+		{addr: "192.0.3.1", want: ""},
+		{addr: "2001:db8:1:2::1", want: "DE"},
+		{addr: "2001:db8:2::1", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := reader.Country(netip.MustParseAddr(tt.addr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Country() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestASN(t *testing.T) {
+	reader, err := Open("../../tests/GeoLite2-ASN-Test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]uint{
+		"192.0.2.1":       64496,
+		"198.51.100.255":  64497,
+		"2001:db8:1::abc": 64498,
+		"203.0.113.1":     0,
+	}
+	for addr, want := range tests {
+		got, err := reader.ASN(netip.MustParseAddr(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("ASN(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	record, _ := reader.Lookup(netip.MustParseAddr("192.0.2.1"))
+	if record["autonomous_system_organization"] != "Example FR" {
+		t.Errorf("Lookup() = %v", record)
+	}
+}
+
+func TestRecordSizes(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordSize int
+		ipVersion  int
+	}{
+		{name: "24 bits IPv6", recordSize: 24, ipVersion: 6},
+		{name: "28 bits IPv6", recordSize: 28, ipVersion: 6},
+		{name: "32 bits IPv6", recordSize: 32, ipVersion: 6},
+		{name: "32 bits IPv4", recordSize: 32, ipVersion: 4},
+	}
+	entries := []fixtureEntry{
+		{prefix: "192.0.2.0/24", record: map[string]interface{}{"country": map[string]interface{}{"iso_code": "FR"}}},
+		{prefix: "198.51.100.128/25", record: map[string]interface{}{"country": map[string]interface{}{"iso_code": "US"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := New(buildDatabase(t, "Test", tt.recordSize, tt.ipVersion, entries))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for addr, want := range map[string]string{"192.0.2.3": "FR", "198.51.100.200": "US", "198.51.100.1": "", "2001:db8::1": ""} {
+				if got, _ := reader.Country(netip.MustParseAddr(addr)); got != want {
+					t.Errorf("Country(%s) = %v, want %v", addr, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	if _, err := New([]byte("not a database")); err == nil {
+		t.Error("New() expected an error without metadata")
+	}
+	database := buildDatabase(t, "Test", 24, 6, countryEntries)
+	if _, err := New(database[len(database)-200:]); err == nil {
+		t.Error("New() expected an error on a truncated search tree")
+	}
+	if _, err := Open("../../tests/missing.mmdb"); err == nil {
+		t.Error("Open() expected an error on a missing file")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "GeoLite2-Country.mmdb")
+	if err := os.WriteFile(path, buildDatabase(t, "GeoLite2-Country", 24, 6, countryEntries), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	first, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := Open(path); again != first {
+		t.Error("Open() expected the Reader of an unchanged file to be shared")
+	}
+
+	if err = os.WriteFile(path, buildDatabase(t, "GeoLite2-Country", 28, 6, countryEntries), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Minute)
+	if err = os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated == first || updated.recordSize != 28 {
+		t.Errorf("Open() expected the updated file to be loaded again, got record size %d", updated.recordSize)
+	}
+}
+
+func Test_decode(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer []byte
+		offset uint
+		want   interface{}
+		next   uint
+	}{
+		{name: "String", buffer: []byte{0x42, 'F', 'R'}, want: "FR", next: 3},
+		{name: "Long string", buffer: append([]byte{0x5D, 1}, bytes.Repeat([]byte{'a'}, 30)...), want: string(bytes.Repeat([]byte{'a'}, 30)), next: 32},
+		{name: "Uint16", buffer: []byte{0xA2, 0x01, 0x02}, want: uint64(258), next: 3},
+		{name: "Uint32 zero", buffer: []byte{0xC0}, want: uint64(0), next: 1},
+		{name: "Negative int32", buffer: []byte{0x04, 0x01, 0xFF, 0xFF, 0xFF, 0xFE}, want: int64(-2), next: 6},
+		{name: "Bool", buffer: []byte{0x01, 0x07}, want: true, next: 2},
+		{name: "Double", buffer: []byte{0x68, 0x3F, 0xF8, 0, 0, 0, 0, 0, 0}, want: 1.5, next: 9},
+		{name: "Array", buffer: []byte{0x02, 0x04, 0x41, 'a', 0x41, 'b'}, want: []interface{}{"a", "b"}, next: 6},
+		{name: "Pointer", buffer: []byte{0x42, 'F', 'R', 0x20, 0x00}, offset: 3, want: "FR", next: 5},
+		{name: "Map with pointer", buffer: []byte{0x42, 'F', 'R', 0xE1, 0x41, 'k', 0x20, 0x00}, offset: 3, want: map[string]interface{}{"k": "FR"}, next: 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, next, err := (&decoder{buffer: tt.buffer}).decode(tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) || next != tt.next {
+				t.Errorf("decode() = %v, %v, want %v, %v", got, next, tt.want, tt.next)
+			}
+		})
+	}
+	if _, _, err := (&decoder{buffer: []byte{0x44, 'F'}}).decode(0); err == nil {
+		t.Error("decode() expected an error out of buffer")
+	}
+	if _, _, err := (&decoder{buffer: []byte{0x20, 0x00}}).decode(0); err == nil {
+		t.Error("decode() expected an error on a pointer to itself")
+	}
+	nested := append(bytes.Repeat([]byte{0x01, 0x04}, decodeMaxDepth+1), 0x41, 'a')
+	if _, _, err := (&decoder{buffer: nested}).decode(0); err == nil {
+		t.Error("decode() expected an error on too deeply nested arrays")
+	}
+	if _, err := (&decoder{buffer: nested}).skip(0); err == nil {
+		t.Error("skip() expected an error on too deeply nested arrays")
+	}
+}
+
+func Test_decodePath(t *testing.T) {
+	// "FR", then {"a": [1, 2], "k": pointer to "FR"} at 3, then {pointer to "FR": "x"} at 18.
+	buffer := []byte{
+		0x42, 'F', 'R',
+		0xE2, 0x41, 'a', 0x02, 0x04, 0xA1, 0x01, 0xA1, 0x02, 0x41, 'k', 0x20, 0x00,
+		0x41, 'o', // padding
+		0xE1, 0x20, 0x00, 0x41, 'x',
+	}
+	tests := []struct {
+		name   string
+		offset uint
+		path   []string
+		want   interface{}
+	}{
+		{name: "Value after a skipped array", offset: 3, path: []string{"k"}, want: "FR"},
+		{name: "Missing key", offset: 3, path: []string{"missing"}, want: nil},
+		{name: "Path through an array", offset: 3, path: []string{"a", "x"}, want: nil},
+		{name: "Key behind a pointer", offset: 18, path: []string{"FR"}, want: "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&decoder{buffer: buffer}).decodePath(tt.offset, tt.path...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupAllocations(t *testing.T) {
+	country, err := Open("../../tests/GeoLite2-Country-Test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asn, err := Open("../../tests/GeoLite2-ASN-Test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParseAddr("2001:db8:1:2::1")
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = country.Country(addr)
+		_, _ = asn.ASN(addr)
+	})
+	if allocs != 0 {
+		t.Errorf("Country() and ASN() allocs = %v, want 0", allocs)
+	}
+}
+
+func BenchmarkCountry(b *testing.B) {
+	reader, err := Open("../../tests/GeoLite2-Country-Test.mmdb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := netip.MustParseAddr("198.51.100.7")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = reader.Country(addr)
+	}
+}
+
+func BenchmarkASN(b *testing.B) {
+	reader, err := Open("../../tests/GeoLite2-ASN-Test.mmdb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := netip.MustParseAddr("198.51.100.7")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = reader.ASN(addr)
+	}
+}
+
+func Test_decodePointer(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer []byte
+		want   uint
+	}{
+		{name: "Size 1", buffer: []byte{0x21, 0x02}, want: 0x102},
+		{name: "Size 2", buffer: []byte{0x29, 0x00, 0x01}, want: 0x10001 + 2048},
+		{name: "Size 3", buffer: []byte{0x30, 0x00, 0x00, 0x01}, want: 1 + 526336},
+		{name: "Size 4", buffer: []byte{0x3F, 0x00, 0x00, 0x01, 0x00}, want: 256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &decoder{buffer: tt.buffer}
+			dataType, size, offset, err := d.decodeControl(0)
+			if err != nil || dataType != typePointer {
+				t.Fatalf("decodeControl() = %v, %v", dataType, err)
+			}
+			got, next, err := d.decodePointer(size, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || next != uint(len(tt.buffer)) {
+				t.Errorf("decodePointer() = %v, %v, want %v, %v", got, next, tt.want, len(tt.buffer))
+			}
+		})
+	}
+}
+
+func TestKeys(t *testing.T) {
+	if got := CountryKey(" fr "); got != "country:FR" {
+		t.Errorf("CountryKey() = %v", got)
+	}
+	for _, asn := range []string{"64496", "AS64496", "as64496"} {
+		if got := ASKey(asn); got != "as:64496" {
+			t.Errorf("ASKey(%s) = %v", asn, got)
+		}
+	}
+}
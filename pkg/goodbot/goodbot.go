@@ -0,0 +1,186 @@
+// Package goodbot implements the verification of search engine crawlers with forward-confirmed reverse DNS.
+// A request claiming to be a crawler in its User-Agent is verified when the reverse DNS of its IP
+// belongs to the crawler domains and this name resolves back to the same IP.
+package goodbot
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	cache "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/cache"
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+)
+
+const (
+	cacheKeyPrefix     = "goodbot:"
+	verifiedValue      = "v"
+	unverifiedValue    = "u"
+	lookupTimeout      = 2 * time.Second
+	errorCacheDuration = 60
+)
+
+// Defaults are the crawlers verified when none is configured.
+// Sources:
+// - https://developers.google.com/search/docs/crawling-indexing/verifying-googlebot
+// - https://www.bing.com/webmasters/help/how-to-verify-bingbot-3905dc26
+// - https://support.apple.com/en-us/119829
+// - https://yandex.com/support/webmaster/robot-workings/check-yandex-robots.html
+// - https://help.baidu.com/question?prod_id=99&class=476&id=2996
+//
+//nolint:gochecknoglobals
+var Defaults = []string{
+	"googlebot=googlebot.com,google.com,googleusercontent.com",
+	"bingbot=search.msn.com",
+	"applebot=applebot.apple.com",
+	"yandex=yandex.ru,yandex.net,yandex.com",
+	"baiduspider=baidu.com,baidu.jp",
+}
+
+// Resolver resolves names and addresses, it is implemented by *net.Resolver.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type bot struct {
+	token    string
+	suffixes []string
+}
+
+// Verifier verifies crawlers and caches the results.
+type Verifier struct {
+	log          *logger.Log
+	cacheClient  *cache.Client
+	resolver     Resolver
+	cacheSeconds int64
+	bots         []bot
+}
+
+// Parse checks a list of crawler definitions <user-agent token>=<domain>,<domain>
+// (ex: googlebot=googlebot.com,google.com).
+func Parse(definitions []string) error {
+	_, err := parseBots(definitions)
+	return err
+}
+
+func parseBots(definitions []string) ([]bot, error) {
+	bots := make([]bot, 0, len(definitions))
+	for _, definition := range definitions {
+		token, domains, found := strings.Cut(strings.TrimSpace(definition), "=")
+		token = strings.ToLower(strings.TrimSpace(token))
+		if !found || token == "" {
+			return nil, fmt.Errorf("goodbot:parse %q must be <user-agent token>=<domain>,<domain>", definition)
+		}
+		var suffixes []string
+		for _, domain := range strings.Split(domains, ",") {
+			domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+			if domain != "" {
+				suffixes = append(suffixes, domain)
+			}
+		}
+		if len(suffixes) == 0 {
+			return nil, fmt.Errorf("goodbot:parse %q has no domain", definition)
+		}
+		bots = append(bots, bot{token: token, suffixes: suffixes})
+	}
+	return bots, nil
+}
+
+// New creates a Verifier of the crawlers defined, see Parse. The Defaults are used if none is defined.
+func New(log *logger.Log, cacheClient *cache.Client, resolver Resolver, definitions []string, cacheSeconds int64) (*Verifier, error) {
+	if len(definitions) == 0 {
+		definitions = Defaults
+	}
+	bots, err := parseBots(definitions)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{
+		log:          log,
+		cacheClient:  cacheClient,
+		resolver:     resolver,
+		cacheSeconds: cacheSeconds,
+		bots:         bots,
+	}, nil
+}
+
+// claimed returns the crawler claimed by a User-Agent, or nil.
+func (v *Verifier) claimed(userAgent string) *bot {
+	userAgent = strings.ToLower(userAgent)
+	for i := range v.bots {
+		if strings.Contains(userAgent, v.bots[i].token) {
+			return &v.bots[i]
+		}
+	}
+	return nil
+}
+
+// Verify returns true if the User-Agent claims a crawler and the IP belongs to it.
+// Results are cached per crawler and IP, lookup failures are cached for a minute.
+func (v *Verifier) Verify(remoteIP, userAgent string) bool {
+	claimedBot := v.claimed(userAgent)
+	if claimedBot == nil {
+		return false
+	}
+	key := cacheKeyPrefix + claimedBot.token + ":" + remoteIP
+	if value, err := v.cacheClient.Get(key); err == nil {
+		return value == verifiedValue
+	}
+	verified, err := v.lookup(claimedBot, remoteIP)
+	if err != nil {
+		v.log.Debug(fmt.Sprintf("goodbot:Verify ip:%s bot:%s %s", remoteIP, claimedBot.token, err.Error()))
+		v.cacheClient.Set(key, unverifiedValue, errorCacheDuration)
+		return false
+	}
+	v.log.Debug(fmt.Sprintf("goodbot:Verify ip:%s bot:%s verified:%t", remoteIP, claimedBot.token, verified))
+	if verified {
+		v.cacheClient.Set(key, verifiedValue, v.cacheSeconds)
+	} else {
+		v.cacheClient.Set(key, unverifiedValue, v.cacheSeconds)
+	}
+	return verified
+}
+
+// lookup performs the forward-confirmed reverse DNS of an IP for a crawler.
+func (v *Verifier) lookup(claimedBot *bot, remoteIP string) (bool, error) {
+	addr, err := netip.ParseAddr(remoteIP)
+	if err != nil {
+		return false, fmt.Errorf("lookup:parseAddress %w", err)
+	}
+	addr = addr.Unmap()
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	names, err := v.resolver.LookupAddr(ctx, addr.String())
+	if err != nil {
+		return false, fmt.Errorf("lookup:reverse %w", err)
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if !matchDomain(name, claimedBot.suffixes) {
+			continue
+		}
+		hosts, errHost := v.resolver.LookupHost(ctx, name)
+		if errHost != nil {
+			return false, fmt.Errorf("lookup:forward name:%s %w", name, errHost)
+		}
+		for _, host := range hosts {
+			if hostAddr, errParse := netip.ParseAddr(host); errParse == nil && hostAddr.Unmap() == addr {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// matchDomain checks that a name is one of the domains or one of their subdomains.
+func matchDomain(name string, domains []string) bool {
+	for _, domain := range domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
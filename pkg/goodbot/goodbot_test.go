@@ -0,0 +1,252 @@
+package goodbot
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	cache "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/cache"
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+)
+
+// fakeDNS is a minimal DNS server answering A, AAAA and PTR questions from static records.
+type fakeDNS struct {
+	conn    net.PacketConn
+	ptr     map[string]string
+	hosts   map[string][]netip.Addr
+	queries int64
+}
+
+func newFakeDNS(t *testing.T, ptr map[string]string, hosts map[string][]string) *fakeDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeDNS{conn: conn, ptr: map[string]string{}, hosts: map[string][]netip.Addr{}}
+	for ip, name := range ptr {
+		server.ptr[reverseName(netip.MustParseAddr(ip))] = name
+	}
+	for name, ips := range hosts {
+		for _, ip := range ips {
+			server.hosts[name] = append(server.hosts[name], netip.MustParseAddr(ip))
+		}
+	}
+	go server.serve()
+	t.Cleanup(func() { _ = conn.Close() })
+	return server
+}
+
+// resolver returns a Go resolver sending every query to the fake server.
+func (s *fakeDNS) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+func reverseName(addr netip.Addr) string {
+	if addr.Is4() {
+		v4 := addr.As4()
+		return net.IPv4(v4[3], v4[2], v4[1], v4[0]).String() + ".in-addr.arpa"
+	}
+	v6 := addr.As16()
+	var labels []string
+	for i := len(v6) - 1; i >= 0; i-- {
+		labels = append(labels, string("0123456789abcdef"[v6[i]&0x0F]), string("0123456789abcdef"[v6[i]>>4]))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
+
+func encodeName(name string) []byte {
+	var encoded []byte
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
+
+func (s *fakeDNS) serve() {
+	buffer := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.queries, 1)
+		if response := s.answer(buffer[:n]); response != nil {
+			_, _ = s.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *fakeDNS) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	var labels []string
+	offset := 12
+	for offset < len(query) && query[offset] != 0 {
+		length := int(query[offset])
+		if offset+1+length > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	offset++
+	if offset+4 > len(query) {
+		return nil
+	}
+	questionType := binary.BigEndian.Uint16(query[offset:])
+	question := query[12 : offset+4]
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	var answers [][]byte
+	found := false
+	switch questionType {
+	case dnsTypePTR:
+		if ptr, ok := s.ptr[name]; ok {
+			found = true
+			answers = append(answers, encodeName(ptr))
+		}
+	case dnsTypeA, dnsTypeAAAA:
+		addrs, ok := s.hosts[name]
+		found = ok
+		for _, addr := range addrs {
+			if addr.Is4() && questionType == dnsTypeA {
+				v4 := addr.As4()
+				answers = append(answers, v4[:])
+			} else if addr.Is6() && questionType == dnsTypeAAAA {
+				v6 := addr.As16()
+				answers = append(answers, v6[:])
+			}
+		}
+	}
+
+	response := make([]byte, 12, 512)
+	copy(response, query[:2])
+	flags := uint16(0x8180)
+	if !found {
+		flags |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(response[2:], flags)
+	binary.BigEndian.PutUint16(response[4:], 1)
+	binary.BigEndian.PutUint16(response[6:], uint16(len(answers)))
+	response = append(response, question...)
+	for _, rdata := range answers {
+		record := []byte{0xC0, 0x0C, 0, 0, 0, 1, 0, 0, 0x0E, 0x10, 0, 0}
+		binary.BigEndian.PutUint16(record[2:], questionType)
+		binary.BigEndian.PutUint16(record[10:], uint16(len(rdata)))
+		response = append(response, record...)
+		response = append(response, rdata...)
+	}
+	return response
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	server := newFakeDNS(t,
+		map[string]string{
+			"66.249.66.1":          "crawl-66-249-66-1.googlebot.com.",
+			"203.0.113.5":          "crawl.example.com.",
+			"203.0.113.6":          "fake.googlebot.com.",
+			"2001:4860:4801:10::1": "crawl-2001-4860-4801-10--1.googlebot.com.",
+			"157.55.39.1":          "msnbot-157-55-39-1.search.msn.com.",
+		},
+		map[string][]string{
+			"crawl-66-249-66-1.googlebot.com":          {"66.249.66.1"},
+			"crawl.example.com":                        {"203.0.113.5"},
+			"fake.googlebot.com":                       {"66.249.66.2"},
+			"crawl-2001-4860-4801-10--1.googlebot.com": {"2001:4860:4801:10::1"},
+			"msnbot-157-55-39-1.search.msn.com":        {"157.55.39.1"},
+		},
+	)
+	log := logger.New("INFO", "")
+	cacheClient := &cache.Client{}
+	cacheClient.New(log, false, false, "", "", "", "")
+	verifier, err := New(log, cacheClient, server.resolver(), nil, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	googlebot := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	tests := []struct {
+		name      string
+		remoteIP  string
+		userAgent string
+		want      bool
+	}{
+		{name: "Verified Googlebot", remoteIP: "66.249.66.1", userAgent: googlebot, want: true},
+		{name: "Verified IPv6 Googlebot", remoteIP: "2001:4860:4801:10::1", userAgent: googlebot, want: true},
+		{name: "Verified Bingbot", remoteIP: "157.55.39.1", userAgent: "Mozilla/5.0 (compatible; bingbot/2.0)", want: true},
+		{name: "Googlebot IP claiming to be Bingbot", remoteIP: "66.249.66.1", userAgent: "bingbot/2.0", want: false},
+		{name: "Reverse DNS outside of the domains", remoteIP: "203.0.113.5", userAgent: googlebot, want: false},
+		{name: "Reverse DNS not confirmed", remoteIP: "203.0.113.6", userAgent: googlebot, want: false},
+		{name: "No reverse DNS", remoteIP: "198.51.100.1", userAgent: googlebot, want: false},
+		{name: "Not a crawler", remoteIP: "66.249.66.1", userAgent: "curl/8.0", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifier.Verify(tt.remoteIP, tt.userAgent); got != tt.want {
+				t.Errorf("Verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Results are cached", func(t *testing.T) {
+		queries := atomic.LoadInt64(&server.queries)
+		if !verifier.Verify("66.249.66.1", googlebot) || verifier.Verify("203.0.113.6", googlebot) || verifier.Verify("198.51.100.1", googlebot) {
+			t.Error("Verify() cached results changed")
+		}
+		if got := atomic.LoadInt64(&server.queries); got != queries {
+			t.Errorf("Verify() sent %d DNS queries, want 0", got-queries)
+		}
+	})
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		definitions []string
+		wantErr     bool
+	}{
+		{definitions: Defaults, wantErr: false},
+		{definitions: []string{"MyBot=.bot.example.com, example.net"}, wantErr: false},
+		{definitions: []string{"mybot"}, wantErr: true},
+		{definitions: []string{"=example.com"}, wantErr: true},
+		{definitions: []string{"mybot= , "}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := Parse(tt.definitions); (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%v) error = %v, wantErr %v", tt.definitions, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_matchDomain(t *testing.T) {
+	domains := []string{"googlebot.com", "google.com"}
+	tests := map[string]bool{
+		"crawl-1.googlebot.com":         true,
+		"googlebot.com":                 true,
+		"rate-limited-proxy.google.com": true,
+		"evilgooglebot.com":             false,
+		"googlebot.com.evil.io":         false,
+	}
+	for name, want := range tests {
+		if got := matchDomain(name, domains); got != want {
+			t.Errorf("matchDomain(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
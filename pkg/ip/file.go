@@ -0,0 +1,145 @@
+package ip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+)
+
+// FILE
+
+//nolint:gochecknoglobals
+var (
+	fileCheckersMu sync.Mutex
+	fileCheckers   = map[string]*sharedFile{}
+)
+
+// sharedFile is the Checker of a file and the number of Checkers using it.
+type sharedFile struct {
+	checker *Checker
+	users   int
+	stop    chan struct{}
+}
+
+// ReadFile returns the IPs, CIDRs and presets listed in a file, one per line.
+// Empty lines and lines starting with # are ignored.
+func ReadFile(path string) ([]string, error) {
+	content, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile:read path:%s %w", path, err)
+	}
+	var list []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list = append(list, line)
+	}
+	return list, scanner.Err()
+}
+
+// WithFile adds the IPs listed in a file to the Checker, until ctx is done.
+// The file is read again every refreshSeconds when it was modified (never if refreshSeconds <= 0).
+// A single goroutine refreshes a file, whatever the number of Checkers using it,
+// so the refresh interval is the one of the first Checker. It stops when the contexts of all of them are done.
+func (ip *Checker) WithFile(ctx context.Context, log *logger.Log, path string, refreshSeconds int64) error {
+	path = filepath.Clean(path)
+	fileCheckersMu.Lock()
+	defer fileCheckersMu.Unlock()
+	if shared, ok := fileCheckers[path]; ok {
+		ip.file = shared.checker
+		shared.acquire(ctx, path)
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("WithFile:stat path:%s %w", path, err)
+	}
+	list, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	trie, err := buildTrie(log, list)
+	if err != nil {
+		return fmt.Errorf("WithFile:parse path:%s %w", path, err)
+	}
+	shared := &sharedFile{checker: &Checker{trie: trie}, stop: make(chan struct{})}
+	fileCheckers[path] = shared
+	ip.file = shared.checker
+	shared.acquire(ctx, path)
+	if refreshSeconds > 0 {
+		go shared.checker.refresh(log, path, info.ModTime(), time.Duration(refreshSeconds)*time.Second, shared.stop)
+	}
+	return nil
+}
+
+// acquire counts a Checker using the file until ctx is done, fileCheckersMu must be held.
+// A context that is never done keeps the file used forever.
+func (shared *sharedFile) acquire(ctx context.Context, path string) {
+	shared.users++
+	done := ctx.Done()
+	if done == nil {
+		return
+	}
+	go func() {
+		<-done
+		fileCheckersMu.Lock()
+		defer fileCheckersMu.Unlock()
+		shared.users--
+		if shared.users > 0 {
+			return
+		}
+		// The next Checker using the file reads it again.
+		if fileCheckers[path] == shared {
+			delete(fileCheckers, path)
+		}
+		close(shared.stop)
+	}()
+}
+
+// refresh reloads the file when it is modified, an invalid file keeps the previous IPs. It returns when stop is closed.
+func (ip *Checker) refresh(log *logger.Log, path string, modTime time.Time, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Error("ip:refresh:stat " + err.Error())
+			continue
+		}
+		if info.ModTime().Equal(modTime) {
+			continue
+		}
+		list, err := ReadFile(path)
+		if err != nil {
+			log.Error("ip:refresh:read " + err.Error())
+			continue
+		}
+		trie, err := buildTrie(log, list)
+		if err != nil {
+			log.Error(fmt.Sprintf("ip:refresh:parse path:%s %s", path, err.Error()))
+			continue
+		}
+		ip.mu.Lock()
+		ip.trie = trie
+		ip.mu.Unlock()
+		modTime = info.ModTime()
+		log.Info(fmt.Sprintf("ip:refresh path:%s entries:%d", path, len(list)))
+	}
+}
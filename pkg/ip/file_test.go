@@ -0,0 +1,111 @@
+package ip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+)
+
+func Test_WithFile(t *testing.T) {
+	log := logger.New("ERROR", "")
+	path := filepath.Join(t.TempDir(), "trusted")
+	if err := os.WriteFile(path, []byte("# proxies\n192.0.2.0/24\n\nloopback\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checker, _ := NewChecker(log, []string{"198.51.100.1"})
+	if err := checker.WithFile(context.Background(), log, path, 0); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewChecker(log, nil)
+	if err := other.WithFile(context.Background(), log, path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if other.file != checker.file {
+		t.Errorf("WithFile() file checker not shared")
+	}
+	for addr, want := range map[string]bool{"198.51.100.1": true, "192.0.2.7": true, "127.0.0.1": true, "203.0.113.1": false} {
+		if got, _ := checker.Contains(addr); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if got, _ := other.Contains("198.51.100.1"); got {
+		t.Errorf("Contains() static IP of another checker = true, want false")
+	}
+
+	// Refresh with a short interval instead of waiting for the ticker of WithFile.
+	info, _ := os.Stat(path)
+	stop := make(chan struct{})
+	defer close(stop)
+	go checker.file.refresh(log, path, info.ModTime(), 10*time.Millisecond, stop)
+	if err := os.WriteFile(path, []byte("invalid\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Second)
+	_ = os.Chtimes(path, future, future)
+	time.Sleep(50 * time.Millisecond)
+	if got, _ := checker.Contains("192.0.2.7"); !got {
+		t.Errorf("Contains() after invalid refresh = false, want true")
+	}
+	if err := os.WriteFile(path, []byte("203.0.113.0/24\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Second)
+	_ = os.Chtimes(path, future, future)
+	time.Sleep(50 * time.Millisecond)
+	for addr, want := range map[string]bool{"192.0.2.7": false, "203.0.113.1": true} {
+		if got, _ := checker.Contains(addr); got != want {
+			t.Errorf("Contains(%s) after refresh = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func Test_WithFileStop(t *testing.T) {
+	log := logger.New("ERROR", "")
+	path := filepath.Join(t.TempDir(), "trusted")
+	if err := os.WriteFile(path, []byte("192.0.2.0/24\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	checker, _ := NewChecker(log, nil)
+	if err := checker.WithFile(ctx, log, path, 3600); err != nil {
+		t.Fatal(err)
+	}
+	otherCtx, otherCancel := context.WithCancel(context.Background())
+	defer otherCancel()
+	other, _ := NewChecker(log, nil)
+	if err := other.WithFile(otherCtx, log, path, 3600); err != nil {
+		t.Fatal(err)
+	}
+	fileCheckersMu.Lock()
+	shared := fileCheckers[path]
+	fileCheckersMu.Unlock()
+
+	// The refresh goes on while a Checker uses the file.
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-shared.stop:
+		t.Fatal("WithFile() refresh stopped while the file is used")
+	default:
+	}
+
+	otherCancel()
+	select {
+	case <-shared.stop:
+	case <-time.After(time.Second):
+		t.Fatal("WithFile() refresh not stopped")
+	}
+	fileCheckersMu.Lock()
+	_, ok := fileCheckers[path]
+	fileCheckersMu.Unlock()
+	if ok {
+		t.Error("WithFile() file still shared after its last Checker")
+	}
+	if got, _ := checker.Contains("192.0.2.7"); !got {
+		t.Error("Contains() after the refresh stopped = false, want true")
+	}
+}
@@ -0,0 +1,72 @@
+package ip
+
+import (
+	"strings"
+)
+
+// FORWARDED
+
+// ForwardedHeader is the standard header defined by RFC 7239.
+const ForwardedHeader = "Forwarded"
+
+// parseForwarded returns the values of the "for" parameters of a RFC 7239 Forwarded header,
+// in the order of the proxies (the most recent is the last one).
+// Quoted strings are unquoted, an element without "for" parameter gives an empty value.
+func parseForwarded(value string) []string {
+	var nodes []string
+	var node string
+	var pair strings.Builder
+	inQuotes, escaped := false, false
+
+	flushPair := func() {
+		key, val, found := strings.Cut(pair.String(), "=")
+		if found && strings.EqualFold(strings.TrimSpace(key), "for") {
+			node = strings.TrimSpace(val)
+		}
+		pair.Reset()
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case escaped:
+			pair.WriteByte(c)
+			escaped = false
+		case inQuotes && c == '\\':
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && c == ';':
+			flushPair()
+		case !inQuotes && c == ',':
+			flushPair()
+			nodes = append(nodes, node)
+			node = ""
+		default:
+			pair.WriteByte(c)
+		}
+	}
+	flushPair()
+	return append(nodes, node)
+}
+
+// isObfuscated tells if a node is "unknown" or an obfuscated identifier (RFC 7239 section 6.3),
+// such a node hides the address of the proxy or client and cannot be checked.
+func isObfuscated(node string) bool {
+	return node == "" || strings.EqualFold(node, "unknown") || strings.HasPrefix(node, "_")
+}
+
+// stripPort removes the port and the brackets of "1.2.3.4:80", "[2001:db8::1]:80" or "[2001:db8::1]".
+// Addresses without port are returned as is, nothing is allocated.
+func stripPort(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.IndexByte(node, ']'); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	// A single colon is an IPv4 with a port, more is an IPv6 address.
+	if colon := strings.IndexByte(node, ':'); colon >= 0 && strings.IndexByte(node[colon+1:], ':') < 0 {
+		return node[:colon]
+	}
+	return node
+}
@@ -0,0 +1,83 @@
+package ip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+)
+
+func Test_parseForwarded(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{name: "Single IPv4", value: "for=192.0.2.60;proto=http;by=203.0.113.43", want: []string{"192.0.2.60"}},
+		{name: "Case insensitive parameter", value: "For=192.0.2.60", want: []string{"192.0.2.60"}},
+		{name: "Quoted IPv6 with port", value: `for="[2001:db8:cafe::17]:4711"`, want: []string{"[2001:db8:cafe::17]:4711"}},
+		{name: "List of proxies", value: "for=192.0.2.43, for=198.51.100.17;by=203.0.113.60", want: []string{"192.0.2.43", "198.51.100.17"}},
+		{name: "Obfuscated identifiers", value: "for=unknown, for=_hidden, for=_SEVKISEK", want: []string{"unknown", "_hidden", "_SEVKISEK"}},
+		{name: "Comma and escape in quoted string", value: `for=192.0.2.43;host="a,b\"c", for=198.51.100.17`, want: []string{"192.0.2.43", "198.51.100.17"}},
+		{name: "Element without for", value: "proto=https, for=192.0.2.43", want: []string{"", "192.0.2.43"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseForwarded(tt.value); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseForwarded() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_stripPort(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":            "192.0.2.1",
+		"192.0.2.1:8080":       "192.0.2.1",
+		"2001:db8::1":          "2001:db8::1",
+		"[2001:db8::1]":        "2001:db8::1",
+		"[2001:db8::1]:8080":   "2001:db8::1",
+		"::ffff:192.0.2.1":     "::ffff:192.0.2.1",
+		"[2001:db8::1":         "[2001:db8::1",
+		"not-an-ip":            "not-an-ip",
+		"[::ffff:192.0.2.1]:1": "::ffff:192.0.2.1",
+	}
+	for node, want := range tests {
+		if got := stripPort(node); got != want {
+			t.Errorf("stripPort(%s) = %v, want %v", node, got, want)
+		}
+	}
+}
+
+func Test_getIPHeaders(t *testing.T) {
+	checker, _ := NewChecker(logger.New("INFO", ""), []string{"10.0.0.0/8", "2001:db8:ffff::/48"})
+	strategy := &PoolStrategy{Checker: checker}
+	headers := []string{"Forwarded", "X-Real-Ip", "Cf-Connecting-Ip", "X-Forwarded-For"}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "No header", headers: map[string]string{}, want: ""},
+		{name: "Forwarded first untrusted", headers: map[string]string{"Forwarded": `for="[2001:db8::1]:1234", for=10.0.0.1`}, want: "2001:db8::1"},
+		{name: "Forwarded skips trusted IPv6", headers: map[string]string{"Forwarded": `for=192.0.2.1, for="[2001:db8:ffff::1]"`}, want: "192.0.2.1"},
+		{name: "Forwarded obfuscated stops the chain", headers: map[string]string{"Forwarded": "for=192.0.2.1, for=_proxy, for=10.0.0.1", "X-Real-Ip": "192.0.2.2"}, want: "192.0.2.2"},
+		{name: "Forwarded has precedence", headers: map[string]string{"Forwarded": "for=192.0.2.1", "X-Forwarded-For": "192.0.2.3"}, want: "192.0.2.1"},
+		{name: "Falls back on next header", headers: map[string]string{"Forwarded": "for=10.0.0.2", "Cf-Connecting-Ip": "192.0.2.4"}, want: "192.0.2.4"},
+		{name: "X-Forwarded-For with port", headers: map[string]string{"X-Forwarded-For": "192.0.2.5:4444, 10.0.0.3"}, want: "192.0.2.5"},
+		{name: "Only trusted everywhere", headers: map[string]string{"X-Real-Ip": "10.0.0.4", "X-Forwarded-For": "10.0.0.5"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			if got := strategy.getIP(req, headers); got != tt.want {
+				t.Errorf("getIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
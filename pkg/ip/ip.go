@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
+	"sync"
 
 	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
 )
@@ -15,32 +17,73 @@ import (
 // CHECKER
 
 // Checker allows to check that addresses are in a trusted IPs.
+// IPs and CIDRs are stored in a prefix trie so lookups do not depend on the size of the list.
 type Checker struct {
-	authorizedIPs    []*net.IP
-	authorizedIPsNet []*net.IPNet
+	mu   sync.RWMutex
+	trie prefixTrie
+	// file is an optional checker refreshed from a file, shared by every Checker using the same file.
+	file *Checker
 }
 
 // NewChecker builds a new Checker given a list of CIDR-Strings to trusted IPs.
+// Names of presets (ex: cloudflare, fastly, private) can be mixed with the CIDRs.
 func NewChecker(log *logger.Log, trustedIPs []string) (*Checker, error) {
 	checker := &Checker{}
+	trie, err := buildTrie(log, trustedIPs)
+	if err != nil {
+		return nil, err
+	}
+	checker.trie = trie
+	return checker, nil
+}
+
+func buildTrie(log *logger.Log, trustedIPs []string) (prefixTrie, error) {
+	var trie prefixTrie
 
 	for _, ipMaskRaw := range trustedIPs {
 		ipMask := strings.TrimSpace(ipMaskRaw)
+		if ranges, ok := Preset(ipMask); ok {
+			for _, ipRange := range ranges {
+				_, ipAddr, _ := net.ParseCIDR(ipRange)
+				trie.insert(prefixBytes(ipAddr))
+			}
+			log.Debug(fmt.Sprintf("IP preset %v is trusted", ipMask))
+			continue
+		}
 		if ipAddr := net.ParseIP(ipMask); ipAddr != nil {
-			checker.authorizedIPs = append(checker.authorizedIPs, &ipAddr)
+			addr := addressBytes(ipAddr)
+			trie.insert(addr, len(addr)*8)
 			log.Debug(fmt.Sprintf("IP %v is trusted", ipAddr))
 			continue
 		}
 
 		_, ipAddr, err := net.ParseCIDR(ipMask)
 		if err != nil {
-			return nil, fmt.Errorf("parsing CIDR trusted IPs %s: %w", ipAddr, err)
+			return trie, fmt.Errorf("parsing CIDR trusted IPs %s: %w", ipMask, err)
 		}
-		checker.authorizedIPsNet = append(checker.authorizedIPsNet, ipAddr)
+		trie.insert(prefixBytes(ipAddr))
 		log.Debug(fmt.Sprintf("IP network %v is trusted", ipAddr))
 	}
 
-	return checker, nil
+	return trie, nil
+}
+
+// Update replaces the trusted IPs of the Checker, invalid IPs and CIDRs are skipped and returned.
+func (ip *Checker) Update(log *logger.Log, trustedIPs []string) []string {
+	var valid, invalid []string
+	for _, ipMaskRaw := range trustedIPs {
+		ipMask := strings.TrimSpace(ipMaskRaw)
+		if _, _, err := net.ParseCIDR(ipMask); err != nil && net.ParseIP(ipMask) == nil {
+			invalid = append(invalid, ipMask)
+			continue
+		}
+		valid = append(valid, ipMask)
+	}
+	trie, _ := buildTrie(log, valid)
+	ip.mu.Lock()
+	ip.trie = trie
+	ip.mu.Unlock()
+	return invalid
 }
 
 // Contains checks if provided address is in the trusted IPs.
@@ -49,82 +92,236 @@ func (ip *Checker) Contains(addr string) (bool, error) {
 		return false, errors.New("Contains:noAddress")
 	}
 
-	ipAddr, err := parseIP(addr)
+	ipAddr, err := netip.ParseAddr(addr)
 	if err != nil {
 		return false, fmt.Errorf("Contains:parseAddress addr:%s %w", addr, err)
 	}
 
-	return ip.ContainsIP(ipAddr), nil
+	return ip.ContainsAddr(ipAddr), nil
+}
+
+// ContainsAddr checks if provided address is in the trusted IPs.
+// Unlike ContainsIP it does not allocate, it is meant for the request path.
+func (ip *Checker) ContainsAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	var found bool
+	ip.mu.RLock()
+	if addr.Is4() {
+		v4 := addr.As4()
+		found = ip.trie.contains(v4[:])
+	} else {
+		v6 := addr.As16()
+		found = ip.trie.contains(v6[:])
+	}
+	ip.mu.RUnlock()
+	if !found && ip.file != nil {
+		return ip.file.ContainsAddr(addr)
+	}
+	return found
 }
 
 // ContainsIP checks if provided address is in the trusted IPs.
 func (ip *Checker) ContainsIP(addr net.IP) bool {
-	for _, authorizedIP := range ip.authorizedIPs {
-		if authorizedIP.Equal(addr) {
-			return true
-		}
+	ip.mu.RLock()
+	found := ip.trie.contains(addressBytes(addr))
+	ip.mu.RUnlock()
+	if !found && ip.file != nil {
+		return ip.file.ContainsIP(addr)
 	}
+	return found
+}
 
-	for _, authorizedNet := range ip.authorizedIPsNet {
-		if authorizedNet.Contains(addr) {
-			return true
-		}
+// KEYS
+
+// Canonical returns the canonical form of an address: IPv4-mapped IPv6 addresses are unmapped,
+// IPv6 addresses are lowercased and compressed (RFC 5952) and zones are dropped.
+// raw is the string the address was parsed from, it is returned as is when already canonical
+// so that no allocation is made for the common case.
+func Canonical(addr netip.Addr, raw string) string {
+	addr = addr.Unmap().WithZone("")
+	var buf [64]byte
+	if canonical := addr.AppendTo(buf[:0]); string(canonical) == raw {
+		return raw
 	}
+	return addr.String()
+}
 
-	return false
+// CanonicalString parses an address and returns its canonical form.
+func CanonicalString(raw string) (string, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(raw))
+	if err != nil {
+		return "", fmt.Errorf("CanonicalString:parseAddress addr:%s %w", raw, err)
+	}
+	return Canonical(addr, raw), nil
 }
 
-func parseIP(addr string) (net.IP, error) {
-	userIP := net.ParseIP(addr)
-	if userIP == nil {
-		return nil, fmt.Errorf("parseIP:parseAddress %s", addr)
+// Key returns the key under which the decisions of an address are stored.
+// IPv6 addresses are grouped by their prefix when ipv6PrefixLength is lower than 128
+// (ex: 2001:db8::/64), so that rotating addresses inside the prefix does not evade decisions.
+func Key(addr netip.Addr, raw string, ipv6PrefixLength int) string {
+	addr = addr.Unmap()
+	if addr.Is6() && ipv6PrefixLength > 0 && ipv6PrefixLength < 128 {
+		prefix, err := addr.WithZone("").Prefix(ipv6PrefixLength)
+		if err == nil {
+			return prefix.String()
+		}
 	}
+	return Canonical(addr, raw)
+}
 
-	return userIP, nil
+// RangeKey returns the key of an IPv6 range having exactly the enforced prefix length,
+// or the empty string if decisions on this range cannot be matched by Key.
+func RangeKey(raw string, ipv6PrefixLength int) string {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(raw))
+	if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() || prefix.Bits() != ipv6PrefixLength || ipv6PrefixLength >= 128 {
+		return ""
+	}
+	return prefix.Masked().String()
 }
 
 // STRATEGY
 
 // PoolStrategy is a strategy based on an IP Checker.
 // It allows to check whether addresses are in a given pool of IPs.
+// When Depth is set, the Checker is not used and the IP at this position from the right is taken.
 type PoolStrategy struct {
 	Checker *Checker
+	Depth   int
 }
 
-// GetIP checks the list of Forwarded IPs (most recent first) against the
-// Checker pool of IPs. It returns the first IP that is not in the pool, or the
-// empty string otherwise.
-func (s *PoolStrategy) getIP(req *http.Request, customHeader string) string {
-	if s.Checker == nil {
+// GetIP checks the headers in order and returns the IP found in the first one that gives one.
+// Each header is checked against the Checker pool of IPs, see getHeaderIP.
+func (s *PoolStrategy) getIP(req *http.Request, headers []string) string {
+	if s.Checker == nil && s.Depth <= 0 {
 		return ""
 	}
+	for _, header := range headers {
+		if remoteIP := s.getHeaderIP(req, header); len(remoteIP) != 0 {
+			return remoteIP
+		}
+	}
+	return ""
+}
 
-	xff := req.Header.Get(customHeader)
+// getHeaderIP checks the list of Forwarded IPs of a header (most recent first) against the
+// Checker pool of IPs. It returns the first IP that is not in the pool, or the
+// empty string otherwise. With a Depth, it returns the Depth-th IP from the right,
+// or the empty string if the list is shorter.
+// The RFC 7239 Forwarded header is parsed, other headers are a comma-separated list of IPs
+// (X-Forwarded-For) or a single IP (X-Real-IP, True-Client-IP, CF-Connecting-IP).
+func (s *PoolStrategy) getHeaderIP(req *http.Request, header string) string {
+	xff := req.Header.Get(header)
+	if len(xff) == 0 {
+		return ""
+	}
 
-	xffs := strings.Split(xff, ",")
+	if strings.EqualFold(header, ForwardedHeader) {
+		nodes := parseForwarded(xff)
+		if s.Depth > 0 {
+			if len(nodes) < s.Depth || isObfuscated(nodes[len(nodes)-s.Depth]) {
+				return ""
+			}
+			return stripPort(nodes[len(nodes)-s.Depth])
+		}
+		for i := len(nodes) - 1; i >= 0; i-- {
+			// We can't tell if a hidden node is trusted, so nothing on its left can be trusted either.
+			if isObfuscated(nodes[i]) {
+				return ""
+			}
+			if remoteIP := stripPort(nodes[i]); !s.contains(remoteIP) {
+				return remoteIP
+			}
+		}
+		return ""
+	}
 
-	for i := len(xffs) - 1; i >= 0; i-- {
-		xffTrimmed := strings.TrimSpace(xffs[i])
+	// The list is walked from the end without splitting it, to avoid allocating on every request.
+	depth := 0
+	for len(xff) > 0 {
+		comma := strings.LastIndexByte(xff, ',')
+		xffTrimmed := strings.TrimSpace(xff[comma+1:])
+		if comma < 0 {
+			xff = ""
+		} else {
+			xff = xff[:comma]
+		}
 		if len(xffTrimmed) == 0 {
 			continue
 		}
-		if contain, _ := s.Checker.Contains(xffTrimmed); !contain {
-			return xffTrimmed
+		if s.Depth > 0 {
+			if depth++; depth == s.Depth {
+				return stripPort(xffTrimmed)
+			}
+			continue
+		}
+		if remoteIP := stripPort(xffTrimmed); !s.contains(remoteIP) {
+			return remoteIP
 		}
 	}
 
 	return ""
 }
 
+func (s *PoolStrategy) contains(addr string) bool {
+	contain, _ := s.Checker.Contains(addr)
+	return contain
+}
+
 // GetRemoteIP It returns the first IP that is not in the pool, or the empty string otherwise.
-func GetRemoteIP(req *http.Request, strategy *PoolStrategy, customHeader string) (string, error) {
-	remoteIP := strategy.getIP(req, customHeader)
-	if len(remoteIP) != 0 {
-		return remoteIP, nil
+// The headers are checked in order, the remote address of the request is used if none gives an IP.
+// Valid addresses are returned in their canonical form.
+func GetRemoteIP(req *http.Request, strategy *PoolStrategy, headers []string) (string, error) {
+	remoteIP := strategy.getIP(req, headers)
+	if len(remoteIP) == 0 {
+		var err error
+		remoteIP, _, err = net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return "", fmt.Errorf("GetRemoteIP:extractIP: %w", err)
+		}
 	}
-	remoteIP, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		return "", fmt.Errorf("GetRemoteIP:extractIP: %w", err)
+	if addr, err := netip.ParseAddr(remoteIP); err == nil {
+		return Canonical(addr, remoteIP), nil
 	}
 	return remoteIP, nil
 }
+
+// GetRemoteIPs returns the untrusted IPs of the forwarded chain, from the right to the left,
+// the first one being the IP returned by GetRemoteIP. Invalid addresses are skipped.
+// Only the first header giving an IP is used, and at most maxHops addresses of it are examined.
+func GetRemoteIPs(req *http.Request, strategy *PoolStrategy, headers []string, maxHops int) []string {
+	var remoteIPs []string
+	for _, header := range headers {
+		xff := req.Header.Get(header)
+		if len(xff) == 0 {
+			continue
+		}
+		var nodes []string
+		if strings.EqualFold(header, ForwardedHeader) {
+			nodes = parseForwarded(xff)
+		} else {
+			nodes = strings.Split(xff, ",")
+		}
+		for i, hop := len(nodes)-1, 1; i >= 0 && hop <= maxHops; i-- {
+			node := strings.TrimSpace(nodes[i])
+			if len(node) == 0 && !strings.EqualFold(header, ForwardedHeader) {
+				continue
+			}
+			if isObfuscated(node) {
+				break
+			}
+			addr, err := netip.ParseAddr(stripPort(node))
+			isTrusted := strategy.Depth <= 0 && strategy.Checker != nil && strategy.Checker.ContainsAddr(addr)
+			if err == nil && hop >= strategy.Depth && !isTrusted {
+				remoteIPs = append(remoteIPs, Canonical(addr, node))
+			}
+			hop++
+		}
+		if len(remoteIPs) > 0 {
+			return remoteIPs
+		}
+	}
+	if remoteIP, err := GetRemoteIP(req, strategy, nil); err == nil {
+		remoteIPs = append(remoteIPs, remoteIP)
+	}
+	return remoteIPs
+}
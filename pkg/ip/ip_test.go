@@ -0,0 +1,312 @@
+package ip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+)
+
+func Test_Contains(t *testing.T) {
+	checker, err := NewChecker(logger.New("INFO", ""), []string{
+		"10.0.0.0/8",
+		"192.168.1.1",
+		"172.16.0.0/12",
+		"2001:db8::/32",
+		"::1",
+		"::ffff:100.64.0.0/106",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		addr    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "IPv4 in a CIDR", addr: "10.1.2.3", want: true},
+		{name: "IPv4 equal to a trusted IP", addr: "192.168.1.1", want: true},
+		{name: "IPv4 next to a trusted IP", addr: "192.168.1.2", want: false},
+		{name: "IPv4 on the edge of a CIDR", addr: "172.31.255.255", want: true},
+		{name: "IPv4 out of a CIDR", addr: "172.32.0.0", want: false},
+		{name: "IPv4-mapped IPv6 in a CIDR", addr: "::ffff:10.0.0.1", want: true},
+		{name: "IPv4 in an IPv4-mapped CIDR", addr: "100.100.0.1", want: true},
+		{name: "IPv6 in a CIDR", addr: "2001:db8:1::1", want: true},
+		{name: "IPv6 out of a CIDR", addr: "2001:db9::1", want: false},
+		{name: "IPv6 equal to a trusted IP", addr: "::1", want: true},
+		{name: "IPv6 not matching IPv4 CIDR", addr: "a00::1", want: false},
+		{name: "Empty address", addr: "", want: false, wantErr: true},
+		{name: "Invalid address", addr: "10.0.0", want: false, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checker.Contains(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Contains() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Update(t *testing.T) {
+	log := logger.New("INFO", "")
+	checker, _ := NewChecker(log, []string{"10.0.0.0/8"})
+	invalid := checker.Update(log, []string{"192.168.1.1", " 2001:db8::/32", "cloudflare", "10.0.0"})
+	if len(invalid) != 2 || invalid[0] != "cloudflare" || invalid[1] != "10.0.0" {
+		t.Errorf("Update() invalid = %v, want [cloudflare 10.0.0]", invalid)
+	}
+	for addr, want := range map[string]bool{"192.168.1.1": true, "2001:db8::1": true, "10.0.0.1": false} {
+		if got, _ := checker.Contains(addr); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func Test_ContainsAll(t *testing.T) {
+	checker, err := NewChecker(logger.New("INFO", ""), []string{"0.0.0.0/0", "::/0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"1.2.3.4", "255.255.255.255", "2001:db8::1", "::"} {
+		if !checker.ContainsIP(net.ParseIP(addr)) {
+			t.Errorf("ContainsIP(%s) = false, want true", addr)
+		}
+	}
+	empty, _ := NewChecker(logger.New("INFO", ""), nil)
+	if empty.ContainsIP(net.ParseIP("1.2.3.4")) {
+		t.Errorf("ContainsIP() on empty checker = true, want false")
+	}
+}
+
+// linearChecker is the previous implementation of the Checker, kept to compare in benchmarks.
+type linearChecker struct {
+	authorizedIPs    []net.IP
+	authorizedIPsNet []*net.IPNet
+}
+
+func (l *linearChecker) containsIP(addr net.IP) bool {
+	for _, authorizedIP := range l.authorizedIPs {
+		if authorizedIP.Equal(addr) {
+			return true
+		}
+	}
+	for _, authorizedNet := range l.authorizedIPsNet {
+		if authorizedNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// benchmarkList returns size CIDRs, half IPv4 /24 and half IPv6 /48, and an address matching none of them.
+func benchmarkList(size int) ([]string, net.IP) {
+	list := make([]string, 0, size)
+	for i := 0; i < size/2; i++ {
+		list = append(list, fmt.Sprintf("10.%d.%d.0/24", i/256, i%256), fmt.Sprintf("2001:db8:%x::/48", i))
+	}
+	return list, net.ParseIP("192.0.2.1")
+}
+
+func BenchmarkContainsIPTrie(b *testing.B) {
+	for _, size := range []int{10, 1000, 10000} {
+		list, addr := benchmarkList(size)
+		checker, _ := NewChecker(logger.New("ERROR", ""), list)
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				checker.ContainsIP(addr)
+			}
+		})
+	}
+}
+
+func BenchmarkContainsIPLinear(b *testing.B) {
+	for _, size := range []int{10, 1000, 10000} {
+		list, addr := benchmarkList(size)
+		checker := &linearChecker{}
+		for _, cidr := range list {
+			_, network, _ := net.ParseCIDR(cidr)
+			checker.authorizedIPsNet = append(checker.authorizedIPsNet, network)
+		}
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				checker.containsIP(addr)
+			}
+		})
+	}
+}
+
+func Test_Key(t *testing.T) {
+	tests := []struct {
+		name         string
+		raw          string
+		prefixLength int
+		want         string
+	}{
+		{name: "IPv4 unchanged", raw: "1.2.3.4", prefixLength: 128, want: "1.2.3.4"},
+		{name: "IPv4-mapped IPv6 unmapped", raw: "::ffff:1.2.3.4", prefixLength: 128, want: "1.2.3.4"},
+		{name: "IPv6 expanded compressed", raw: "2001:0db8:0:0::1", prefixLength: 128, want: "2001:db8::1"},
+		{name: "IPv6 uppercase lowered", raw: "2001:DB8::1", prefixLength: 128, want: "2001:db8::1"},
+		{name: "IPv6 zone dropped", raw: "fe80::1%eth0", prefixLength: 128, want: "fe80::1"},
+		{name: "IPv6 grouped by prefix", raw: "2001:db8:0:0:aaaa::1", prefixLength: 64, want: "2001:db8::/64"},
+		{name: "IPv4-mapped not grouped by prefix", raw: "::ffff:1.2.3.4", prefixLength: 64, want: "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Key(netip.MustParseAddr(tt.raw), tt.raw, tt.prefixLength); got != tt.want {
+				t.Errorf("Key() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_RangeKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		raw          string
+		prefixLength int
+		want         string
+	}{
+		{name: "IPv6 range of the enforced length", raw: "2001:0db8::1/64", prefixLength: 64, want: "2001:db8::/64"},
+		{name: "IPv6 range of another length", raw: "2001:db8::/48", prefixLength: 64, want: ""},
+		{name: "IPv4 range", raw: "1.2.3.0/24", prefixLength: 24, want: ""},
+		{name: "Prefix not enforced", raw: "2001:db8::/64", prefixLength: 128, want: ""},
+		{name: "Invalid range", raw: "2001:db8::", prefixLength: 64, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RangeKey(tt.raw, tt.prefixLength); got != tt.want {
+				t.Errorf("RangeKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_GetRemoteIP(t *testing.T) {
+	checker, _ := NewChecker(logger.New("INFO", ""), []string{"10.0.0.0/8"})
+	strategy := &PoolStrategy{Checker: checker}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+		wantErr    bool
+	}{
+		{name: "Remote address without header", remoteAddr: "1.2.3.4:80", want: "1.2.3.4"},
+		{name: "Remote IPv6 address canonicalized", remoteAddr: "[2001:0DB8::0001]:80", want: "2001:db8::1"},
+		{name: "First untrusted from the right", remoteAddr: "10.0.0.1:80", xff: "5.6.7.8, 1.2.3.4, 10.0.0.2", want: "1.2.3.4"},
+		{name: "Forwarded IPv4-mapped canonicalized", remoteAddr: "10.0.0.1:80", xff: "::ffff:1.2.3.4,10.0.0.2", want: "1.2.3.4"},
+		{name: "Only trusted forwarded", remoteAddr: "10.0.0.1:80", xff: "10.0.0.3, ,10.0.0.2", want: "10.0.0.1"},
+		{name: "Invalid remote address", remoteAddr: "1.2.3.4", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			got, err := GetRemoteIP(req, strategy, []string{"X-Forwarded-For"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetRemoteIP() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("GetRemoteIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_NewCheckerPresets(t *testing.T) {
+	checker, err := NewChecker(logger.New("INFO", ""), []string{"Cloudflare", "private", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"173.245.48.1": true,
+		"2606:4700::1": true,
+		"10.1.1.1":     true,
+		"fd00::1":      true,
+		"192.0.2.1":    true,
+		"151.101.1.1":  false,
+		"198.51.100.1": false,
+		"2001:db8::1":  false,
+	}
+	for addr, want := range tests {
+		if got, _ := checker.Contains(addr); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if _, err := NewChecker(logger.New("INFO", ""), []string{"akamai"}); err == nil {
+		t.Errorf("NewChecker() with unknown preset error = nil, want error")
+	}
+}
+
+func Test_getIPDepth(t *testing.T) {
+	tests := []struct {
+		name    string
+		depth   int
+		headers map[string]string
+		want    string
+	}{
+		{name: "Rightmost", depth: 1, headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 2.2.2.2, 3.3.3.3"}, want: "3.3.3.3"},
+		{name: "Second from the right", depth: 2, headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 2.2.2.2,, 3.3.3.3"}, want: "2.2.2.2"},
+		{name: "Chain too short", depth: 4, headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 2.2.2.2, 3.3.3.3"}, want: ""},
+		{name: "Forwarded second from the right", depth: 2, headers: map[string]string{"Forwarded": `for="[2001:db8::1]:80", for=10.0.0.1`}, want: "2001:db8::1"},
+		{name: "Forwarded obfuscated", depth: 1, headers: map[string]string{"Forwarded": "for=1.1.1.1, for=_hidden"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := &PoolStrategy{Depth: tt.depth}
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			if got := strategy.getIP(req, []string{"Forwarded", "X-Forwarded-For"}); got != tt.want {
+				t.Errorf("getIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_GetRemoteIPs(t *testing.T) {
+	checker, _ := NewChecker(logger.New("INFO", ""), []string{"10.0.0.0/8"})
+	tests := []struct {
+		name     string
+		strategy *PoolStrategy
+		headers  map[string]string
+		maxHops  int
+		want     []string
+	}{
+		{name: "Every untrusted hop", strategy: &PoolStrategy{Checker: checker}, headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 10.0.0.3, 2.2.2.2, 10.0.0.2"}, maxHops: 10, want: []string{"2.2.2.2", "1.1.1.1"}},
+		{name: "Capped number of hops", strategy: &PoolStrategy{Checker: checker}, headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 10.0.0.3, 2.2.2.2, 10.0.0.2"}, maxHops: 3, want: []string{"2.2.2.2"}},
+		{name: "Invalid hop skipped", strategy: &PoolStrategy{Checker: checker}, headers: map[string]string{"X-Forwarded-For": "1.1.1.1, nope, 2.2.2.2"}, maxHops: 10, want: []string{"2.2.2.2", "1.1.1.1"}},
+		{name: "Forwarded stops at obfuscated", strategy: &PoolStrategy{Checker: checker}, headers: map[string]string{"Forwarded": `for=1.1.1.1, for=_x, for="[2001:DB8::1]:80"`}, maxHops: 10, want: []string{"2001:db8::1"}},
+		{name: "Depth skips the right", strategy: &PoolStrategy{Depth: 2}, headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 2.2.2.2, 10.0.0.1"}, maxHops: 10, want: []string{"2.2.2.2", "1.1.1.1"}},
+		{name: "Remote address without header", strategy: &PoolStrategy{Checker: checker}, headers: map[string]string{}, maxHops: 10, want: []string{"192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = "192.0.2.1:80"
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			got := GetRemoteIPs(req, tt.strategy, []string{"Forwarded", "X-Forwarded-For"}, tt.maxHops)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("GetRemoteIPs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package ip
+
+import (
+	"net"
+)
+
+// TRIE
+
+// trieNode is a node of a binary prefix trie, one level per bit of the address.
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool
+}
+
+// prefixTrie stores IPv4 and IPv6 prefixes in two separate binary tries,
+// lookups cost at most the length of the address in bits.
+type prefixTrie struct {
+	v4 trieNode
+	v6 trieNode
+}
+
+// addressBytes returns the 4 bytes of an IPv4 (or IPv4-mapped) address or the 16 bytes of an IPv6 one.
+func addressBytes(addr net.IP) []byte {
+	if v4 := addr.To4(); v4 != nil {
+		return v4
+	}
+	return addr.To16()
+}
+
+// prefixBytes returns the address bytes and prefix length of a network,
+// IPv4-mapped IPv6 networks are stored with the IPv4 ones.
+func prefixBytes(network *net.IPNet) ([]byte, int) {
+	prefixLen, bits := network.Mask.Size()
+	addr := addressBytes(network.IP)
+	if bits == 8*net.IPv6len && len(addr) == net.IPv4len {
+		if prefixLen < 96 {
+			return network.IP.To16(), prefixLen
+		}
+		prefixLen -= 96
+	}
+	return addr, prefixLen
+}
+
+func (t *prefixTrie) root(addr []byte) *trieNode {
+	if len(addr) == net.IPv4len {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// insert adds the prefix made of the first prefixLen bits of addr.
+func (t *prefixTrie) insert(addr []byte, prefixLen int) {
+	node := t.root(addr)
+	for i := 0; i < prefixLen && !node.terminal; i++ {
+		bit := addr[i/8] >> (7 - uint(i%8)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	// Shorter prefixes already cover everything below, longer ones are now useless.
+	node.terminal = true
+	node.children = [2]*trieNode{}
+}
+
+// contains reports whether addr is covered by one of the inserted prefixes.
+func (t *prefixTrie) contains(addr []byte) bool {
+	if len(addr) != net.IPv4len && len(addr) != net.IPv6len {
+		return false
+	}
+	node := t.root(addr)
+	for i := 0; !node.terminal; i++ {
+		if i == len(addr)*8 {
+			return false
+		}
+		node = node.children[addr[i/8]>>(7-uint(i%8))&1]
+		if node == nil {
+			return false
+		}
+	}
+	return true
+}
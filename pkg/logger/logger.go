@@ -15,6 +15,7 @@ type Log struct {
 	logError *log.Logger
 	logInfo  *log.Logger
 	logDebug *log.Logger
+	isDebug  bool
 }
 
 // New Set Default log level to info in case log level to defined.
@@ -60,6 +61,7 @@ func New(logLevel string, logFilePath string) *Log {
 		logError: logError,
 		logInfo:  logInfo,
 		logDebug: logDebug,
+		isDebug:  logLevel == "DEBUG",
 	}
 }
 
@@ -68,6 +70,12 @@ func (l *Log) Info(str string) {
 	l.logInfo.Printf("%s", str)
 }
 
+// DebugEnabled tells if debug logs are written.
+// Check it before formatting a debug message on the request path, so nothing is allocated when DEBUG is disabled.
+func (l *Log) DebugEnabled() bool {
+	return l.isDebug
+}
+
 // Debug log to Stdout.
 func (l *Log) Debug(str string) {
 	l.logDebug.Printf("%s", str)
@@ -0,0 +1,84 @@
+// Package policy implements the mapping of CrowdSec decisions to remediations
+// by their type, scenario, origin and scope.
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Actions of a policy.
+const (
+	ActionBan      = "ban"
+	ActionCaptcha  = "captcha"
+	ActionBypass   = "bypass"
+	ActionRedirect = "redirect"
+	ActionTarpit   = "tarpit"
+	ActionThrottle = "throttle"
+)
+
+// Policy maps decisions to an action, every non empty attribute must match.
+type Policy struct {
+	decisionType string
+	scenario     string
+	origin       string
+	scope        string
+	Action       string
+	StatusCode   int
+}
+
+// New creates a Policy. Attributes are case insensitive globs (ex: crowdsecurity/http-*),
+// the origin also matches <origin>:<scenario> (ex: lists:tor-exit-nodes).
+// The status code is only allowed for the ban action, 0 keeps the default one.
+func New(decisionType, scenario, origin, scope, action string, statusCode int) (*Policy, error) {
+	action = strings.ToLower(strings.TrimSpace(action))
+	switch action {
+	case ActionBan, ActionCaptcha, ActionBypass, ActionRedirect, ActionTarpit, ActionThrottle:
+	default:
+		return nil, fmt.Errorf("policy:New action %q must be one of ban, captcha, redirect, tarpit, throttle or bypass", action)
+	}
+	if statusCode != 0 && (action != ActionBan || statusCode < 100 || statusCode >= 600) {
+		return nil, fmt.Errorf("policy:New statusCode %d must be between 100 and 599 with the ban action", statusCode)
+	}
+	policy := &Policy{
+		decisionType: strings.ToLower(strings.TrimSpace(decisionType)),
+		scenario:     strings.ToLower(strings.TrimSpace(scenario)),
+		origin:       strings.ToLower(strings.TrimSpace(origin)),
+		scope:        strings.ToLower(strings.TrimSpace(scope)),
+		Action:       action,
+		StatusCode:   statusCode,
+	}
+	for _, pattern := range []string{policy.decisionType, policy.scenario, policy.origin, policy.scope} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("policy:New pattern %q %w", pattern, err)
+		}
+	}
+	return policy, nil
+}
+
+// Match checks that a decision matches every attribute of the policy.
+func (p *Policy) Match(decisionType, scenario, origin, scope string) bool {
+	if !match(p.decisionType, decisionType) || !match(p.scenario, scenario) || !match(p.scope, scope) {
+		return false
+	}
+	return match(p.origin, origin) || (p.origin != "" && match(p.origin, origin+":"+scenario))
+}
+
+func match(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, strings.ToLower(value))
+	return matched
+}
+
+// Evaluate returns the first policy matching the decision, or nil.
+func Evaluate(policies []*Policy, decisionType, scenario, origin, scope string) *Policy {
+	for _, policy := range policies {
+		if policy.Match(decisionType, scenario, origin, scope) {
+			return policy
+		}
+	}
+	return nil
+}
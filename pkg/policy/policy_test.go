@@ -0,0 +1,74 @@
+package policy
+
+import "testing"
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name       string
+		scenario   string
+		action     string
+		statusCode int
+		wantErr    bool
+	}{
+		{name: "Valid policy", scenario: "crowdsecurity/http-*", action: "Captcha", wantErr: false},
+		{name: "Ban with a status code", action: ActionBan, statusCode: 429, wantErr: false},
+		{name: "Redirect", action: "redirect", wantErr: false},
+		{name: "Tarpit", action: ActionTarpit, wantErr: false},
+		{name: "Throttle", action: ActionThrottle, wantErr: false},
+		{name: "Unknown action", action: "allow", wantErr: true},
+		{name: "Status code without ban", action: ActionCaptcha, statusCode: 429, wantErr: true},
+		{name: "Invalid status code", action: ActionBan, statusCode: 999, wantErr: true},
+		{name: "Invalid glob", scenario: "[a-", action: ActionBan, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New("", tt.scenario, "", "", tt.action, tt.statusCode); (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	mustNew := func(decisionType, scenario, origin, scope, action string, statusCode int) *Policy {
+		policy, err := New(decisionType, scenario, origin, scope, action, statusCode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return policy
+	}
+	policies := []*Policy{
+		mustNew("", "crowdsecurity/http-crawl-non_statics", "", "", ActionCaptcha, 0),
+		mustNew("", "", "lists:tor*", "", ActionCaptcha, 0),
+		mustNew("", "crowdsecurity/http-bad-user-agent", "", "", ActionBan, 429),
+		mustNew("", "", "", "country", ActionBypass, 0),
+		mustNew("captcha", "", "", "", ActionCaptcha, 0),
+		mustNew("*", "", "", "", ActionBan, 0),
+	}
+	tests := []struct {
+		name         string
+		decisionType string
+		scenario     string
+		origin       string
+		scope        string
+		want         *Policy
+	}{
+		{name: "Scenario", decisionType: "ban", scenario: "crowdsecurity/http-crawl-non_statics", origin: "crowdsec", scope: "Ip", want: policies[0]},
+		{name: "Origin and list", decisionType: "ban", scenario: "tor-exit-nodes", origin: "lists", scope: "Ip", want: policies[1]},
+		{name: "Origin without list", decisionType: "ban", scenario: "tor-exit-nodes", origin: "CAPI", scope: "Ip", want: policies[5]},
+		{name: "Status code", decisionType: "ban", scenario: "crowdsecurity/http-bad-user-agent", origin: "crowdsec", scope: "Ip", want: policies[2]},
+		{name: "Scope", decisionType: "ban", origin: "cscli", scope: "Country", want: policies[3]},
+		{name: "Captcha type", decisionType: "captcha", origin: "cscli", scope: "Ip", want: policies[4]},
+		{name: "Unknown type", decisionType: "custom", origin: "cscli", scope: "Ip", want: policies[5]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Evaluate(policies, tt.decisionType, tt.scenario, tt.origin, tt.scope); got != tt.want {
+				t.Errorf("Evaluate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if got := Evaluate(nil, "ban", "", "", "Ip"); got != nil {
+		t.Errorf("Evaluate() without policies = %+v, want nil", got)
+	}
+}
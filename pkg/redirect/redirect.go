@@ -0,0 +1,109 @@
+// Package redirect implements the redirection of banned requests to a portal,
+// with the original URL, the IP and the decision ID as signed query parameters.
+package redirect
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters added to the portal URL.
+const (
+	ParamURL       = "url"
+	ParamIP        = "ip"
+	ParamDecision  = "decision"
+	ParamTimestamp = "ts"
+	ParamSignature = "signature"
+)
+
+// Redirect builds the portal URLs.
+type Redirect struct {
+	portal     *url.URL
+	secret     []byte
+	StatusCode int
+}
+
+// New creates a Redirect to the portal URL with one of the 302, 303 or 307 status codes.
+func New(portalURL, secret string, statusCode int) (*Redirect, error) {
+	portal, err := url.Parse(portalURL)
+	if err != nil {
+		return nil, fmt.Errorf("redirect:New portalURL %w", err)
+	}
+	if (portal.Scheme != "http" && portal.Scheme != "https") || portal.Host == "" {
+		return nil, fmt.Errorf("redirect:New portalURL %q must be an absolute http or https URL", portalURL)
+	}
+	switch statusCode {
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+	default:
+		return nil, fmt.Errorf("redirect:New statusCode %d must be 302, 303 or 307", statusCode)
+	}
+	if secret == "" {
+		return nil, errors.New("redirect:New secret cannot be empty")
+	}
+	return &Redirect{portal: portal, secret: []byte(secret), StatusCode: statusCode}, nil
+}
+
+// Location returns the portal URL with the signed parameters, the query of the portal URL is kept.
+func (r *Redirect) Location(originalURL, ip, decisionID string, now time.Time) string {
+	query := r.portal.Query()
+	query.Set(ParamURL, originalURL)
+	query.Set(ParamIP, ip)
+	query.Set(ParamDecision, decisionID)
+	query.Set(ParamTimestamp, strconv.FormatInt(now.Unix(), 10))
+	query.Set(ParamSignature, Sign(r.secret, query))
+	location := *r.portal
+	location.RawQuery = query.Encode()
+	return location.String()
+}
+
+// Sign returns the unpadded base64url HMAC-SHA256 of the parameters url, ip, decision and ts,
+// encoded as a query string sorted by key (ex: decision=42&ip=192.0.2.1&ts=1700000000&url=https%3A%2F%2Fexample.com%2F).
+func Sign(secret []byte, query url.Values) string {
+	signed := url.Values{}
+	for _, key := range []string{ParamURL, ParamIP, ParamDecision, ParamTimestamp} {
+		signed.Set(key, query.Get(key))
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of the parameters received by the portal and that they are not older than maxAge.
+func Verify(secret []byte, query url.Values, maxAge time.Duration, now time.Time) error {
+	if !hmac.Equal([]byte(query.Get(ParamSignature)), []byte(Sign(secret, query))) {
+		return errors.New("redirect:Verify invalid signature")
+	}
+	timestamp, err := strconv.ParseInt(query.Get(ParamTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("redirect:Verify parse timestamp %w", err)
+	}
+	if now.Sub(time.Unix(timestamp, 0)) > maxAge {
+		return errors.New("redirect:Verify parameters expired")
+	}
+	return nil
+}
+
+// OriginalURL returns the URL requested by the client. When the request comes from a trusted proxy,
+// which may terminate TLS, the scheme is the one of its X-Forwarded-Proto header.
+func OriginalURL(req *http.Request, trustedProxy bool) string {
+	original := url.URL{Scheme: "http", Host: req.Host, Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+	if req.TLS != nil {
+		original.Scheme = "https"
+	}
+	if trustedProxy {
+		// The first proxy of the chain gives the scheme of the client.
+		proto, _, _ := strings.Cut(req.Header.Get("X-Forwarded-Proto"), ",")
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "http" || proto == "https" {
+			original.Scheme = proto
+		}
+	}
+	return original.String()
+}
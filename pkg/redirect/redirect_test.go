@@ -0,0 +1,106 @@
+package redirect
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name       string
+		portalURL  string
+		secret     string
+		statusCode int
+		wantErr    bool
+	}{
+		{name: "Valid redirect", portalURL: "https://portal.example.com/denied", secret: "secret", statusCode: http.StatusSeeOther, wantErr: false},
+		{name: "Relative URL", portalURL: "/denied", secret: "secret", statusCode: http.StatusFound, wantErr: true},
+		{name: "Other scheme", portalURL: "ftp://portal.example.com/", secret: "secret", statusCode: http.StatusFound, wantErr: true},
+		{name: "Permanent redirect", portalURL: "https://portal.example.com/", secret: "secret", statusCode: http.StatusMovedPermanently, wantErr: true},
+		{name: "Without secret", portalURL: "https://portal.example.com/", statusCode: http.StatusFound, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.portalURL, tt.secret, tt.statusCode); (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedirect_Location(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r, err := New("https://portal.example.com/denied?site=shop", "secret", http.StatusFound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, err := url.Parse(r.Location("https://shop.example.com/cart?id=1", "192.0.2.1", "42", now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if location.Host != "portal.example.com" || query.Get("site") != "shop" {
+		t.Errorf("Location() = %v, the portal URL is not kept", location)
+	}
+	if query.Get(ParamURL) != "https://shop.example.com/cart?id=1" || query.Get(ParamIP) != "192.0.2.1" || query.Get(ParamDecision) != "42" {
+		t.Errorf("Location() = %v, missing parameters", location)
+	}
+	tests := []struct {
+		name    string
+		secret  string
+		tamper  func(url.Values)
+		now     time.Time
+		wantErr bool
+	}{
+		{name: "Valid signature", secret: "secret", now: now.Add(time.Minute), wantErr: false},
+		{name: "Other secret", secret: "other", now: now, wantErr: true},
+		{name: "Tampered IP", secret: "secret", tamper: func(q url.Values) { q.Set(ParamIP, "192.0.2.2") }, now: now, wantErr: true},
+		{name: "Expired", secret: "secret", now: now.Add(time.Hour), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := location.Query()
+			if tt.tamper != nil {
+				tt.tamper(received)
+			}
+			if err := Verify([]byte(tt.secret), received, 5*time.Minute, tt.now); (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOriginalURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		tls          bool
+		proto        string
+		trustedProxy bool
+		want         string
+	}{
+		{name: "Plain HTTP", want: "http://shop.example.com/a%2Fb?x=1"},
+		{name: "TLS", tls: true, want: "https://shop.example.com/a%2Fb?x=1"},
+		{name: "TLS terminated by a trusted proxy", proto: "https", trustedProxy: true, want: "https://shop.example.com/a%2Fb?x=1"},
+		{name: "Scheme of the first proxy", proto: "HTTPS, http", trustedProxy: true, want: "https://shop.example.com/a%2Fb?x=1"},
+		{name: "Scheme from an untrusted client", proto: "https", want: "http://shop.example.com/a%2Fb?x=1"},
+		{name: "Invalid scheme", proto: "javascript", trustedProxy: true, want: "http://shop.example.com/a%2Fb?x=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://shop.example.com/a%2Fb?x=1", nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if got := OriginalURL(req, tt.trustedProxy); got != tt.want {
+				t.Errorf("OriginalURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package response
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// NoncePlaceholder is replaced by the nonce of the response in the Content-Security-Policy.
+const NoncePlaceholder = "{nonce}"
+
+// BanContentSecurityPolicy is the default Content-Security-Policy of the ban page,
+// only the inline scripts and styles having the nonce of the response are allowed.
+const BanContentSecurityPolicy = "default-src 'none'; script-src 'nonce-{nonce}'; style-src 'nonce-{nonce}'; img-src 'self' data:; " +
+	"base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// NoContentSecurityPolicy disables the Content-Security-Policy header, for the templates without nonces.
+const NoContentSecurityPolicy = "none"
+
+// nonceMarker is given as nonce to the templates to detect the ones using it.
+const nonceMarker = "crowdsec-nonce-marker"
+
+// ContentSecurityPolicy returns the configured Content-Security-Policy, the default one when empty,
+// or no policy when NoContentSecurityPolicy.
+func ContentSecurityPolicy(configured, defaultPolicy string) string {
+	switch strings.TrimSpace(configured) {
+	case "":
+		return defaultPolicy
+	case NoContentSecurityPolicy:
+		return ""
+	default:
+		return configured
+	}
+}
+
+// Pages holds an HTML template, under the empty language, and its translations by lowercase language.
+type Pages struct {
+	templates map[string]*template.Template
+	languages []string
+	usesNonce bool
+}
+
+// NewPages creates the Pages of templates, see configuration.GetHTMLTemplates.
+func NewPages(templates map[string]*template.Template) *Pages {
+	pages := &Pages{templates: templates, languages: make([]string, 0, len(templates)), usesNonce: true}
+	for lang, page := range templates {
+		if lang != "" {
+			pages.languages = append(pages.languages, lang)
+		}
+		var buf strings.Builder
+		if err := page.Execute(&buf, map[string]string{"Nonce": nonceMarker}); err != nil || !strings.Contains(buf.String(), nonceMarker) {
+			pages.usesNonce = false
+		}
+	}
+	sort.Strings(pages.languages)
+	return pages
+}
+
+// Template returns the translation negotiated with the Accept-Language header of the request,
+// or the template when there is none.
+func (p *Pages) Template(req *http.Request, defaultLanguage string) *template.Template {
+	if len(p.languages) > 0 {
+		if translation, ok := p.templates[Language(req, p.languages, defaultLanguage)]; ok {
+			return translation
+		}
+	}
+	return p.templates[""]
+}
+
+// UsesNonce tells if the template and all its translations use the nonce.
+func (p *Pages) UsesNonce() bool {
+	return p.usesNonce
+}
+
+// PagesContentSecurityPolicy returns the Content-Security-Policy of the Pages, see ContentSecurityPolicy.
+// When none is configured, the default one is sent only with templates using the nonce,
+// it would block the inline scripts and styles of the custom templates written without it.
+func PagesContentSecurityPolicy(configured, defaultPolicy string, pages *Pages) string {
+	if strings.TrimSpace(configured) == "" && !pages.UsesNonce() {
+		return ""
+	}
+	return ContentSecurityPolicy(configured, defaultPolicy)
+}
+
+// Nonce returns a random nonce allowing the inline scripts and styles of a page.
+func Nonce() string {
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(nonce)
+}
+
+// SetSecurityHeaders sets the security headers of a block response, the Content-Security-Policy is set
+// for the HTML pages only, when not empty, with the nonce of the response replacing NoncePlaceholder.
+func SetSecurityHeaders(header http.Header, contentSecurityPolicy, nonce string) {
+	if contentSecurityPolicy != "" {
+		header.Set("Content-Security-Policy", strings.ReplaceAll(contentSecurityPolicy, NoncePlaceholder, nonce))
+	}
+	header.Set("X-Frame-Options", "DENY")
+	header.Set("Referrer-Policy", "strict-origin")
+	header.Set("Cache-Control", "no-store")
+}
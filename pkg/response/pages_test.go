@@ -0,0 +1,107 @@
+package response
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPages_Template(t *testing.T) {
+	pages := NewPages(map[string]*template.Template{
+		"":   template.Must(template.New("").Parse("banned")),
+		"fr": template.Must(template.New("fr").Parse("banni")),
+	})
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		want           string
+	}{
+		{name: "Default language", acceptLanguage: "en", want: "banned"},
+		{name: "Translation", acceptLanguage: "fr-FR", want: "banni"},
+		{name: "Unknown language", acceptLanguage: "de", want: "banned"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Language", tt.acceptLanguage)
+			var got strings.Builder
+			if err := pages.Template(req, "en").Execute(&got, nil); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("Template() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSetSecurityHeaders(t *testing.T) {
+	nonce := Nonce()
+	if len(nonce) != 22 || nonce == Nonce() {
+		t.Fatalf("Nonce() = %v, want a random base64url nonce of 16 bytes", nonce)
+	}
+	header := http.Header{}
+	SetSecurityHeaders(header, BanContentSecurityPolicy, nonce)
+	if got := header.Get("Content-Security-Policy"); !strings.Contains(got, "style-src 'nonce-"+nonce+"'") || strings.Contains(got, NoncePlaceholder) {
+		t.Errorf("SetSecurityHeaders() Content-Security-Policy = %v, want the nonce %v", got, nonce)
+	}
+	if header.Get("X-Frame-Options") != "DENY" || header.Get("Referrer-Policy") == "" || header.Get("Cache-Control") != "no-store" {
+		t.Errorf("SetSecurityHeaders() headers = %v", header)
+	}
+	header = http.Header{}
+	SetSecurityHeaders(header, "", "")
+	if _, ok := header["Content-Security-Policy"]; ok {
+		t.Errorf("SetSecurityHeaders() sets a Content-Security-Policy without policy")
+	}
+}
+
+func TestContentSecurityPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		want       string
+	}{
+		{name: "Default", configured: "", want: BanContentSecurityPolicy},
+		{name: "Configured", configured: "default-src 'self'", want: "default-src 'self'"},
+		{name: "Disabled", configured: NoContentSecurityPolicy, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ContentSecurityPolicy(tt.configured, BanContentSecurityPolicy); got != tt.want {
+				t.Errorf("ContentSecurityPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPagesContentSecurityPolicy(t *testing.T) {
+	withNonce := NewPages(map[string]*template.Template{
+		"":   template.Must(template.New("").Parse(`<style nonce="{{ .Nonce }}"></style>`)),
+		"fr": template.Must(template.New("fr").Parse(`<style nonce="{{ .Nonce }}"></style>`)),
+	})
+	// A translation without nonce is enough to drop the default policy.
+	withoutNonce := NewPages(map[string]*template.Template{
+		"":   template.Must(template.New("").Parse(`<style nonce="{{ .Nonce }}"></style>`)),
+		"fr": template.Must(template.New("fr").Parse(`<style></style>`)),
+	})
+	tests := []struct {
+		name       string
+		configured string
+		pages      *Pages
+		want       string
+	}{
+		{name: "Default with nonce", pages: withNonce, want: BanContentSecurityPolicy},
+		{name: "Default without nonce", pages: withoutNonce, want: ""},
+		{name: "Configured without nonce", configured: "default-src 'self'", pages: withoutNonce, want: "default-src 'self'"},
+		{name: "Disabled with nonce", configured: NoContentSecurityPolicy, pages: withNonce, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PagesContentSecurityPolicy(tt.configured, BanContentSecurityPolicy, tt.pages); got != tt.want {
+				t.Errorf("PagesContentSecurityPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
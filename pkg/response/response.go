@@ -0,0 +1,230 @@
+// Package response implements the content negotiation of the block responses:
+// HTML pages for browsers, problem details (RFC 9457) for APIs, and plain text.
+package response
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Formats of a block response.
+const (
+	FormatHTML = "html"
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Content types of the formats.
+const (
+	ContentTypeHTML    = "text/html; charset=utf-8"
+	ContentTypeProblem = "application/problem+json"
+	ContentTypeText    = "text/plain; charset=utf-8"
+)
+
+// Details of the remediations.
+const (
+	DetailBan     = "Your IP address has been blocked by CrowdSec."
+	DetailCaptcha = "A captcha must be solved in a browser to access this resource."
+)
+
+// Data is given to the JSON and text templates.
+type Data struct {
+	Status      int
+	Title       string
+	Detail      string
+	Remediation string
+}
+
+// NewData returns the Data of a remediation (ban or captcha) answered with the status code.
+func NewData(statusCode int, remediation string) Data {
+	detail := DetailBan
+	if remediation == "captcha" {
+		detail = DetailCaptcha
+	}
+	return Data{Status: statusCode, Title: http.StatusText(statusCode), Detail: detail, Remediation: remediation}
+}
+
+// problem is the default JSON body.
+type problem struct {
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	Status      int    `json:"status"`
+	Detail      string `json:"detail"`
+	Remediation string `json:"remediation"`
+}
+
+// Renderer writes the JSON and text bodies, from templates or the default ones.
+type Renderer struct {
+	json *template.Template
+	text *template.Template
+}
+
+// New creates a Renderer, the template paths are optional.
+func New(jsonPath, textPath string) (*Renderer, error) {
+	renderer := &Renderer{}
+	var err error
+	if renderer.json, err = parseFile(jsonPath); err != nil {
+		return nil, err
+	}
+	if renderer.text, err = parseFile(textPath); err != nil {
+		return nil, err
+	}
+	return renderer, nil
+}
+
+func parseFile(path string) (*template.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+	//nolint:gosec
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("response:parseFile %w", err)
+	}
+	parsed, err := template.New(path).Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("response:parseFile %w", err)
+	}
+	return parsed, nil
+}
+
+// Body returns the content type and the body of the JSON or text format.
+func (r *Renderer) Body(format string, data Data) (string, string, error) {
+	if format == FormatText {
+		if r.text == nil {
+			return ContentTypeText, strconv.Itoa(data.Status) + " " + data.Title + ": " + data.Detail + "\n", nil
+		}
+		body, err := execute(r.text, data)
+		return ContentTypeText, body, err
+	}
+	if r.json == nil {
+		body, err := json.Marshal(problem{Type: "about:blank", Title: data.Title, Status: data.Status, Detail: data.Detail, Remediation: data.Remediation})
+		return ContentTypeProblem, string(body), err
+	}
+	body, err := execute(r.json, data)
+	return ContentTypeProblem, body, err
+}
+
+func execute(tmpl *template.Template, data Data) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("response:execute %w", err)
+	}
+	return buf.String(), nil
+}
+
+// Format negotiates the format of a block response with the Accept header of the request.
+// The formats are preferred in the order HTML, JSON, text, or JSON, text, HTML for the API path prefixes.
+func Format(req *http.Request, apiPathPrefixes []string) string {
+	preferred := []string{FormatHTML, FormatJSON, FormatText}
+	for _, prefix := range apiPathPrefixes {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			preferred = []string{FormatJSON, FormatText, FormatHTML}
+			break
+		}
+	}
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return preferred[0]
+	}
+	best, bestQuality := preferred[0], -1.0
+	for _, format := range preferred {
+		if quality := acceptQuality(accept, format); quality > bestQuality {
+			best, bestQuality = format, quality
+		}
+	}
+	return best
+}
+
+// mediaTypes of the formats, the first one is the main one.
+var mediaTypes = map[string][]string{ //nolint:gochecknoglobals
+	FormatHTML: {"text/html", "application/xhtml+xml"},
+	FormatJSON: {"application/problem+json", "application/json"},
+	FormatText: {"text/plain"},
+}
+
+// acceptQuality returns the quality of a format in an Accept header, the most specific media range applies.
+func acceptQuality(accept, format string) float64 {
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+		rangeSpecificity := -1
+		for _, mediaType := range mediaTypes[format] {
+			mainType, _, _ := strings.Cut(mediaType, "/")
+			switch {
+			case mediaRange == mediaType:
+				rangeSpecificity = 2
+			case mediaRange == mainType+"/*" && rangeSpecificity < 1:
+				rangeSpecificity = 1
+			case mediaRange == "*/*" && rangeSpecificity < 0:
+				rangeSpecificity = 0
+			}
+		}
+		if rangeSpecificity > specificity {
+			quality, specificity = parseQuality(params), rangeSpecificity
+		}
+	}
+	return quality
+}
+
+func parseQuality(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(strings.TrimSpace(key), "q") {
+			if quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				return quality
+			}
+		}
+	}
+	return 1
+}
+
+// Language negotiates the language of a page with the Accept-Language header of the request,
+// among the available lowercase languages, or returns the default language.
+func Language(req *http.Request, languages []string, defaultLanguage string) string {
+	best, bestQuality := strings.ToLower(defaultLanguage), 0.0
+	for _, part := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		quality := parseQuality(params)
+		if tag == "" || quality <= bestQuality {
+			continue
+		}
+		if lang := matchLanguage(tag, languages, defaultLanguage); lang != "" {
+			best, bestQuality = lang, quality
+		}
+	}
+	return best
+}
+
+// matchLanguage returns the language matching a language range: the same language, the default language,
+// the primary language of the range (fr-ca matches fr) or one of its regional variants (pt matches pt-br).
+func matchLanguage(tag string, languages []string, defaultLanguage string) string {
+	for _, lang := range languages {
+		if lang == tag {
+			return lang
+		}
+	}
+	defaultLanguage = strings.ToLower(defaultLanguage)
+	primary, _, _ := strings.Cut(tag, "-")
+	if tag == "*" || tag == defaultLanguage || primary == defaultLanguage {
+		return defaultLanguage
+	}
+	variant := ""
+	for _, lang := range languages {
+		if lang == primary {
+			return lang
+		}
+		if variant == "" && strings.HasPrefix(lang, tag+"-") {
+			variant = lang
+		}
+	}
+	return variant
+}
@@ -0,0 +1,113 @@
+package response
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+		want   string
+	}{
+		{name: "Browser", path: "/", accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", want: FormatHTML},
+		{name: "Without Accept", path: "/", want: FormatHTML},
+		{name: "Any type", path: "/", accept: "*/*", want: FormatHTML},
+		{name: "JSON client", path: "/", accept: "application/json", want: FormatJSON},
+		{name: "Problem details client", path: "/", accept: "application/problem+json", want: FormatJSON},
+		{name: "Text client", path: "/", accept: "text/plain", want: FormatText},
+		{name: "Text preferred", path: "/", accept: "text/html;q=0.5, text/plain", want: FormatText},
+		{name: "HTML excluded", path: "/", accept: "text/html;q=0, */*", want: FormatJSON},
+		{name: "API without Accept", path: "/api/users", want: FormatJSON},
+		{name: "API with any type", path: "/api/users", accept: "*/*", want: FormatJSON},
+		{name: "API browser", path: "/api/users", accept: "text/html", want: FormatHTML},
+		{name: "Other path", path: "/apis", accept: "*/*", want: FormatHTML},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			if got := Format(req, []string{"/api/"}); got != tt.want {
+				t.Errorf("Format() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderer_Body(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "ban.json")
+	if err := os.WriteFile(jsonPath, []byte(`{"error":"{{ .Remediation }}","code":{{ .Status }}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	renderer, err := New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentType, body, err := renderer.Body(FormatJSON, NewData(http.StatusForbidden, "ban"))
+	if err != nil || contentType != ContentTypeProblem {
+		t.Fatalf("Body() = %v, %v", contentType, err)
+	}
+	var got problem
+	if err = json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != "about:blank" || got.Status != http.StatusForbidden || got.Title != "Forbidden" || got.Detail != DetailBan || got.Remediation != "ban" {
+		t.Errorf("Body() = %v, unexpected problem details", body)
+	}
+	_, body, _ = renderer.Body(FormatText, NewData(http.StatusForbidden, "captcha"))
+	if want := "403 Forbidden: " + DetailCaptcha + "\n"; body != want {
+		t.Errorf("Body() = %q, want %q", body, want)
+	}
+
+	renderer, err = New(jsonPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body, _ = renderer.Body(FormatJSON, NewData(http.StatusTooManyRequests, "captcha"))
+	if want := `{"error":"captcha","code":429}`; body != want {
+		t.Errorf("Body() = %v, want %v", body, want)
+	}
+	if _, err = New(filepath.Join(dir, "missing.txt"), ""); err == nil {
+		t.Error("New() should fail with a missing template")
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	languages := []string{"de", "fr", "pt-br"}
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		want           string
+	}{
+		{name: "Without Accept-Language", want: "en"},
+		{name: "Available language", acceptLanguage: "fr", want: "fr"},
+		{name: "Unavailable language", acceptLanguage: "es", want: "en"},
+		{name: "Preferred language", acceptLanguage: "es, de;q=0.8, fr;q=0.5", want: "de"},
+		{name: "Regional language", acceptLanguage: "fr-CA", want: "fr"},
+		{name: "Regional variant", acceptLanguage: "pt", want: "pt-br"},
+		{name: "Case insensitive", acceptLanguage: "PT-BR", want: "pt-br"},
+		{name: "Any language", acceptLanguage: "*", want: "en"},
+		{name: "Default preferred", acceptLanguage: "en-US, fr;q=0.9", want: "en"},
+		{name: "Excluded language", acceptLanguage: "fr;q=0", want: "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			if got := Language(req, languages, "EN"); got != tt.want {
+				t.Errorf("Language() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Package rules implements the matching of requests by their attributes (host, path, method, header)
+// to bypass the bouncer, enforce it, or force a remediation.
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Actions of a rule.
+const (
+	ActionBypass  = "bypass"
+	ActionEnforce = "enforce"
+	ActionBan     = "ban"
+	ActionCaptcha = "captcha"
+)
+
+// Rule matches requests, every non empty attribute must match.
+type Rule struct {
+	host         string
+	pathPrefix   string
+	pathRegex    *regexp.Regexp
+	methods      []string
+	header       string
+	headerValue  string
+	remediations []string
+	Action       string
+}
+
+// New creates a Rule. host is a glob (ex: *.example.com), pathRegex a regular expression,
+// the header must be present, with exactly headerValue if not empty.
+// The remediations (ban, captcha or throttle) of an enforce rule are applied only to the requests matching
+// an enforce rule listing them, see Restricts.
+func New(host, pathPrefix, pathRegex string, methods []string, header, headerValue, action string, remediations []string) (*Rule, error) {
+	action = strings.ToLower(strings.TrimSpace(action))
+	switch action {
+	case ActionBypass, ActionEnforce, ActionBan, ActionCaptcha:
+	default:
+		return nil, fmt.Errorf("rules:New action %q must be one of bypass, enforce, ban or captcha", action)
+	}
+	if len(remediations) > 0 && action != ActionEnforce {
+		return nil, errors.New("rules:New remediations need the enforce action")
+	}
+	rule := &Rule{
+		host:        strings.ToLower(strings.TrimSpace(host)),
+		pathPrefix:  pathPrefix,
+		header:      http.CanonicalHeaderKey(strings.TrimSpace(header)),
+		headerValue: headerValue,
+		Action:      action,
+	}
+	if rule.host != "" {
+		if _, err := path.Match(rule.host, ""); err != nil {
+			return nil, fmt.Errorf("rules:New host %q %w", host, err)
+		}
+	}
+	if pathRegex != "" {
+		reg, err := regexp.Compile(pathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("rules:New pathRegex %w", err)
+		}
+		rule.pathRegex = reg
+	}
+	for _, method := range methods {
+		rule.methods = append(rule.methods, strings.ToUpper(strings.TrimSpace(method)))
+	}
+	if rule.headerValue != "" && rule.header == "" {
+		return nil, errors.New("rules:New headerValue needs a header")
+	}
+	for _, remediation := range remediations {
+		remediation = strings.ToLower(strings.TrimSpace(remediation))
+		switch remediation {
+		case "ban", "captcha", "throttle":
+		default:
+			return nil, fmt.Errorf("rules:New remediation %q must be one of ban, captcha or throttle", remediation)
+		}
+		rule.remediations = append(rule.remediations, remediation)
+	}
+	return rule, nil
+}
+
+// Match checks that a request matches every attribute of the rule.
+func (r *Rule) Match(req *http.Request) bool {
+	if r.host != "" && !MatchHost(r.host, req.Host) {
+		return false
+	}
+	if r.pathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.pathPrefix) {
+		return false
+	}
+	if r.pathRegex != nil && !r.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(r.methods) > 0 && !r.matchMethod(req.Method) {
+		return false
+	}
+	if r.header != "" {
+		values, ok := req.Header[r.header]
+		if !ok || (r.headerValue != "" && (len(values) == 0 || values[0] != r.headerValue)) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchHost matches the host of a request, without its port, with a lowercase glob (ex: *.example.com).
+func MatchHost(pattern, host string) bool {
+	// Remove the port, IPv6 hosts are bracketed.
+	if colon := strings.LastIndexByte(host, ':'); colon >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:colon]
+	}
+	matched, _ := path.Match(pattern, strings.ToLower(host))
+	return matched
+}
+
+func (r *Rule) matchMethod(method string) bool {
+	for _, m := range r.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate returns the first rule matching the request, or nil.
+func Evaluate(rules []*Rule, req *http.Request) *Rule {
+	for _, rule := range rules {
+		if rule.Match(req) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Enforces reports whether the rule enforces the remediation: an enforce rule without remediations enforces them all.
+func (r *Rule) Enforces(remediation string) bool {
+	if r.Action != ActionEnforce {
+		return false
+	}
+	if len(r.remediations) == 0 {
+		return true
+	}
+	for _, enforced := range r.remediations {
+		if enforced == remediation {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricts reports whether the remediation is listed by an enforce rule,
+// it is then applied only to the requests matching one of these rules.
+func Restricts(rules []*Rule, remediation string) bool {
+	for _, rule := range rules {
+		if len(rule.remediations) > 0 && rule.Enforces(remediation) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package rules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name         string
+		host         string
+		pathRegex    string
+		header       string
+		headerValue  string
+		action       string
+		remediations []string
+		wantErr      bool
+	}{
+		{name: "Valid rule", host: "*.example.com", pathRegex: "^/api/", action: "Bypass", wantErr: false},
+		{name: "Unknown action", action: "allow", wantErr: true},
+		{name: "Invalid host glob", host: "[a-", action: ActionBan, wantErr: true},
+		{name: "Invalid path regex", pathRegex: "(", action: ActionBan, wantErr: true},
+		{name: "Header value without header", headerValue: "x", action: ActionBan, wantErr: true},
+		{name: "Enforced remediations", action: ActionEnforce, remediations: []string{"Captcha"}, wantErr: false},
+		{name: "Remediations of another action", action: ActionBypass, remediations: []string{"captcha"}, wantErr: true},
+		{name: "Unknown remediation", action: ActionEnforce, remediations: []string{"redirect"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.host, "", tt.pathRegex, nil, tt.header, tt.headerValue, tt.action, tt.remediations); (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	mustNew := func(host, pathPrefix, pathRegex string, methods []string, header, headerValue, action string) *Rule {
+		rule, err := New(host, pathPrefix, pathRegex, methods, header, headerValue, action, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rule
+	}
+	rules := []*Rule{
+		mustNew("", "/healthz", "", nil, "", "", ActionBypass),
+		mustNew("", "/.well-known/acme-challenge/", "", nil, "", "", ActionBypass),
+		mustNew("", "/webhooks/", "", []string{"post"}, "Stripe-Signature", "", ActionBypass),
+		mustNew("", "", "", []string{"OPTIONS"}, "", "", ActionBypass),
+		mustNew("admin.example.com", "", "", nil, "", "", ActionBan),
+		mustNew("*.example.com", "", `^/(login|signup)$`, nil, "", "", ActionCaptcha),
+		mustNew("", "", "", nil, "X-Env", "staging", ActionEnforce),
+	}
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "Health check", method: http.MethodGet, target: "http://www.example.com/healthz", want: ActionBypass},
+		{name: "ACME challenge", method: http.MethodGet, target: "http://www.example.com/.well-known/acme-challenge/token", want: ActionBypass},
+		{name: "Signed webhook", method: http.MethodPost, target: "http://www.example.com/webhooks/stripe", headers: map[string]string{"Stripe-Signature": "t=1"}, want: ActionBypass},
+		{name: "Unsigned webhook", method: http.MethodPost, target: "http://www.example.com/webhooks/stripe", want: ""},
+		{name: "Webhook with another method", method: http.MethodGet, target: "http://www.example.com/webhooks/stripe", headers: map[string]string{"Stripe-Signature": "t=1"}, want: ""},
+		{name: "Preflight", method: http.MethodOptions, target: "http://www.example.com/api", want: ActionBypass},
+		{name: "Host with port", method: http.MethodGet, target: "http://ADMIN.example.com:8443/", want: ActionBan},
+		{name: "Captcha on login", method: http.MethodPost, target: "http://www.example.com/login", want: ActionCaptcha},
+		{name: "Login on another domain", method: http.MethodPost, target: "http://www.example.org/login", want: ""},
+		{name: "Header value", method: http.MethodGet, target: "http://www.example.org/", headers: map[string]string{"X-Env": "staging"}, want: ActionEnforce},
+		{name: "Other header value", method: http.MethodGet, target: "http://www.example.org/", headers: map[string]string{"X-Env": "prod"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			got := ""
+			if rule := Evaluate(rules, req); rule != nil {
+				got = rule.Action
+			}
+			if got != tt.want {
+				t.Errorf("Evaluate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestricts(t *testing.T) {
+	login, _ := New("", "/login", "", nil, "", "", ActionEnforce, []string{"captcha"})
+	staging, _ := New("", "", "", nil, "X-Env", "staging", ActionEnforce, nil)
+	rules := []*Rule{login, staging}
+	tests := []struct {
+		name        string
+		rule        *Rule
+		remediation string
+		restricted  bool
+		enforced    bool
+	}{
+		{name: "Listed remediation", rule: login, remediation: "captcha", restricted: true, enforced: true},
+		{name: "Remediation not listed", rule: login, remediation: "ban", restricted: false, enforced: false},
+		{name: "Enforce rule without remediations", rule: staging, remediation: "captcha", restricted: true, enforced: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Restricts(rules, tt.remediation); got != tt.restricted {
+				t.Errorf("Restricts() = %v, want %v", got, tt.restricted)
+			}
+			if got := tt.rule.Enforces(tt.remediation); got != tt.enforced {
+				t.Errorf("Enforces() = %v, want %v", got, tt.enforced)
+			}
+		})
+	}
+}
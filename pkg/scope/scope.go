@@ -0,0 +1,178 @@
+// Package scope implements the extraction of custom decision scopes from requests.
+// A custom scope (ex: username, api_key) is read from a header, a cookie or a claim of a JWT.
+package scope
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Reserved scopes are enforced by the bouncer itself and cannot be custom scopes.
+//
+//nolint:gochecknoglobals
+var Reserved = []string{"ip", "range", "country", "as"}
+
+// Extractor reads the value of a custom scope from a request.
+type Extractor struct {
+	Scope  string
+	header string
+	cookie string
+	claim  string
+	secret []byte
+}
+
+// New creates an Extractor of a scope, only one of header, cookie and claim is expected.
+// The claim is read from the bearer token of the Authorization header, its signature is
+// verified (HS256, HS384, HS512) when a secret is given.
+func New(scope, header, cookie, claim, secret string) *Extractor {
+	extractor := &Extractor{
+		Scope:  scope,
+		header: header,
+		cookie: cookie,
+		claim:  claim,
+	}
+	if secret != "" {
+		extractor.secret = []byte(secret)
+	}
+	return extractor
+}
+
+// Parse creates an Extractor from a definition <scope>=<source>:<name>, the source being
+// header, cookie or jwt (ex: api_key=header:X-Api-Key, session=cookie:sid, username=jwt:sub).
+// The secret is used to verify JWT signatures, tokens are not verified if it is empty.
+func Parse(definition, secret string) (*Extractor, error) {
+	scope, source, found := strings.Cut(strings.TrimSpace(definition), "=")
+	if !found || scope == "" {
+		return nil, fmt.Errorf("scope:Parse %q must be <scope>=<source>:<name>", definition)
+	}
+	for _, reserved := range Reserved {
+		if strings.EqualFold(scope, reserved) {
+			return nil, fmt.Errorf("scope:Parse %q is a reserved scope", scope)
+		}
+	}
+	kind, name, found := strings.Cut(source, ":")
+	if !found || name == "" {
+		return nil, fmt.Errorf("scope:Parse %q must be <scope>=<source>:<name>", definition)
+	}
+	switch strings.ToLower(kind) {
+	case "header":
+		return New(scope, name, "", "", ""), nil
+	case "cookie":
+		return New(scope, "", name, "", ""), nil
+	case "jwt":
+		return New(scope, "", "", name, secret), nil
+	default:
+		return nil, fmt.Errorf("scope:Parse source %q must be one of header, cookie or jwt", kind)
+	}
+}
+
+// Key returns the cache key of the decisions on a value of a scope.
+func Key(scope, value string) string {
+	return strings.ToLower(scope) + ":" + value
+}
+
+// Value returns the value of the scope in the request, or the empty string if it is absent.
+func (e *Extractor) Value(req *http.Request) (string, error) {
+	switch {
+	case e.header != "":
+		return strings.TrimSpace(req.Header.Get(e.header)), nil
+	case e.cookie != "":
+		cookie, err := req.Cookie(e.cookie)
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	case e.claim != "":
+		authorization := req.Header.Get("Authorization")
+		if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+			return "", nil
+		}
+		return e.claimValue(strings.TrimSpace(authorization[7:]))
+	}
+	return "", nil
+}
+
+// claimValue returns the claim of a JWT as a string.
+func (e *Extractor) claimValue(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("scope:claimValue token is not a JWT")
+	}
+	if e.secret != nil {
+		if err := e.verify(parts); err != nil {
+			return "", err
+		}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("scope:claimValue decode payload %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var claims map[string]interface{}
+	if err = decoder.Decode(&claims); err != nil {
+		return "", fmt.Errorf("scope:claimValue parse payload %w", err)
+	}
+	if e.secret != nil {
+		if exp, ok := claims["exp"].(json.Number); ok {
+			if expiration, errExp := exp.Int64(); errExp == nil && time.Now().Unix() >= expiration {
+				return "", errors.New("scope:claimValue token expired")
+			}
+		}
+	}
+	switch value := claims[e.claim].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	default:
+		return fmt.Sprint(value), nil
+	}
+}
+
+// verify checks the HMAC signature of a JWT, tokens using another algorithm (or none) are rejected.
+func (e *Extractor) verify(parts []string) error {
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("scope:verify decode header %w", err)
+	}
+	var jwtHeader struct {
+		Alg string `json:"alg"`
+	}
+	if err = json.Unmarshal(header, &jwtHeader); err != nil {
+		return fmt.Errorf("scope:verify parse header %w", err)
+	}
+	var hashFunc func() hash.Hash
+	switch jwtHeader.Alg {
+	case "HS256":
+		hashFunc = sha256.New
+	case "HS384":
+		hashFunc = sha512.New384
+	case "HS512":
+		hashFunc = sha512.New
+	default:
+		return fmt.Errorf("scope:verify unsupported alg:%s", jwtHeader.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("scope:verify decode signature %w", err)
+	}
+	mac := hmac.New(hashFunc, e.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.New("scope:verify invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package scope
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func signedToken(alg, payload, secret string) string {
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"`+alg+`","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestExtractor_Value(t *testing.T) {
+	valid := signedToken("HS256", `{"sub":"alice","uid":42}`, "secret")
+	expired := signedToken("HS256", `{"sub":"alice","exp":1}`, "secret")
+	none := signedToken("none", `{"sub":"alice"}`, "secret")
+	tests := []struct {
+		name      string
+		extractor *Extractor
+		header    map[string]string
+		cookie    *http.Cookie
+		want      string
+		wantErr   bool
+	}{
+		{name: "Header", extractor: New("api_key", "X-Api-Key", "", "", ""), header: map[string]string{"X-Api-Key": " key1 "}, want: "key1"},
+		{name: "Missing header", extractor: New("api_key", "X-Api-Key", "", "", ""), want: ""},
+		{name: "Cookie", extractor: New("session", "", "session", "", ""), cookie: &http.Cookie{Name: "session", Value: "abc"}, want: "abc"},
+		{name: "Missing cookie", extractor: New("session", "", "session", "", ""), want: ""},
+		{name: "Unverified claim", extractor: New("username", "", "", "sub", ""), header: map[string]string{"Authorization": "Bearer " + none}, want: "alice"},
+		{name: "Numeric claim", extractor: New("user_id", "", "", "uid", ""), header: map[string]string{"Authorization": "bearer " + valid}, want: "42"},
+		{name: "Verified claim", extractor: New("username", "", "", "sub", "secret"), header: map[string]string{"Authorization": "Bearer " + valid}, want: "alice"},
+		{name: "Missing claim", extractor: New("username", "", "", "name", ""), header: map[string]string{"Authorization": "Bearer " + valid}, want: ""},
+		{name: "Bad signature", extractor: New("username", "", "", "sub", "other"), header: map[string]string{"Authorization": "Bearer " + valid}, wantErr: true},
+		{name: "Alg none rejected", extractor: New("username", "", "", "sub", "secret"), header: map[string]string{"Authorization": "Bearer " + none}, wantErr: true},
+		{name: "Expired verified token", extractor: New("username", "", "", "sub", "secret"), header: map[string]string{"Authorization": "Bearer " + expired}, wantErr: true},
+		{name: "Not a JWT", extractor: New("username", "", "", "sub", ""), header: map[string]string{"Authorization": "Bearer abc"}, wantErr: true},
+		{name: "Basic authorization", extractor: New("username", "", "", "sub", ""), header: map[string]string{"Authorization": "Basic YWxpY2U6cGFzcw=="}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			for key, value := range tt.header {
+				req.Header.Set(key, value)
+			}
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			got, err := tt.extractor.Value(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Value() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Value() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		definition string
+		want       *Extractor
+		wantErr    bool
+	}{
+		{definition: "api_key=header:X-Api-Key", want: &Extractor{Scope: "api_key", header: "X-Api-Key"}},
+		{definition: " session=Cookie:sid", want: &Extractor{Scope: "session", cookie: "sid"}},
+		{definition: "username=jwt:sub", want: &Extractor{Scope: "username", claim: "sub", secret: []byte("secret")}},
+		{definition: "username", wantErr: true},
+		{definition: "=header:X-User", wantErr: true},
+		{definition: "username=header:", wantErr: true},
+		{definition: "username=query:user", wantErr: true},
+		{definition: "Ip=header:X-Ip", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.definition, func(t *testing.T) {
+			got, err := Parse(tt.definition, "secret")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	if got := Key("Username", "Alice"); got != "username:Alice" {
+		t.Errorf("Key() = %v, want username:Alice", got)
+	}
+}
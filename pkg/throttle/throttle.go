@@ -0,0 +1,77 @@
+// Package throttle implements a token bucket rate limiter per key,
+// stored in the cache so that limits are shared by the cluster when Redis is used.
+package throttle
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	cache "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/cache"
+)
+
+const keyPrefix = "throttle:"
+
+// Limiter allows requests at a rate with a burst.
+type Limiter struct {
+	cacheClient *cache.Client
+	rate        float64
+	burst       float64
+	ttl         int64
+}
+
+// New creates a Limiter allowing requests per period, with bursts of burst requests.
+func New(cacheClient *cache.Client, requests, periodSeconds, burst int64) *Limiter {
+	rate := float64(requests) / float64(periodSeconds)
+	return &Limiter{
+		cacheClient: cacheClient,
+		rate:        rate,
+		burst:       float64(burst),
+		// An unused bucket is full again after burst/rate seconds, it can be forgotten.
+		ttl: int64(math.Ceil(float64(burst)/rate)) + 1,
+	}
+}
+
+// Allow takes a token from the bucket of key, or returns how long to wait for the next one.
+// Concurrent requests may read the same bucket, the limit is approximate.
+func (l *Limiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	tokens := l.burst
+	if value, err := l.cacheClient.Get(keyPrefix + key); err == nil {
+		if stored, last, ok := parse(value); ok {
+			elapsed := now.Sub(time.Unix(0, last)).Seconds()
+			if elapsed < 0 {
+				elapsed = 0
+			}
+			tokens = math.Min(l.burst, stored+elapsed*l.rate)
+		}
+	}
+	if tokens < 1 {
+		l.cacheClient.Set(keyPrefix+key, format(tokens, now), l.ttl)
+		return false, time.Duration((1 - tokens) / l.rate * float64(time.Second))
+	}
+	l.cacheClient.Set(keyPrefix+key, format(tokens-1, now), l.ttl)
+	return true, 0
+}
+
+// format stores the tokens left and the time of the last request: <tokens>,<unix nanoseconds>.
+func format(tokens float64, now time.Time) string {
+	return fmt.Sprintf("%s,%d", strconv.FormatFloat(tokens, 'f', 3, 64), now.UnixNano())
+}
+
+func parse(value string) (float64, int64, bool) {
+	rawTokens, rawLast, found := strings.Cut(value, ",")
+	if !found {
+		return 0, 0, false
+	}
+	tokens, err := strconv.ParseFloat(rawTokens, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	last, err := strconv.ParseInt(rawLast, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return tokens, last, true
+}
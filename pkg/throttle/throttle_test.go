@@ -0,0 +1,41 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+
+	cache "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/cache"
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	cacheClient := &cache.Client{}
+	cacheClient.New(logger.New("INFO", ""), false, false, "", "", "", "")
+	// 2 requests per second, bursts of 3 requests.
+	limiter := New(cacheClient, 2, 1, 3)
+	defer cacheClient.Delete(keyPrefix + "192.0.2.1")
+	defer cacheClient.Delete(keyPrefix + "192.0.2.2")
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name           string
+		key            string
+		at             time.Duration
+		want           bool
+		wantRetryAfter time.Duration
+	}{
+		{name: "Burst 1", key: "192.0.2.1", want: true},
+		{name: "Burst 2", key: "192.0.2.1", want: true},
+		{name: "Burst 3", key: "192.0.2.1", want: true},
+		{name: "Burst exceeded", key: "192.0.2.1", want: false, wantRetryAfter: 500 * time.Millisecond},
+		{name: "Other key", key: "192.0.2.2", want: true},
+		{name: "Refilled token", key: "192.0.2.1", at: 500 * time.Millisecond, want: true},
+		{name: "Empty again", key: "192.0.2.1", at: 500 * time.Millisecond, want: false, wantRetryAfter: 500 * time.Millisecond},
+		{name: "Refilled burst", key: "192.0.2.1", at: 10 * time.Second, want: true},
+	}
+	for _, tt := range tests {
+		got, retryAfter := limiter.Allow(tt.key, now.Add(tt.at))
+		if got != tt.want || retryAfter != tt.wantRetryAfter {
+			t.Errorf("%s: Allow() = %v, %v, want %v, %v", tt.name, got, retryAfter, tt.want, tt.wantRetryAfter)
+		}
+	}
+}